@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strconv"
+)
+
+const (
+	chatSettingMaxTokens    = "max_tokens"
+	chatSettingShortReplies = "short_replies"
+
+	defaultAdaptiveMaxTokensMin = 64
+	defaultAdaptiveMaxTokensMax = 1024
+
+	finishReasonLength = "length"
+
+	// shortRepliesToShrink is the number of consecutive replies using less than half of the limit that lowers it.
+	shortRepliesToShrink = 3
+)
+
+// adaptMaxTokens returns the new limit of tokens to generate and the number of consecutive short replies,
+// given the reply generated with the current limit. The limit grows by half when the reply is cut off,
+// and shrinks by a quarter after several replies in a row take less than half of it.
+func adaptMaxTokens(limit, shortReplies int, finishReason string, tokens, min, max int) (int, int) {
+	switch {
+	case finishReason == finishReasonLength:
+		limit, shortReplies = limit*3/2, 0
+	case tokens < limit/2:
+		shortReplies++
+		if shortReplies >= shortRepliesToShrink {
+			limit, shortReplies = limit*3/4, 0
+		}
+	default:
+		shortReplies = 0
+	}
+
+	if limit < min {
+		limit = min
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, shortReplies
+}
+
+// chatMaxTokensToGenerate returns how many tokens may be generated in reply to the user's prompt in the chat,
+// and whether the limit is adapted to the replies. Limit the user has set with /maxtokens is used as is,
+// the same as the limit of /think questions.
+func (p *messageProcessor) chatMaxTokensToGenerate(ctx context.Context, chatID int64, userID int, prompt modelPrompt) (int, bool) {
+	if think, ok := thinking(ctx); ok {
+		return min(think.maxTokens, prompt.contextLength()-p.countPromptTokens(prompt)), false
+	}
+	userLimit, err := p.settings.UserMaxTokens(ctx, userID)
+	if err != nil {
+		slog.Error("failed to get user max tokens to generate", "error", err)
+	}
+	if userLimit > 0 {
+		return min(userLimit, prompt.contextLength()-p.countPromptTokens(prompt)), false
+	}
+	if !p.adaptiveMaxTokens {
+		return p.maxTokensToGenerate, false
+	}
+
+	limit := p.maxTokensToGenerate
+	if value, err := p.settings.ChatSetting(ctx, chatID, chatSettingMaxTokens); err != nil {
+		slog.Error("failed to get chat max tokens to generate", "error", err)
+	} else if value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			slog.Error("failed to parse chat max tokens to generate", "error", err)
+			limit = p.maxTokensToGenerate
+		}
+	}
+
+	// Prompt is built to leave room for the default limit only, a larger one must not exceed the model context
+	if available := prompt.contextLength() - p.countPromptTokens(prompt); limit > available {
+		limit = available
+	}
+	return limit, true
+}
+
+// adaptMaxTokensToGenerate tunes the limit of tokens to generate in the chat after the reply.
+func (p *messageProcessor) adaptMaxTokensToGenerate(ctx context.Context, chatID int64, c completion, maxTokens int) {
+	if !p.adaptiveMaxTokens || c.Cached {
+		return
+	}
+
+	shortReplies := 0
+	if value, err := p.settings.ChatSetting(ctx, chatID, chatSettingShortReplies); err != nil {
+		slog.Error("failed to get chat short replies count", "error", err)
+	} else if value != "" {
+		shortReplies, _ = strconv.Atoi(value)
+	}
+
+	// Generated tokens are counted for all choices together, the limit applies to each of them
+	tokens := c.Tokens / (len(c.Alternatives) + 1)
+	limit, shortReplies := adaptMaxTokens(maxTokens, shortReplies, c.FinishReason, tokens, p.adaptiveMaxTokensMin, p.adaptiveMaxTokensMax)
+	if limit != maxTokens {
+		log.Printf("max tokens to generate is changed from %d to %d\n", maxTokens, limit)
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingMaxTokens, strconv.Itoa(limit)); err != nil {
+		slog.Error("failed to save chat max tokens to generate", "error", err)
+	}
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingShortReplies, strconv.Itoa(shortReplies)); err != nil {
+		slog.Error("failed to save chat short replies count", "error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestAdaptMaxTokens(t *testing.T) {
+	const start, min, max = 200, 64, 1024
+
+	type reply struct {
+		finishReason string
+		tokens       int
+	}
+	tests := []struct {
+		name    string
+		replies []reply
+		want    int
+	}{
+		{name: "cut off reply raises the limit", replies: []reply{{finishReasonLength, 200}}, want: 300},
+		{name: "cut off replies keep raising it", replies: []reply{{finishReasonLength, 200}, {finishReasonLength, 300}}, want: 450},
+		{name: "raised up to the maximum", replies: []reply{{finishReasonLength, 200}, {finishReasonLength, 300}, {finishReasonLength, 450}, {finishReasonLength, 675}, {finishReasonLength, 1012}}, want: max},
+		{name: "few short replies keep the limit", replies: []reply{{"stop", 20}, {"stop", 20}}, want: start},
+		{name: "short replies in a row lower the limit", replies: []reply{{"stop", 20}, {"stop", 20}, {"stop", 20}}, want: 150},
+		{name: "long reply breaks the row of short ones", replies: []reply{{"stop", 20}, {"stop", 20}, {"stop", 150}, {"stop", 20}}, want: start},
+		{
+			name:    "lowered down to the minimum",
+			replies: []reply{{"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}, {"stop", 1}},
+			want:    min,
+		},
+		{name: "cut off reply after short ones raises the limit", replies: []reply{{"stop", 20}, {"stop", 20}, {finishReasonLength, 200}}, want: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, shortReplies := start, 0
+			for _, r := range tt.replies {
+				limit, shortReplies = adaptMaxTokens(limit, shortReplies, r.finishReason, r.tokens, min, max)
+			}
+			if limit != tt.want {
+				t.Errorf("limit = %d, want %d", limit, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveMaxTokensInRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		finishReasons []openai.FinishReason
+		// wantMaxTokens is the limit of the next request after the replies.
+		wantMaxTokens int
+	}{
+		{name: "first request", wantMaxTokens: 100},
+		{name: "after cut off reply", finishReasons: []openai.FinishReason{openai.FinishReasonLength}, wantMaxTokens: 150},
+		{name: "after short replies", finishReasons: []openai.FinishReason{openai.FinishReasonStop, openai.FinishReasonStop, openai.FinishReasonStop}, wantMaxTokens: 75},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Fake replies take 5 tokens, which is short for any limit in the test
+			completions := &fakeChatCompletions{}
+			for _, reason := range tt.finishReasons {
+				completions.replies = append(completions.replies, chatChoice("hi", reason))
+			}
+			completions.replies = append(completions.replies, chatChoice("hi", openai.FinishReasonStop))
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.adaptiveMaxTokens = true
+			p.adaptiveMaxTokensMin, p.adaptiveMaxTokensMax = 10, 1000
+
+			for range tt.finishReasons {
+				p.processMessage(context.Background(), privateMessage(1, "hello"))
+			}
+			p.processMessage(context.Background(), privateMessage(1, "hello"))
+
+			if got := completions.lastRequest().MaxTokens; got != tt.wantMaxTokens {
+				t.Errorf("max tokens = %d, want %d", got, tt.wantMaxTokens)
+			}
+		})
+	}
+}
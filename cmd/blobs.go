@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	blobStoreLocal = "local"
+
+	defaultBlobStoreBackend = blobStoreLocal
+	defaultBlobStoreDirName = "blobs"
+)
+
+var errBlobNotFound = errors.New("blob is not found")
+
+// blobStore persists binary attachments, such as generated images and downloaded media, under a key,
+// so that they can be referenced later instead of being fetched again.
+type blobStore interface {
+	Put(ctx context.Context, key string, data io.Reader) error
+	// Get returns errBlobNotFound if there is nothing stored under the key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// newBlobStore creates the blob store of the backend, location is interpreted by the backend.
+func newBlobStore(backend, location string) (blobStore, error) {
+	switch backend {
+	case blobStoreLocal:
+		return newLocalBlobStore(location)
+	default:
+		return nil, fmt.Errorf("unsupported blob store backend '%v'", backend)
+	}
+}
+
+// localBlobStore keeps blobs as files in a directory, keys may contain slashes to group blobs into subdirectories.
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob store directory: %w", err)
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, data io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	// Blob is written to a temporary file first, so that a partially written one is never returned by Get
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob '%v': %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob '%v': %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save blob '%v': %w", key, err)
+	}
+	return nil
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: '%v'", errBlobNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob '%v': %w", key, err)
+	}
+	return f, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if key == "" || !fs.ValidPath(key) || strings.HasPrefix(filepath.Base(key), ".tmp-") {
+		return "", fmt.Errorf("invalid blob key '%v'", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// promptNormalizers are rules applied to the prompt to build the completion cache key.
+// Rules are set via COMPLETION_CACHE_NORMALIZE as a comma-separated list.
+var promptNormalizers = map[string]func(string) string{
+	"trim":  strings.TrimSpace,
+	"lower": strings.ToLower,
+	"spaces": func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	},
+	"punctuation": func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsPunct(r) {
+				return -1
+			}
+			return r
+		}, s)
+	},
+}
+
+// completionCache keeps completions of recent prompts, so that similar prompts don't hit the model again.
+// The whole completion is kept, with the alternatives and the finish reason.
+// Prompts are the same to the cache if they are equal after normalization.
+// The oldest entry is evicted when the cache is full. Nil cache is disabled.
+type completionCache struct {
+	mu          sync.Mutex
+	maxEntries  int
+	normalizers []func(string) string
+	entries     map[string]completion
+	keys        []string
+}
+
+func newCompletionCache(maxEntries int, normalize string) (*completionCache, error) {
+	c := &completionCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]completion, maxEntries),
+	}
+
+	for _, rule := range strings.Split(normalize, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		normalizer, ok := promptNormalizers[rule]
+		if !ok {
+			return nil, fmt.Errorf("unknown prompt normalization rule '%v'", rule)
+		}
+		c.normalizers = append(c.normalizers, normalizer)
+	}
+	return c, nil
+}
+
+func (c *completionCache) key(prompt string) string {
+	for _, normalize := range c.normalizers {
+		prompt = normalize(prompt)
+	}
+	return prompt
+}
+
+func (c *completionCache) get(prompt string) (completion, bool) {
+	if c == nil {
+		return completion{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	completion, ok := c.entries[c.key(prompt)]
+	return completion, ok
+}
+
+func (c *completionCache) put(prompt string, completion completion) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(prompt)
+	if _, ok := c.entries[key]; !ok {
+		if len(c.keys) >= c.maxEntries {
+			delete(c.entries, c.keys[0])
+			c.keys = c.keys[1:]
+		}
+		c.keys = append(c.keys, key)
+	}
+	c.entries[key] = completion
+}
+
+func (c *completionCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]completion, c.maxEntries)
+	c.keys = nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestCompletionCacheKey(t *testing.T) {
+	prompt := modelPrompt{model: openai.GPT3Dot5Turbo, messages: []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "Hello"},
+	}}
+	withModel := prompt
+	withModel.model = openai.GPT4
+	withSampling := prompt
+	withSampling.sampling = &samplingParams{temperature: 0.2}
+	withOwner := prompt
+	withOwner.ownerID = 2
+
+	tests := []struct {
+		name      string
+		prompt    modelPrompt
+		maxTokens int
+		choices   int
+		wantSame  bool
+	}{
+		{name: "same prompt, limit and choices", prompt: prompt, maxTokens: 100, choices: 1, wantSame: true},
+		{name: "other limit of tokens to generate", prompt: prompt, maxTokens: 200, choices: 1},
+		{name: "other number of choices", prompt: prompt, maxTokens: 100, choices: 3},
+		{name: "other model", prompt: withModel, maxTokens: 100, choices: 1},
+		{name: "other sampling parameters", prompt: withSampling, maxTokens: 100, choices: 1},
+		{name: "other owner", prompt: withOwner, maxTokens: 100, choices: 1},
+	}
+	base := completionCacheKey(prompt, 100, 1)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := completionCacheKey(tt.prompt, tt.maxTokens, tt.choices) == base; same != tt.wantSame {
+				t.Errorf("key is the same = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestCachedReplyIsNotSharedBetweenUsers(t *testing.T) {
+	ctx := context.Background()
+	completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{
+		chatChoice("reply to the first user", openai.FinishReasonStop),
+		chatChoice("reply to the second user", openai.FinishReasonStop),
+	}}
+	telegram := &fakeTelegram{}
+	p := newTestProcessor(t, telegram, completions)
+	cache, err := newCompletionCache(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.completionCache = cache
+
+	// Both conversations are seeded the same way, so the prompts are equal
+	p.processMessage(ctx, privateMessage(1, "hello"))
+	p.processMessage(ctx, privateMessage(2, "hello"))
+
+	if len(completions.requests) != 2 {
+		t.Errorf("requests = %d, want the second user answered by the model", len(completions.requests))
+	}
+	if got := telegram.last(); got != "reply to the second user" {
+		t.Errorf("reply = %q, want the reply to the second user", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandCancel = "cancel"
+
+	cancelledMessage       = "Cancelled."
+	nothingToCancelMessage = "There is no reply being generated."
+)
+
+// The reply being generated can be cancelled with /cancel. The command is handled as soon as it is received,
+// not by the worker of the conversation, which is busy with the reply until it is done.
+
+// startCancellableCompletion returns the context of the completion that is cancelled by /cancel in the conversation,
+// the returned function has to be called once the completion is done.
+func (p *messageProcessor) startCancellableCompletion(ctx context.Context, ownerID int) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p.activeCompletionsMu.Lock()
+	defer p.activeCompletionsMu.Unlock()
+
+	if p.activeCompletions == nil {
+		p.activeCompletions = make(map[int]context.CancelFunc)
+	}
+	p.activeCompletions[ownerID] = cancel
+
+	return ctx, func() {
+		p.activeCompletionsMu.Lock()
+		defer p.activeCompletionsMu.Unlock()
+
+		delete(p.activeCompletions, ownerID)
+		cancel()
+	}
+}
+
+// cancelCompletion cancels the completion being generated in the conversation, returns false if there is none.
+func (p *messageProcessor) cancelCompletion(ownerID int) bool {
+	p.activeCompletionsMu.Lock()
+	defer p.activeCompletionsMu.Unlock()
+
+	cancel, ok := p.activeCompletions[ownerID]
+	if ok {
+		cancel()
+		delete(p.activeCompletions, ownerID)
+	}
+	return ok
+}
+
+// isCancelCommand reports whether the message is /cancel, it is handled before the message is queued to the worker.
+func isCancelCommand(msg *tgbotapi.Message) bool {
+	return msg.IsCommand() && msg.Command() == commandCancel
+}
+
+// handleCancelCommand aborts the reply being generated in the conversation,
+// the reply itself answers with cancelledMessage and saves nothing to the history.
+func (p *messageProcessor) handleCancelCommand(update tgbotapi.Update) {
+	if !p.cancelCompletion(conversationOwnerID(update.Message)) {
+		sendTextMessage(p.bot, update.Message.Chat.ID, "", nothingToCancelMessage)
+	}
+}
+
+// isReplyCancelled reports whether the reply is cancelled with /cancel, the user is told so if it is.
+func (p *messageProcessor) isReplyCancelled(ctx, completionCtx context.Context, update tgbotapi.Update, parseMode string) bool {
+	if !errors.Is(completionCtx.Err(), context.Canceled) || ctx.Err() != nil {
+		return false
+	}
+	log.Println("reply is cancelled by the user")
+	sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, cancelledMessage)
+	return true
+}
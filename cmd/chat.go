@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"text/template"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// chatMessageTokensOverhead is the number of tokens each chat message takes in addition to its content.
+	chatMessageTokensOverhead = 4
+	// chatReplyTokensOverhead is the number of tokens the reply is primed with.
+	chatReplyTokensOverhead = 3
+)
+
+// modelPrompt is the request to the model: the prompt text for the completion API,
+// or the conversation messages for the chat API.
+type modelPrompt struct {
+	// model is the name of the model the prompt is built for.
+	model    string
+	text     string
+	messages []openai.ChatCompletionMessage
+	// ownerID is the owner of the conversation the prompt is built from, zero for the prompt without history.
+	ownerID int
+	// system and rows are what the text is rendered from, so that it can be rendered again with less history.
+	system string
+	rows   []promptRow
+	// sampling overrides the configured sampling parameters if it is set, e.g. for /think.
+	sampling *samplingParams
+}
+
+// contextLength returns the context window of the model the prompt is built for.
+func (m modelPrompt) contextLength() int {
+	return modelContextLength(m.model)
+}
+
+// String returns the prompt as the model sees it, chat messages are prefixed with their roles.
+func (m modelPrompt) String() string {
+	if m.messages == nil {
+		return m.text
+	}
+	parts := make([]string, 0, len(m.messages))
+	for _, msg := range m.messages {
+		parts = append(parts, msg.Role+": "+msg.Content)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// LogValue logs the prompt as the model sees it, it is only rendered if the record is actually logged.
+func (m modelPrompt) LogValue() slog.Value {
+	return slog.StringValue(m.String())
+}
+
+// textPrompt returns the prompt consisting of the text only, without conversation history.
+func (p *messageProcessor) textPrompt(text string) modelPrompt {
+	if p.model.completionAPI {
+		return modelPrompt{model: p.model.name, text: text}
+	}
+	return modelPrompt{model: p.model.name, messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: text}}}
+}
+
+// countPromptTokens returns the number of tokens the prompt takes in the model context.
+func (p *messageProcessor) countPromptTokens(prompt modelPrompt) int {
+	countTokens := p.tokenCounterFor(prompt.model)
+	if prompt.messages == nil {
+		return countTokens(prompt.text)
+	}
+	return countChatTokens(countTokens, prompt.messages)
+}
+
+func countChatTokens(countTokens tokenCounter, messages []openai.ChatCompletionMessage) int {
+	tokens := chatReplyTokensOverhead
+	for _, msg := range messages {
+		tokens += chatMessageTokensOverhead + countTokens(msg.Content)
+	}
+	return tokens
+}
+
+// buildChatMessagesFromHistory is the same as buildPromptFromHistory, but builds messages for the chat API:
+// the system prompt is the system message, followed by human and AI messages with user and assistant roles.
+// It also returns the ID of the newest message trimmed from the conversation, zero if nothing is trimmed.
+func buildChatMessagesFromHistory(
+	countTokens tokenCounter,
+	contextLength int,
+	maxTokensToGenerate int,
+	system string,
+	history []*dbMessage,
+	humanMessage string,
+) ([]openai.ChatCompletionMessage, int, error) {
+	exchanges := groupExchanges(history, humanMessage)
+	rows := flattenExchanges(exchanges)
+
+	var (
+		messages []openai.ChatCompletionMessage
+		trimmed  int
+	)
+	err := trimExchanges(exchanges, func(deleted int) (bool, error) {
+		messages = chatMessages(system, rows[countRows(exchanges[:deleted]):])
+		trimmed = deleted
+		return countChatTokens(countTokens, messages)+maxTokensToGenerate <= contextLength, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, lastMessageID(exchanges[:trimmed]), nil
+}
+
+func chatMessages(system string, rows []promptRow) []openai.ChatCompletionMessage {
+	messages := make([]openai.ChatCompletionMessage, 0, len(rows)+1)
+	if system != "" {
+		messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system})
+	}
+	for _, row := range rows {
+		role := openai.ChatMessageRoleAssistant
+		if row.human {
+			role = openai.ChatMessageRoleUser
+		}
+		messages = append(messages, openai.ChatCompletionMessage{Role: role, Content: row.text})
+	}
+	return messages
+}
+
+// shrinkPrompt drops the older half of the conversation history from the prompt, see shrinkChatPrompt.
+// Returns false if there is no history to drop.
+func (p *messageProcessor) shrinkPrompt(prompt modelPrompt) (modelPrompt, bool) {
+	if prompt.messages == nil {
+		return shrinkTextPrompt(p.promptTemplate, prompt)
+	}
+	return shrinkChatPrompt(prompt)
+}
+
+// shrinkTextPrompt renders the text prompt again without the older half of its rows, the same way as shrinkChatPrompt.
+func shrinkTextPrompt(promptTemplate *template.Template, prompt modelPrompt) (modelPrompt, bool) {
+	if len(prompt.rows) <= 1 {
+		return prompt, false
+	}
+
+	history, last := prompt.rows[:len(prompt.rows)-1], prompt.rows[len(prompt.rows)-1]
+	history = history[len(history)/2+len(history)%2:]
+	for len(history) > 0 && !history[0].human {
+		history = history[1:]
+	}
+
+	rows := append(append(make([]promptRow, 0, len(history)+1), history...), last)
+	text, err := renderPrompt(promptTemplate, prompt.system, rows)
+	if err != nil {
+		return prompt, false
+	}
+	return modelPrompt{model: prompt.model, ownerID: prompt.ownerID, text: text, system: prompt.system, rows: rows, sampling: prompt.sampling}, true
+}
+
+// shrinkChatPrompt drops the older half of the conversation history from the chat prompt,
+// keeping the system message and the last human message. Returns false if there is no history to drop.
+func shrinkChatPrompt(prompt modelPrompt) (modelPrompt, bool) {
+	messages := prompt.messages
+	if len(messages) == 0 {
+		return prompt, false
+	}
+
+	var system []openai.ChatCompletionMessage
+	if messages[0].Role == openai.ChatMessageRoleSystem {
+		system, messages = messages[:1], messages[1:]
+	}
+	if len(messages) <= 1 {
+		return prompt, false
+	}
+
+	// Conversation has to start with a human message, so assistant messages cut from theirs are dropped too
+	history, last := messages[:len(messages)-1], messages[len(messages)-1]
+	history = history[len(history)/2+len(history)%2:]
+	for len(history) > 0 && history[0].Role != openai.ChatMessageRoleUser {
+		history = history[1:]
+	}
+
+	shrunk := make([]openai.ChatCompletionMessage, 0, len(system)+len(history)+1)
+	shrunk = append(shrunk, system...)
+	shrunk = append(shrunk, history...)
+	shrunk = append(shrunk, last)
+	return modelPrompt{model: prompt.model, ownerID: prompt.ownerID, messages: shrunk, sampling: prompt.sampling}, true
+}
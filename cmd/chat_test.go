@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestShrinkTextPrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []*dbMessage
+		want    string
+		wantOK  bool
+	}{
+		{
+			name:    "older exchange is dropped",
+			history: testHistory("human q1", "ai a1", "human q2", "ai a2"),
+			want:    defaultFormatPrompt("S", "human q2", "ai a2", "human new"),
+			wantOK:  true,
+		},
+		{
+			name:    "reply cut from its question is dropped too",
+			history: testHistory("human q1", "ai a1", "human q2", "ai a2", "human q3", "ai a3"),
+			want:    defaultFormatPrompt("S", "human q3", "ai a3", "human new"),
+			wantOK:  true,
+		},
+		{
+			name:    "last exchange is dropped",
+			history: testHistory("human q1", "ai a1"),
+			want:    defaultFormatPrompt("S", "human new"),
+			wantOK:  true,
+		},
+		{name: "nothing to drop", want: defaultFormatPrompt("S", "human new")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, _, err := buildPromptFromHistory(countBytes, 1000, 10, nil, "S", tt.history, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := shrinkTextPrompt(nil, prompt)
+			if got.text != tt.want || ok != tt.wantOK {
+				t.Errorf("shrinkTextPrompt() = %q, %v, want %q, %v", got.text, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// contextLengthExceeded fails the first requests with context_length_exceeded and records the prompts of all requests.
+type contextLengthExceeded struct {
+	mu       sync.Mutex
+	failures int
+	prompts  []string
+}
+
+func (f *contextLengthExceeded) handle(w http.ResponseWriter, r *http.Request) {
+	var prompt string
+	if strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		var req openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, msg := range req.Messages {
+			prompt += msg.Role + ": " + msg.Content + "\n"
+		}
+	} else {
+		var req openai.CompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		prompt, _ = req.Prompt.(string)
+	}
+
+	f.mu.Lock()
+	f.prompts = append(f.prompts, prompt)
+	fail := f.failures > 0
+	f.failures--
+	f.mu.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"This model's maximum context length is exceeded.","type":"invalid_request_error","code":"context_length_exceeded"}}`))
+		return
+	}
+	fakeOpenAI("hi")(w, r)
+}
+
+func TestContextLengthExceededIsRetriedWithShorterHistory(t *testing.T) {
+	tests := []struct {
+		name          string
+		completionAPI bool
+		failures      int
+		wantReply     string
+		wantRequests  int
+	}{
+		{name: "chat prompt", failures: 1, wantReply: "hi", wantRequests: 2},
+		{name: "text prompt", completionAPI: true, failures: 1, wantReply: "hi", wantRequests: 2},
+		{name: "shorter text prompt is too long too", completionAPI: true, failures: 2, wantReply: promptTooLongMessage, wantRequests: 2},
+		{name: "shorter chat prompt is too long too", failures: 2, wantReply: promptTooLongMessage, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+			api := &contextLengthExceeded{failures: tt.failures}
+			p.gptClient = newTestOpenAIClient(t, api.handle)
+			if tt.completionAPI {
+				p.model = chatModel{name: openai.GPT3TextDavinci003, completionAPI: true}
+				p.countTokens = newTokenCounter(openai.GPT3TextDavinci003)
+			}
+			history := testHistory("human q1", "ai a1", "human q2", "ai a2")
+			for _, msg := range history {
+				msg.ID = 0
+			}
+			if err := p.messages.SaveAll(ctx, history, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			p.processMessage(ctx, privateMessage(1, "new"))
+
+			if got := telegram.last(); got != tt.wantReply {
+				t.Errorf("reply = %q, want %q", got, tt.wantReply)
+			}
+			if len(api.prompts) != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", len(api.prompts), tt.wantRequests)
+			}
+			if tt.wantRequests == 2 {
+				first, retried := api.prompts[0], api.prompts[1]
+				if !strings.Contains(first, "q1") || strings.Contains(retried, "q1") || !strings.Contains(retried, "q2") || !strings.Contains(retried, "new") {
+					t.Errorf("retried prompt = %q, want the older exchange of %q dropped", retried, first)
+				}
+			}
+		})
+	}
+}
+
+func TestMessagesBreakingAlternationAreMergedInRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []*dbMessage
+		want    []openai.ChatCompletionMessage
+	}{
+		{
+			name:    "back-to-back human messages",
+			history: testHistory("human q1", "human q1 again", "ai a1"),
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "q1" + promptRowsSeparator + "q1 again"},
+				{Role: openai.ChatMessageRoleAssistant, Content: "a1"},
+				{Role: openai.ChatMessageRoleUser, Content: "new"},
+			},
+		},
+		{
+			name:    "back-to-back AI messages",
+			history: testHistory("human q1", "ai a1", "ai a1 more"),
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "q1"},
+				{Role: openai.ChatMessageRoleAssistant, Content: "a1" + promptRowsSeparator + "a1 more"},
+				{Role: openai.ChatMessageRoleUser, Content: "new"},
+			},
+		},
+		{
+			name:    "missing reply in the middle",
+			history: testHistory("human q1", "human q2", "ai a2", "human q3"),
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "q1" + promptRowsSeparator + "q2"},
+				{Role: openai.ChatMessageRoleAssistant, Content: "a2"},
+				{Role: openai.ChatMessageRoleUser, Content: "q3" + promptRowsSeparator + "new"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.persona = "S"
+			for _, msg := range tt.history {
+				msg.ID = 0
+			}
+			if err := p.messages.SaveAll(ctx, tt.history, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			p.processMessage(ctx, privateMessage(1, "new"))
+
+			want := append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "S"}}, tt.want...)
+			got := completions.lastRequest().Messages
+			if len(got) != len(want) {
+				t.Fatalf("messages = %+v, want %+v", got, want)
+			}
+			for i := range want {
+				if got[i].Role != want[i].Role || got[i].Content != want[i].Content {
+					t.Errorf("message %d = %s %q, want %s %q", i, got[i].Role, got[i].Content, want[i].Role, want[i].Content)
+				}
+			}
+		})
+	}
+}
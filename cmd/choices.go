@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	defaultChoices = 1
+	// maxChoices is the largest number of choices OpenAI generates in one request.
+	maxChoices = 128
+	// choicesCostWarning is the number of choices above which the cost of replies is worth a warning,
+	// completion tokens of every choice are paid for.
+	choicesCostWarning = 3
+
+	choiceHeader = "Option %d of %d:\n\n"
+)
+
+// When more than one choice is configured, the reply is generated with several candidates. The first one
+// is the reply saved to the conversation history, the others are sent after it as alternatives to pick from.
+
+func validateChoices(n int) error {
+	if n > maxChoices {
+		return fmt.Errorf("%d choices are requested, at most %d are allowed", n, maxChoices)
+	}
+	return nil
+}
+
+// replyChoices returns the texts of the reply to send, each in its own message: the reply itself, or
+// the reply followed by the alternatives that pass moderation, numbered in the order they are generated.
+func (p *messageProcessor) replyChoices(ctx context.Context, reply string, alternatives []string) []string {
+	choices := []string{reply}
+	for _, text := range alternatives {
+		// Flagged alternative is just not offered, the reply is answered anyway
+		if p.moderationRefusal(ctx, text, flaggedReplyMessage) != "" {
+			continue
+		}
+		choices = append(choices, text)
+	}
+	return numberChoices(choices)
+}
+
+// numberChoices prefixes every choice with its number, a single choice is left as is.
+func numberChoices(choices []string) []string {
+	if len(choices) < 2 {
+		return choices
+	}
+	numbered := make([]string, len(choices))
+	for i, text := range choices {
+		numbered[i] = fmt.Sprintf(choiceHeader, i+1, len(choices)) + text
+	}
+	return numbered
+}
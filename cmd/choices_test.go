@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestNumberChoices(t *testing.T) {
+	tests := []struct {
+		name    string
+		choices []string
+		want    []string
+	}{
+		{name: "single choice is left as is", choices: []string{"a"}, want: []string{"a"}},
+		{name: "choices are numbered", choices: []string{"a", "b"}, want: []string{"Option 1 of 2:\n\na", "Option 2 of 2:\n\nb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := numberChoices(tt.choices)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("numberChoices() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newChoicesOpenAIClient returns the client of the fake OpenAI API that answers with as many choices as requested,
+// the number of requests is counted.
+func newChoicesOpenAIClient(t *testing.T, requests *atomic.Int32) *openai.Client {
+	return newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var req openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		resp := openai.ChatCompletionResponse{Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}}
+		for i := 0; i < max(req.N, 1); i++ {
+			resp.Choices = append(resp.Choices, openai.ChatCompletionChoice{
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: fmt.Sprintf("choice %d", i+1)},
+				FinishReason: openai.FinishReasonStop,
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func TestCompleteWithChoicesCached(t *testing.T) {
+	tests := []struct {
+		name string
+		// choices are the numbers of choices requested one after another with the same prompt.
+		choices          []int
+		wantRequests     int32
+		wantAlternatives []string
+	}{
+		{name: "cached completion keeps alternatives", choices: []int{3, 3}, wantRequests: 1, wantAlternatives: []string{"choice 2", "choice 3"}},
+		{name: "single choice is not reused for several", choices: []int{1, 3}, wantRequests: 2, wantAlternatives: []string{"choice 2", "choice 3"}},
+		{name: "several choices are not reused for single", choices: []int{3, 1}, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := newCompletionCache(10, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var requests atomic.Int32
+			p := &messageProcessor{
+				gptClient:       newChoicesOpenAIClient(t, &requests),
+				completionCache: cache,
+				sampling:        defaultSamplingParams,
+				openAITimeout:   time.Minute,
+			}
+			prompt := modelPrompt{model: openai.GPT3Dot5Turbo, messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "Hello"},
+			}}
+
+			var last completion
+			for _, n := range tt.choices {
+				if last, err = p.completeWithChoices(context.Background(), prompt, 100, n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if strings.Join(last.Alternatives, "|") != strings.Join(tt.wantAlternatives, "|") {
+				t.Errorf("alternatives = %q, want %q", last.Alternatives, tt.wantAlternatives)
+			}
+			if last.Text != "choice 1" {
+				t.Errorf("text = %q, want %q", last.Text, "choice 1")
+			}
+			if last.Cached && last.TotalTokens != 0 {
+				t.Errorf("cached completion accounts %d tokens, want 0", last.TotalTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	codeFence = "```"
+
+	codeModeInstruction = "When asked for code, reply only with a single fenced code block in Markdown, with minimal prose, if any."
+)
+
+var (
+	// codeCommandRegexp matches explicit request for code with the /code command.
+	codeCommandRegexp = regexp.MustCompile(`^/` + commandCode + `(@\w+)?(\s|$)`)
+	// codeRequestRegexp matches messages that clearly ask for code, e.g. "write a function that ...".
+	codeRequestRegexp = regexp.MustCompile(`(?i)^\s*(please\s+)?(write|generate|implement|give me|show me)\b.{0,40}\b(code|function|method|script|class|snippet|program|regex|sql query)\b`)
+)
+
+// codeQuestion returns the message without the /code command and whether it asks for code,
+// either with the command or in its wording.
+func codeQuestion(text string) (string, bool) {
+	if loc := codeCommandRegexp.FindStringIndex(text); loc != nil {
+		return strings.TrimSpace(text[loc[1]:]), true
+	}
+	return text, codeRequestRegexp.MatchString(text)
+}
+
+type codeModeKey struct{}
+
+// withCodeMode returns the context of the message that is answered in code mode.
+func withCodeMode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, codeModeKey{}, true)
+}
+
+// codeMode reports whether the message is answered in code mode.
+func codeMode(ctx context.Context) bool {
+	return ctx.Value(codeModeKey{}) != nil
+}
+
+func withCodeInstruction(system string) string {
+	return codeModeInstruction + " " + system
+}
+
+// splitFencedText splits the text into chunks of at most maxLength characters at line boundaries where possible.
+// Code block that is split is closed at the end of the chunk and opened again in the next one,
+// so that each message is formatted on its own.
+func splitFencedText(text string, maxLength int) []string {
+	if utf8.RuneCountInString(text) <= maxLength {
+		return []string{text}
+	}
+
+	// Lines too long to share a chunk with code fences are split between sentences or words
+	lines := make([]string, 0)
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lines = append(lines, splitText(line, maxLength/2)...)
+	}
+
+	var (
+		chunks    []string
+		chunk     strings.Builder
+		openFence string
+	)
+	closeFence := func() {
+		if !strings.HasSuffix(chunk.String(), "\n") {
+			chunk.WriteString("\n")
+		}
+		chunk.WriteString(codeFence)
+	}
+	reserved := utf8.RuneCountInString("\n" + codeFence)
+
+	for _, line := range lines {
+		if chunk.Len() > 0 && utf8.RuneCountInString(chunk.String())+utf8.RuneCountInString(line)+reserved > maxLength {
+			if openFence != "" {
+				closeFence()
+			}
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+			chunk.WriteString(openFence)
+		}
+
+		chunk.WriteString(line)
+
+		if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			if openFence == "" {
+				// Only the language is kept from the opening line
+				openFence = codeFence
+				if fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), codeFence)); len(fields) > 0 {
+					openFence += fields[0]
+				}
+				openFence += "\n"
+			} else {
+				openFence = ""
+			}
+		}
+	}
+	if chunk.Len() > 0 {
+		chunks = append(chunks, chunk.String())
+	}
+	return chunks
+}
+
+// sendCodeReply sends the code reply as HTML, split the same way as sendLongTextMessage does.
+// The text is escaped, so unlike Markdown Telegram always parses it and the code is never sent as plain text.
+func sendCodeReply(ctx context.Context, bot messageSender, chatID int64, text string, markup interface{}) {
+	chunks := splitFencedText(text, telegramMessageLengthMax)
+	for i, chunk := range chunks {
+		msg := tgbotapi.NewMessage(chatID, codeReplyHTML(chunk))
+		msg.ParseMode = tgbotapi.ModeHTML
+		if i == len(chunks)-1 {
+			msg.ReplyMarkup = markup
+		}
+		sendMessage(ctx, bot, msg)
+	}
+}
+
+// codeReplyHTML formats fenced code blocks of the reply as preformatted HTML with their language,
+// the rest is escaped. Code block that is not closed ends with the text.
+func codeReplyHTML(text string) string {
+	var (
+		formatted strings.Builder
+		code      strings.Builder
+		inCode    bool
+	)
+	closeCode := func() {
+		formatted.WriteString(html.EscapeString(strings.TrimSuffix(code.String(), "\n")))
+		formatted.WriteString("</code></pre>")
+		code.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, codeFence) && !inCode:
+			inCode = true
+			formatted.WriteString("<pre>")
+			if fields := strings.Fields(strings.TrimPrefix(trimmed, codeFence)); len(fields) > 0 {
+				formatted.WriteString(`<code class="language-` + html.EscapeString(fields[0]) + `">`)
+			} else {
+				formatted.WriteString("<code>")
+			}
+		case strings.HasPrefix(trimmed, codeFence) && inCode:
+			inCode = false
+			closeCode()
+			if strings.HasSuffix(line, "\n") {
+				formatted.WriteString("\n")
+			}
+		case inCode:
+			code.WriteString(line)
+		default:
+			formatted.WriteString(html.EscapeString(line))
+		}
+	}
+	if inCode {
+		closeCode()
+	}
+	return formatted.String()
+}
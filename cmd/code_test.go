@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestCodeQuestion(t *testing.T) {
+	tests := []struct {
+		text     string
+		want     string
+		wantCode bool
+	}{
+		{text: "/code reverse a string", want: "reverse a string", wantCode: true},
+		{text: "/code@test_bot  reverse a string ", want: "reverse a string", wantCode: true},
+		{text: "/code", want: "", wantCode: true},
+		{text: "Write a function that reverses a string", want: "Write a function that reverses a string", wantCode: true},
+		{text: "/codes are secret", want: "/codes are secret"},
+		{text: "What is a function?", want: "What is a function?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, isCode := codeQuestion(tt.text)
+			if got != tt.want || isCode != tt.wantCode {
+				t.Errorf("codeQuestion(%q) = %q, %v, want %q, %v", tt.text, got, isCode, tt.want, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSplitFencedTextReopensCodeBlock(t *testing.T) {
+	const maxLength = 60
+	var code strings.Builder
+	for i := 0; i < 10; i++ {
+		code.WriteString("fmt.Println(\"line\")\n")
+	}
+	text := "Here it is:\n```go\n" + code.String() + "```\nDone."
+
+	chunks := splitFencedText(text, maxLength)
+	if len(chunks) < 3 {
+		t.Fatalf("chunks = %q, want the code block split", chunks)
+	}
+
+	var gotCode strings.Builder
+	for i, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > maxLength {
+			t.Errorf("chunk %d is %d characters long, want at most %d", i, n, maxLength)
+		}
+		if strings.Count(chunk, codeFence)%2 != 0 {
+			t.Errorf("chunk %d = %q, want code blocks closed", i, chunk)
+		}
+		if i > 0 && i < len(chunks)-1 && !strings.HasPrefix(chunk, "```go\n") {
+			t.Errorf("chunk %d = %q, want the code block reopened with its language", i, chunk)
+		}
+		// Code lines are all kept, each in one chunk
+		for _, line := range strings.SplitAfter(chunk, "\n") {
+			if strings.HasPrefix(line, "fmt.") {
+				gotCode.WriteString(line)
+			}
+		}
+	}
+	if gotCode.String() != code.String() {
+		t.Errorf("code = %q, want %q", gotCode.String(), code.String())
+	}
+	if !strings.HasSuffix(chunks[len(chunks)-1], "```\nDone.") {
+		t.Errorf("last chunk = %q, want the text after the code block", chunks[len(chunks)-1])
+	}
+}
+
+func TestCodeReplyHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "code block with language",
+			text: "Use this:\n```go\nif a < b && b > c {\n}\n```\nIt *works*.",
+			want: "Use this:\n<pre><code class=\"language-go\">if a &lt; b &amp;&amp; b &gt; c {\n}</code></pre>\nIt *works*.",
+		},
+		{
+			name: "code block without language",
+			text: "```\nx := 1\n```",
+			want: "<pre><code>x := 1</code></pre>",
+		},
+		{
+			name: "code block that is not closed",
+			text: "```sh\nls <dir>",
+			want: "<pre><code class=\"language-sh\">ls &lt;dir&gt;</code></pre>",
+		},
+		{name: "text without code", text: "1 < 2 & _x_", want: "1 &lt; 2 &amp; _x_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codeReplyHTML(tt.text); got != tt.want {
+				t.Errorf("codeReplyHTML(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeReplyIsSentAsHTML(t *testing.T) {
+	// Unbalanced Markdown around the code would make Telegram reject the reply in Markdown
+	sender := &fakeSender{}
+	sendCodeReply(context.Background(), sender, 1, "Here is my_func:\n```go\nfunc my_func() {}\n```", nil)
+
+	if !equalStrings(sender.parseModes, []string{tgbotapi.ModeHTML}) {
+		t.Errorf("parse modes = %q, want only %q", sender.parseModes, tgbotapi.ModeHTML)
+	}
+	if want := "Here is my_func:\n<pre><code class=\"language-go\">func my_func() {}</code></pre>"; len(sender.sent) != 1 || sender.sent[0] != want {
+		t.Errorf("sent = %q, want %q", sender.sent, want)
+	}
+}
+
+func TestCodeModePrompt(t *testing.T) {
+	const reply = "```go\nfunc reverse(s string) string\n```"
+
+	tests := []struct {
+		name          string
+		update        tgbotapi.Update
+		format        string
+		wantText      string
+		wantCode      bool
+		wantParseMode string
+	}{
+		{
+			name:          "/code command",
+			update:        commandMessage(1, "/code reverse a string"),
+			wantText:      "reverse a string",
+			wantCode:      true,
+			wantParseMode: tgbotapi.ModeHTML,
+		},
+		{
+			name:          "request worded as asking for code",
+			update:        privateMessage(1, "write a function that reverses a string"),
+			wantText:      "write a function that reverses a string",
+			wantCode:      true,
+			wantParseMode: tgbotapi.ModeHTML,
+		},
+		{
+			name:     "plain text chat is answered in plain text",
+			update:   commandMessage(1, "/code reverse a string"),
+			format:   formatPlain,
+			wantText: "reverse a string",
+			wantCode: true,
+		},
+		{
+			name:          "regular message",
+			update:        privateMessage(1, "how are you?"),
+			wantText:      "how are you?",
+			wantParseMode: tgbotapi.ModeMarkdown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice(reply, openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+			if tt.format != "" {
+				if err := p.settings.SetChatSetting(ctx, 1, chatSettingFormat, tt.format); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p.processMessage(ctx, tt.update)
+
+			messages := completions.lastRequest().Messages
+			system, human := messages[0].Content, messages[len(messages)-1].Content
+			if got := strings.HasPrefix(system, codeModeInstruction); got != tt.wantCode {
+				t.Errorf("system prompt = %q, want code instruction %v", system, tt.wantCode)
+			}
+			if human != tt.wantText {
+				t.Errorf("human message in the prompt = %q, want %q", human, tt.wantText)
+			}
+
+			history, err := p.messages.History(ctx, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved []string
+			for _, msg := range history {
+				if msg.isHuman() {
+					saved = append(saved, msg.Text)
+				}
+			}
+			if !equalStrings(saved, []string{tt.wantText}) {
+				t.Errorf("human messages in the history = %q, want %q", saved, tt.wantText)
+			}
+
+			if got := telegram.parseModes[len(telegram.parseModes)-1]; got != tt.wantParseMode {
+				t.Errorf("reply parse mode = %q, want %q", got, tt.wantParseMode)
+			}
+		})
+	}
+}
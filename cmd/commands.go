@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandFormat      = "format"
+	commandQuota       = "quota"
+	commandFocus       = "focus"
+	commandPrompt      = "prompt"
+	commandStar        = "star"
+	commandFeedback    = "feedback"
+	commandStyle       = "style"
+	commandCount       = "count"
+	commandNames       = "names"
+	commandReset       = "reset"
+	commandLastError   = "lasterror"
+	commandRetry       = "retry"
+	commandMaintenance = "maintenance"
+	commandTimeout     = "timeout"
+	commandExport      = "export"
+	commandImport      = "import"
+	commandPersona     = promptSectionPersona
+	commandRules       = promptSectionRules
+	commandFormatting  = promptSectionFormatting
+	// commandCode is not handled as a command, the message is answered as a regular one in code mode
+	commandCode = "code"
+	// commandThink is not handled as a command either, the question is answered with the thinking configuration
+	commandThink = "think"
+)
+
+// handleCommand processes bot command from the incoming message.
+// Returns false if the message is not a known command and has to be processed as a regular message.
+func (p *messageProcessor) handleCommand(ctx context.Context, update tgbotapi.Update, parseMode string) bool {
+	if !update.Message.IsCommand() {
+		return false
+	}
+
+	switch update.Message.Command() {
+	case commandHelp:
+		p.handleHelpCommand(ctx, update, parseMode)
+	case commandStart:
+		p.handleStartCommand(ctx, update)
+	case commandFormat:
+		p.handleFormatCommand(ctx, update, parseMode)
+	case commandQuota:
+		p.handleQuotaCommand(ctx, update, parseMode)
+	case commandFocus:
+		p.handleFocusCommand(ctx, update, parseMode)
+	case commandStar:
+		p.handleStarCommand(ctx, update, parseMode)
+	case commandFeedback:
+		p.handleFeedbackCommand(ctx, update, parseMode)
+	case commandStyle:
+		p.handleStyleCommand(ctx, update, parseMode)
+	case commandCount:
+		p.handleCountCommand(ctx, update, parseMode)
+	case commandNames:
+		p.handleNamesCommand(ctx, update, parseMode)
+	case commandReset:
+		p.handleResetCommand(ctx, update, parseMode)
+	case commandRetry:
+		p.handleRetryCommand(ctx, update, parseMode)
+	case commandTimeout:
+		p.handleTimeoutCommand(ctx, update, parseMode)
+	case commandExport:
+		p.handleExportCommand(ctx, update, parseMode)
+	case commandHistory:
+		p.handleHistoryCommand(ctx, update, parseMode)
+	case commandUsage:
+		p.handleUsageCommand(ctx, update, parseMode)
+	case commandModel:
+		p.handleModelCommand(ctx, update, parseMode)
+	case commandMaxTokens:
+		p.handleMaxTokensCommand(ctx, update, parseMode)
+	case commandImport:
+		p.handleImportCommand(ctx, update, parseMode)
+	case commandImage:
+		p.handleImageCommand(ctx, update, parseMode)
+	case commandPersona:
+		p.handlePersonaCommand(ctx, update, parseMode)
+	case commandRules, commandFormatting:
+		p.handlePromptSectionCommand(ctx, update, parseMode, update.Message.Command())
+	case commandLastError:
+		if !p.isAdmin(update.Message.From.ID) {
+			return false
+		}
+		p.handleLastErrorCommand(ctx, update, parseMode)
+	case commandMaintenance:
+		if !p.isAdmin(update.Message.From.ID) {
+			return false
+		}
+		p.handleMaintenanceCommand(ctx, update, parseMode)
+	case commandPrompt:
+		if !p.isAdmin(update.Message.From.ID) {
+			return false
+		}
+		p.handlePromptCommand(ctx, update, parseMode)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *messageProcessor) handleResetCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	if err := p.messages.DeleteAll(ctx, conversationOwnerID(update.Message)); err != nil {
+		slog.Error("failed to delete conversation history", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	p.completionCache.clear()
+	sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, "Conversation history is cleared.")
+}
+
+// isAdmin reports whether the user is allowed to run administrative commands.
+func (p *messageProcessor) isAdmin(userID int) bool {
+	return userID != 0 && userID == p.adminUserID
+}
+
+func (p *messageProcessor) handleFormatCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	format := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	if format == "" {
+		current, err := p.settings.ChatSetting(ctx, chatID, chatSettingFormat)
+		if err != nil {
+			slog.Error("failed to get chat format", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		if current == "" {
+			current = formatMarkdown
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Current format is %v. Use /format %v|%v to change it.", current, formatMarkdown, formatPlain))
+		return
+	}
+
+	if format != formatMarkdown && format != formatPlain {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Unknown format '%v'. Use /format %v|%v.", format, formatMarkdown, formatPlain))
+		return
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingFormat, format); err != nil {
+		slog.Error("failed to save chat format", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseModeForFormat(format), fmt.Sprintf("Format is set to %v.", format))
+}
+
+func (p *messageProcessor) handleQuotaCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	if p.dailyMessageLimit <= 0 {
+		sendTextMessage(p.bot, chatID, parseMode, "There is no daily message limit.")
+		return
+	}
+
+	remaining, err := p.remainingDailyMessages(ctx, update.Message.From.ID)
+	if err != nil {
+		slog.Error("failed to get daily message count from the database", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("You have %d of %d messages left for today.", remaining, p.dailyMessageLimit))
+}
+
+func (p *messageProcessor) handleFocusCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	tag := normalizeTag(update.Message.CommandArguments())
+
+	if tag == "" {
+		current, err := p.settings.ChatSetting(ctx, chatID, chatSettingFocus)
+		if err != nil {
+			slog.Error("failed to get chat focus", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		if current == "" {
+			sendTextMessage(p.bot, chatID, parseMode, "Focus is off, the whole conversation is used. Use /focus <tag> to focus on messages with #tag.")
+			return
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Conversation is focused on #%v. Use /focus off to clear it.", current))
+		return
+	}
+
+	if tag == focusOff {
+		if err := p.settings.SetChatSetting(ctx, chatID, chatSettingFocus, ""); err != nil {
+			slog.Error("failed to clear chat focus", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, parseMode, "Focus is cleared, the whole conversation is used.")
+		return
+	}
+
+	if tags := parseTags("#" + tag); len(tags) != 1 || tags[0] != tag {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Invalid tag '%v'. Tags may contain only letters, digits and underscores.", tag))
+		return
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingFocus, tag); err != nil {
+		slog.Error("failed to save chat focus", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Conversation is focused on #%v. New messages are tagged with it automatically.", tag))
+}
+
+// handlePromptCommand replies with the exact prompt that would be sent to the model for the question.
+// Nothing is sent to the model or saved to the history.
+func (p *messageProcessor) handlePromptCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	question := strings.TrimSpace(update.Message.CommandArguments())
+
+	if question == "" {
+		sendTextMessage(p.bot, chatID, parseMode, "Use /prompt <question> to see the prompt that would be sent to the model.")
+		return
+	}
+
+	focus, err := p.settings.ChatSetting(ctx, chatID, chatSettingFocus)
+	if err != nil {
+		slog.Error("failed to get chat focus", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	prompt, err := p.buildPrompt(ctx, chatID, focus, &dbMessage{
+		UserID:   update.Message.From.ID,
+		OwnerID:  conversationOwnerID(update.Message),
+		Role:     messageRoleUser,
+		Username: update.Message.From.UserName,
+		Text:     question,
+	})
+	if err != nil {
+		slog.Error("failed to build prompt", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	// Prompt is sent as plain text, so that it is shown exactly as the model would see it
+	sendLongTextMessage(ctx, p.bot, chatID, "", prompt.String())
+}
+
+// handleCountCommand reports how many tokens the conversation context takes and how many are left before trimming.
+func (p *messageProcessor) handleCountCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	focus, err := p.settings.ChatSetting(ctx, chatID, chatSettingFocus)
+	if err != nil {
+		slog.Error("failed to get chat focus", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	prompt, err := p.buildPrompt(ctx, chatID, focus, &dbMessage{
+		UserID:   update.Message.From.ID,
+		OwnerID:  conversationOwnerID(update.Message),
+		Role:     messageRoleUser,
+		Username: update.Message.From.UserName,
+	})
+	if err != nil {
+		slog.Error("failed to build prompt", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	maxTokens, err := p.userMaxTokensToGenerate(ctx, update.Message.From.ID)
+	if err != nil {
+		slog.Error("failed to get user max tokens to generate", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	tokens := p.countPromptTokens(prompt)
+	remaining := prompt.contextLength() - maxTokens - tokens
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf(
+		"Conversation context takes %d tokens, %d tokens are reserved for the reply. "+
+			"%d tokens are left before older messages are forgotten. Model limit is %d tokens.",
+		tokens, maxTokens, remaining, prompt.contextLength(),
+	))
+}
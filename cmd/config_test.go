@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	const file = "API_KEY_OPENAPI=file-openai-key\nAPI_KEY_TELEGRAM=file-telegram-token\nUSER_ID_TELEGRAM=1\nMAX_MESSAGES_IN_HISTORY=20\n"
+
+	tests := []struct {
+		name string
+		// env is the value of the environment variable of the parameter, nil if the variable is not set.
+		env             *string
+		param           string
+		wantMaxMessages int
+	}{
+		{name: "environment takes precedence over the file", param: "MAX_MESSAGES_IN_HISTORY", env: ptr("50"), wantMaxMessages: 50},
+		{name: "file is used if environment variable is not set", param: "MAX_MESSAGES_IN_HISTORY", wantMaxMessages: 20},
+		{name: "file is used if environment variable is empty", param: "MAX_MESSAGES_IN_HISTORY", env: ptr(""), wantMaxMessages: 20},
+		{name: "file is used instead of the placeholder", param: "API_KEY_TELEGRAM", env: ptr(configPlaceholder), wantMaxMessages: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", path)
+			for _, name := range []string{"API_KEY_OPENAPI", "API_KEY_TELEGRAM", "USER_ID_TELEGRAM", "MAX_MESSAGES_IN_HISTORY"} {
+				unsetenv(t, name)
+			}
+			if tt.env != nil {
+				t.Setenv(tt.param, *tt.env)
+			}
+
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.maxMessagesInHistory != tt.wantMaxMessages {
+				t.Errorf("max messages in history = %d, want %d", cfg.maxMessagesInHistory, tt.wantMaxMessages)
+			}
+			if cfg.apiKeyTelegram != "file-telegram-token" {
+				t.Errorf("Telegram token = %q, want the one from the file", cfg.apiKeyTelegram)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("API_KEY_OPENAPI=key\nAPI_KEY_TELEGRAM=token\nUSER_ID_TELEGRAM=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, name := range []string{"MAX_MESSAGES_IN_HISTORY", "MAX_TOKENS_TO_GENERATE", "APPLICATION_DATA_ROOT_DIR_PATH", "OPENAI_TIMEOUT"} {
+		unsetenv(t, name)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "MAX_MESSAGES_IN_HISTORY", got: cfg.maxMessagesInHistory, want: defaultMaxMessagesInHistory},
+		{name: "MAX_TOKENS_TO_GENERATE", got: cfg.maxTokensToGenerate, want: defaultMaxTokensToGenerate},
+		{name: "APPLICATION_DATA_ROOT_DIR_PATH", got: cfg.applicationDataRootDirPath, want: defaultApplicationDataRootDirPath},
+		{name: "OPENAI_TIMEOUT", got: cfg.openAITimeout, want: defaultOpenAITimeout},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%v = %v, want the default %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// unsetenv unsets the environment variable for the test, it is restored afterwards.
+func unsetenv(t *testing.T, name string) {
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// continueRequest is the message that asks to continue the truncated reply.
+	continueRequest = "continue"
+
+	truncatedNote         = "\n\n(response truncated — send 'continue' for more)"
+	truncatedNoteMarkdown = "\n\n_(response truncated — send 'continue' for more)_"
+
+	// continuePrompt replaces the continue request in the prompt, so that the model picks up where the reply stopped
+	// rather than answering the word.
+	continuePrompt = "Continue your previous message exactly where it stopped, without repeating any of it."
+)
+
+// isTruncated reports whether the reply is cut off at the limit of tokens to generate.
+func isTruncated(c completion) bool {
+	return c.FinishReason == finishReasonLength
+}
+
+// withTruncatedNote tells the user that the reply is cut off and how to get the rest of it.
+func withTruncatedNote(text, parseMode string) string {
+	if parseMode == tgbotapi.ModeMarkdown {
+		return text + truncatedNoteMarkdown
+	}
+	return text + truncatedNote
+}
+
+// isContinueRequest reports whether the message asks to continue the reply, e.g. "Continue." or "continue".
+func isContinueRequest(text string) bool {
+	return strings.EqualFold(strings.TrimRight(strings.TrimSpace(text), ".!"), continueRequest)
+}
+
+// isLastReplyTruncated reports whether the last message of the conversation is the reply that is cut off,
+// so that the continue request is answered with its continuation.
+func isLastReplyTruncated(ctx context.Context, db *sql.DB, ownerID int) (bool, error) {
+	const query = `
+		SELECT role, COALESCE(finish_reason, '') FROM chat_history
+		WHERE owner_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`
+
+	var role, finishReason string
+	if err := db.QueryRowContext(ctx, query, ownerID).Scan(&role, &finishReason); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get the last message from the database: %w", err)
+	}
+	return role == messageRoleAssistant && finishReason == finishReasonLength, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestIsContinueRequest(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{text: "continue", want: true},
+		{text: "  Continue. ", want: true},
+		{text: "CONTINUE!", want: true},
+		{text: "continue the story", want: false},
+		{text: "go on", want: false},
+	}
+	for _, tt := range tests {
+		if got := isContinueRequest(tt.text); got != tt.want {
+			t.Errorf("isContinueRequest(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestWithTruncatedNote(t *testing.T) {
+	tests := []struct {
+		parseMode string
+		want      string
+	}{
+		{parseMode: tgbotapi.ModeMarkdown, want: "text" + truncatedNoteMarkdown},
+		{parseMode: "", want: "text" + truncatedNote},
+	}
+	for _, tt := range tests {
+		if got := withTruncatedNote("text", tt.parseMode); got != tt.want {
+			t.Errorf("withTruncatedNote(%q) = %q, want %q", tt.parseMode, got, tt.want)
+		}
+	}
+}
+
+// fakeTelegram records the texts and parse modes of the messages sent by the bot.
+type fakeTelegram struct {
+	mu         sync.Mutex
+	sent       []string
+	parseModes []string
+}
+
+func (f *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+		f.mu.Lock()
+		f.sent = append(f.sent, r.Form.Get("text"))
+		f.parseModes = append(f.parseModes, r.Form.Get("parse_mode"))
+		f.mu.Unlock()
+	}
+	w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+}
+
+func (f *fakeTelegram) last() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sent) == 0 {
+		return ""
+	}
+	return f.sent[len(f.sent)-1]
+}
+
+// fakeChatCompletions answers chat completion requests with the replies in order and records the requests.
+type fakeChatCompletions struct {
+	mu       sync.Mutex
+	replies  []openai.ChatCompletionChoice
+	requests []openai.ChatCompletionRequest
+}
+
+func (f *fakeChatCompletions) handle(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	choice := f.replies[0]
+	if len(f.replies) > 1 {
+		f.replies = f.replies[1:]
+	}
+	f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{choice},
+		Usage:   openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+	})
+}
+
+func (f *fakeChatCompletions) lastRequest() openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func chatChoice(text string, finishReason openai.FinishReason) openai.ChatCompletionChoice {
+	return openai.ChatCompletionChoice{
+		Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: text},
+		FinishReason: finishReason,
+	}
+}
+
+// newTestProcessor returns the processor that answers private messages with the fake APIs.
+func newTestProcessor(t testing.TB, telegram *fakeTelegram, completions *fakeChatCompletions) *messageProcessor {
+	t.Helper()
+
+	store := newMemoryStore()
+	return &messageProcessor{
+		maxMessagesInHistory: 100,
+		maxTokensToGenerate:  100,
+		choices:              1,
+		messages:             store,
+		settings:             store,
+		activity:             store,
+		bot:                  newTestBot(t, telegram.handle),
+		gptClient:            newTestOpenAIClient(t, completions.handle),
+		model:                chatModel{name: openai.GPT3Dot5Turbo},
+		sampling:             defaultSamplingParams,
+		openAITimeout:        time.Minute,
+		countTokens:          newTokenCounter(openai.GPT3Dot5Turbo),
+	}
+}
+
+func privateMessage(userID int, text string) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: userID},
+		Chat: &tgbotapi.Chat{ID: int64(userID), Type: "private"},
+		Text: text,
+	}}
+}
+
+func TestTruncatedReplyIsContinued(t *testing.T) {
+	tests := []struct {
+		name          string
+		finishReasons []openai.FinishReason
+		// messages are sent one after another, the last one is checked.
+		messages       []string
+		wantPrompt     string
+		wantNote       bool
+		wantTruncation bool
+	}{
+		{
+			name:           "truncated reply has the note",
+			finishReasons:  []openai.FinishReason{openai.FinishReasonLength},
+			messages:       []string{"tell a story"},
+			wantPrompt:     "tell a story",
+			wantNote:       true,
+			wantTruncation: true,
+		},
+		{
+			name:          "complete reply has no note",
+			finishReasons: []openai.FinishReason{openai.FinishReasonStop},
+			messages:      []string{"tell a story"},
+			wantPrompt:    "tell a story",
+		},
+		{
+			name:          "truncated reply is continued",
+			finishReasons: []openai.FinishReason{openai.FinishReasonLength, openai.FinishReasonStop},
+			messages:      []string{"tell a story", "Continue."},
+			wantPrompt:    continuePrompt,
+		},
+		{
+			name:          "continue after complete reply is a regular message",
+			finishReasons: []openai.FinishReason{openai.FinishReasonStop, openai.FinishReasonStop},
+			messages:      []string{"tell a story", "continue"},
+			wantPrompt:    "continue",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{}
+			for _, reason := range tt.finishReasons {
+				completions.replies = append(completions.replies, chatChoice("once upon a time", reason))
+			}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+
+			for _, text := range tt.messages {
+				p.processMessage(context.Background(), privateMessage(1, text))
+			}
+
+			req := completions.lastRequest()
+			if got := req.Messages[len(req.Messages)-1].Content; got != tt.wantPrompt {
+				t.Errorf("last prompt message = %q, want %q", got, tt.wantPrompt)
+			}
+			if got := strings.HasSuffix(telegram.last(), truncatedNoteMarkdown); got != tt.wantNote {
+				t.Errorf("reply %q has the truncation note = %v, want %v", telegram.last(), got, tt.wantNote)
+			}
+			truncated, err := p.messages.LastReplyTruncated(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if truncated != tt.wantTruncation {
+				t.Errorf("last reply is truncated = %v, want %v", truncated, tt.wantTruncation)
+			}
+		})
+	}
+}
+
+func TestCachedTruncatedReplyKeepsFinishReason(t *testing.T) {
+	completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("once upon a time", openai.FinishReasonLength)}}
+	telegram := &fakeTelegram{}
+	p := newTestProcessor(t, telegram, completions)
+	cache, err := newCompletionCache(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.completionCache = cache
+
+	// The prompt is sent again to the conversation started over, which is answered from the cache
+	p.processMessage(context.Background(), privateMessage(1, "tell a story"))
+	if err := p.messages.DeleteAll(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	p.processMessage(context.Background(), privateMessage(1, "tell a story"))
+
+	if got := len(completions.requests); got != 1 {
+		t.Fatalf("requests = %d, want 1", got)
+	}
+	if !strings.HasSuffix(telegram.last(), truncatedNoteMarkdown) {
+		t.Errorf("cached reply %q has no truncation note", telegram.last())
+	}
+	truncated, err := p.messages.LastReplyTruncated(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("cached truncated reply is not saved as truncated")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// prepareDataDir creates the application data directory if it doesn't exist and checks that it is writable,
+// otherwise the database would only fail on the first query. Returns the absolute path of the directory.
+func prepareDataDir(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path '%v': %w", path, err)
+	}
+	if err := os.MkdirAll(absPath, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create directory '%v': %w", absPath, err)
+	}
+
+	f, err := os.CreateTemp(absPath, ".write-check-*")
+	if err != nil {
+		return "", fmt.Errorf("directory '%v' is not writable: %w", absPath, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return "", fmt.Errorf("failed to remove write check file in directory '%v': %w", absPath, err)
+	}
+	return absPath, nil
+}
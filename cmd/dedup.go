@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// processUpdateOnce processes the update unless it has been processed already: updates that weren't confirmed
+// to Telegram before restart are delivered again. Updates of the conversation are processed in order by the same worker,
+// so the ID of the last processed update of the conversation is enough to tell which ones are processed.
+func (p *messageProcessor) processUpdateOnce(ctx context.Context, update tgbotapi.Update) {
+	ownerID := conversationOwnerID(update.Message)
+	lastUpdateID, err := p.activity.LastUpdateID(ctx, ownerID)
+	if err != nil {
+		// Answering the update twice is better than not answering it at all
+		slog.Error("failed to get last processed update", "error", err)
+	} else if update.UpdateID <= lastUpdateID {
+		log.Println("skipping already processed update", update.UpdateID)
+		return
+	}
+
+	p.processMessage(ctx, update)
+
+	// Update interrupted by shutdown is processed again after restart
+	if ctx.Err() != nil {
+		return
+	}
+	if err := p.activity.SaveLastUpdateID(ctx, ownerID, update.UpdateID); err != nil {
+		slog.Error("failed to save last processed update", "error", err)
+	}
+}
+
+// getLastUpdateID returns the ID of the last processed update of the conversation, or zero if there is none.
+func getLastUpdateID(ctx context.Context, db *sql.DB, ownerID int) (int, error) {
+	const query = `
+		SELECT update_id FROM processed_updates WHERE owner_id = ?
+	`
+
+	var updateID int
+	if err := db.QueryRowContext(ctx, query, ownerID).Scan(&updateID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get last processed update from the database: %w", err)
+	}
+	return updateID, nil
+}
+
+func saveLastUpdateID(ctx context.Context, db *sql.DB, ownerID, updateID int) error {
+	const query = `
+		INSERT INTO processed_updates(owner_id, update_id)
+		VALUES(?, ?)
+		ON CONFLICT(owner_id) DO UPDATE SET update_id = excluded.update_id
+	`
+
+	if _, err := db.ExecContext(ctx, query, ownerID, updateID); err != nil {
+		return fmt.Errorf("failed to save last processed update to the database: %w", err)
+	}
+	return nil
+}
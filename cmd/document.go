@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	defaultDocumentQAThreshold = 2048
+
+	documentDefaultQuestion = "What is this document about?"
+	documentNoAnswer        = "NONE"
+
+	documentChunkPrompt = "Answer the question using only the following part %d of %d of a document. " +
+		"If this part doesn't contain the answer, reply with " + documentNoAnswer + ".\n" +
+		"\nDocument part:\n%s\n" +
+		"\nQuestion: %s" +
+		"\nAnswer:"
+	documentCombinePrompt = "The following are answers to the same question, each based on a different part of a document. " +
+		"Combine them into one complete answer to the question.\n" +
+		"\nAnswers:\n%s\n" +
+		"\nQuestion: %s" +
+		"\nAnswer:"
+
+	// documentPromptNumbersMargin reserves space for part numbers substituted into the prompt.
+	documentPromptNumbersMargin = 16
+	// documentChunkTokensMin is the smallest document part worth asking about, shorter ones mean the question is too long.
+	documentChunkTokensMin = 256
+)
+
+var errDocumentNotAnswered = errors.New("no part of the document could be read")
+
+// splitDocumentQuestion splits the message into a document and a question about it,
+// the question is the last paragraph of the message.
+func splitDocumentQuestion(text string) (document, question string) {
+	text = strings.TrimSpace(text)
+	if i := strings.LastIndex(text, "\n\n"); i >= 0 {
+		return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i:])
+	}
+	return text, documentDefaultQuestion
+}
+
+// answerAboutDocument answers the question about the document that doesn't fit into the model context:
+// the question is asked about each part of the document separately, then the partial answers are combined.
+func (p *messageProcessor) answerAboutDocument(ctx context.Context, update tgbotapi.Update, parseMode string, tags []string) {
+	chatID := update.Message.Chat.ID
+	document, question := splitDocumentQuestion(update.Message.Text)
+
+	chunkTokens := modelContextLength(p.model.name) - p.maxTokensToGenerate - documentPromptNumbersMargin -
+		p.countTokens(fmt.Sprintf(documentChunkPrompt, 0, 0, "", question))
+	if chunkTokens < documentChunkTokensMin {
+		sendTextMessage(p.bot, chatID, parseMode, promptTooLongMessage)
+		return
+	}
+	chunks := splitDocument(p.countTokens, document, chunkTokens)
+
+	log.Printf("answering question about a document in %d parts\n", len(chunks))
+	progress := p.newProgressMessage(chatID, fmt.Sprintf("The document is long, reading it in %d parts...", len(chunks)))
+
+	answers := make([]string, 0, len(chunks))
+	failed := 0
+	for i, chunk := range chunks {
+		progress.update(fmt.Sprintf("Reading part %d of %d...", i+1, len(chunks)))
+
+		answer, err := p.complete(ctx, fmt.Sprintf(documentChunkPrompt, i+1, len(chunks), chunk, question))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("failed to get answer about document part", "part", i+1, "parts", len(chunks), "error", err)
+			failed++
+			continue
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" || strings.HasPrefix(answer, documentNoAnswer) {
+			continue
+		}
+		answers = append(answers, answer)
+	}
+
+	if failed == len(chunks) {
+		progress.update("Failed to read the document.")
+		p.sendErrorMessage(ctx, update, parseMode, errDocumentNotAnswered)
+		return
+	}
+
+	progress.update("Combining the answers...")
+	answer, err := p.combineDocumentAnswers(ctx, answers, question)
+	if err != nil {
+		slog.Error("failed to combine answers about the document", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	if failed > 0 {
+		answer += fmt.Sprintf("\n\n(%d of %d parts of the document couldn't be read.)", failed, len(chunks))
+	}
+	progress.update(fmt.Sprintf("The document is read, %d parts.", len(chunks)))
+
+	// Only the question is saved to the history, the document would not fit into the context anyway
+	humanMsg := &dbMessage{
+		UserID:    update.Message.From.ID,
+		OwnerID:   conversationOwnerID(update.Message),
+		Role:      messageRoleUser,
+		Username:  update.Message.From.UserName,
+		Text:      question,
+		CreatedAt: time.Now(),
+	}
+	aiMsg := &dbMessage{
+		OwnerID:   conversationOwnerID(update.Message),
+		Role:      messageRoleAssistant,
+		Text:      answer,
+		CreatedAt: time.Now(),
+	}
+	p.saveExchange(ctx, update, humanMsg, aiMsg, tags)
+
+	sendLongTextMessage(ctx, p.bot, chatID, parseMode, answer)
+	p.clearLastError(ctx, chatID)
+}
+
+// combineDocumentAnswers combines partial answers into one, in several rounds if they don't fit into one prompt.
+func (p *messageProcessor) combineDocumentAnswers(ctx context.Context, answers []string, question string) (string, error) {
+	if len(answers) == 0 {
+		return "The document doesn't seem to contain the answer to the question.", nil
+	}
+
+	answersTokens := modelContextLength(p.model.name) - p.maxTokensToGenerate -
+		p.countTokens(fmt.Sprintf(documentCombinePrompt, "", question))
+
+	for len(answers) > 1 {
+		groups := splitDocument(p.countTokens, strings.Join(answers, "\n\n"), answersTokens)
+		if len(groups) >= len(answers) {
+			return strings.Join(answers, "\n\n"), nil
+		}
+		combined := make([]string, 0, len(groups))
+		for _, group := range groups {
+			answer, err := p.complete(ctx, fmt.Sprintf(documentCombinePrompt, group, question))
+			if err != nil {
+				return "", err
+			}
+			combined = append(combined, strings.TrimSpace(answer))
+		}
+		answers = combined
+	}
+	return answers[0], nil
+}
+
+// splitDocument splits the text into chunks of at most maxTokens tokens, preferably at paragraph boundaries.
+func splitDocument(countTokens tokenCounter, text string, maxTokens int) []string {
+	var (
+		chunks  []string
+		current strings.Builder
+	)
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if current.Len() > 0 && countTokens(current.String()+"\n\n"+paragraph) > maxTokens {
+			flush()
+		}
+		if countTokens(paragraph) <= maxTokens {
+			if current.Len() > 0 {
+				current.WriteString("\n\n")
+			}
+			current.WriteString(paragraph)
+			continue
+		}
+
+		// Paragraph that is too long by itself is split at arbitrary characters,
+		// the longest prefix that fits is found with binary search
+		for paragraph != "" {
+			runes := []rune(paragraph)
+			low, high := 1, len(runes)
+			for low < high {
+				middle := (low + high + 1) / 2
+				if countTokens(string(runes[:middle])) > maxTokens {
+					high = middle - 1
+				} else {
+					low = middle
+				}
+			}
+			chunks = append(chunks, string(runes[:low]))
+			paragraph = string(runes[low:])
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// progressMessage is a message that is edited to report progress of a long operation.
+type progressMessage struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	messageID int
+}
+
+func (p *messageProcessor) newProgressMessage(chatID int64, text string) *progressMessage {
+	progress := &progressMessage{bot: p.bot, chatID: chatID}
+	msg, err := p.bot.Send(tgbotapi.NewMessage(chatID, text))
+	if err != nil {
+		slog.Error("failed to send progress message", "error", err)
+		return progress
+	}
+	progress.messageID = msg.MessageID
+	return progress
+}
+
+func (m *progressMessage) update(text string) {
+	if m.messageID == 0 {
+		return
+	}
+	if _, err := m.bot.Send(tgbotapi.NewEditMessageText(m.chatID, m.messageID, text)); err != nil {
+		slog.Error("failed to update progress message", "error", err)
+	}
+}
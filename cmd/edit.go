@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Edited messages are answered as new turns. If the user edits the last message the bot answered,
+// that exchange is replaced: the stored message and the reply to it are deleted before the edited text
+// is answered. Edits of older messages, and edits after restart, are answered as fresh messages,
+// the conversation history before them is left as is.
+
+// editableMessage is the last message of the conversation, the exchange it starts is replaced if it is edited.
+type editableMessage struct {
+	telegramID int
+	dbID       int
+}
+
+func (p *messageProcessor) rememberEditableMessage(ownerID, telegramID, dbID int) {
+	p.editableMessagesMu.Lock()
+	defer p.editableMessagesMu.Unlock()
+
+	if p.editableMessages == nil {
+		p.editableMessages = make(map[int]editableMessage)
+	}
+	p.editableMessages[ownerID] = editableMessage{telegramID: telegramID, dbID: dbID}
+}
+
+func (p *messageProcessor) forgetEditableMessage(ownerID int) {
+	p.editableMessagesMu.Lock()
+	defer p.editableMessagesMu.Unlock()
+
+	delete(p.editableMessages, ownerID)
+}
+
+func (p *messageProcessor) getEditableMessage(ownerID int) (editableMessage, bool) {
+	p.editableMessagesMu.Lock()
+	defer p.editableMessagesMu.Unlock()
+
+	editable, ok := p.editableMessages[ownerID]
+	return editable, ok
+}
+
+// removeEditedExchange deletes the exchange started by the edited message if it is the last one of the conversation,
+// otherwise the edited message is answered as a fresh one.
+func (p *messageProcessor) removeEditedExchange(ctx context.Context, msg *tgbotapi.Message) error {
+	ownerID := conversationOwnerID(msg)
+	editable, ok := p.getEditableMessage(ownerID)
+	if !ok || editable.telegramID != msg.MessageID {
+		return nil
+	}
+	p.forgetEditableMessage(ownerID)
+
+	// History may have been changed since, e.g. with /reset or /import
+	history, err := p.messages.History(ctx, ownerID, "")
+	if err != nil {
+		return fmt.Errorf("failed to get conversation history from the database: %w", err)
+	}
+	var last *dbMessage
+	for _, m := range history {
+		if m.isHuman() {
+			last = m
+		}
+	}
+	if last == nil || last.ID != editable.dbID {
+		return nil
+	}
+
+	if err := p.messages.DeleteFrom(ctx, ownerID, last.ID); err != nil {
+		return err
+	}
+	log.Println("replacing exchange started by edited message", last.ID)
+	return nil
+}
+
+// deleteMessagesFrom deletes the message with the ID and all later messages of the user.
+func deleteMessagesFrom(ctx context.Context, db *sql.DB, ownerID, messageID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM chat_history WHERE owner_id = ? AND id >= ?", ownerID, messageID); err != nil {
+		return fmt.Errorf("failed to delete messages from database: %w", err)
+	}
+	if err := deleteConversationSummaries(ctx, db, ownerID, messageID); err != nil {
+		return err
+	}
+	return deleteOrphanMessageTags(ctx, db)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+type dbChatError struct {
+	ChatID    int64
+	Text      string
+	CreatedAt time.Time
+}
+
+// sendErrorMessage notifies the user about the failed request and remembers the error for diagnostics.
+func (p *messageProcessor) sendErrorMessage(ctx context.Context, update tgbotapi.Update, parseMode string, err error) {
+	p.saveLastError(ctx, update.Message.Chat.ID, err)
+	sendErrorMessage(p.bot, update, parseMode, err)
+}
+
+func (p *messageProcessor) saveLastError(ctx context.Context, chatID int64, err error) {
+	if saveErr := p.activity.SaveChatError(ctx, &dbChatError{
+		ChatID:    chatID,
+		Text:      err.Error(),
+		CreatedAt: time.Now(),
+	}); saveErr != nil {
+		slog.Error("failed to save the last chat error", "error", saveErr)
+	}
+}
+
+func (p *messageProcessor) clearLastError(ctx context.Context, chatID int64) {
+	if err := p.activity.DeleteChatError(ctx, chatID); err != nil {
+		slog.Error("failed to clear the last chat error", "error", err)
+	}
+}
+
+// handleLastErrorCommand replies with the last error in the chat given as argument, or in the current chat.
+func (p *messageProcessor) handleLastErrorCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	targetChatID := chatID
+
+	if arg := strings.TrimSpace(update.Message.CommandArguments()); arg != "" {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Invalid chat ID '%v'. Use /lasterror [chat ID].", arg))
+			return
+		}
+		targetChatID = id
+	}
+
+	chatErr, err := p.activity.ChatError(ctx, targetChatID)
+	if err != nil {
+		slog.Error("failed to get the last chat error", "error", err)
+		sendErrorMessage(p.bot, update, parseMode, err)
+		return
+	}
+	if chatErr == nil {
+		sendTextMessage(p.bot, chatID, parseMode, "No errors since the last successful reply.")
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Last error at %v:\n%v", chatErr.CreatedAt.Format(time.RFC3339), chatErr.Text))
+}
+
+func saveChatError(ctx context.Context, db *sql.DB, chatErr *dbChatError) error {
+	const query = `
+		INSERT INTO chat_errors(chat_id, message, created_at)
+		VALUES(?, ?, ?)
+		ON CONFLICT(chat_id) DO UPDATE SET message = excluded.message, created_at = excluded.created_at
+	`
+
+	if _, err := db.ExecContext(ctx, query, chatErr.ChatID, chatErr.Text, chatErr.CreatedAt.UnixMilli()); err != nil {
+		return fmt.Errorf("failed to save chat error to the database: %w", err)
+	}
+	return nil
+}
+
+func getChatError(ctx context.Context, db *sql.DB, chatID int64) (*dbChatError, error) {
+	const query = `
+		SELECT chat_id, message, created_at FROM chat_errors WHERE chat_id = ?
+	`
+
+	chatErr := new(dbChatError)
+	var createdAt int64
+	if err := db.QueryRowContext(ctx, query, chatID).Scan(&chatErr.ChatID, &chatErr.Text, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get chat error from the database: %w", err)
+	}
+	chatErr.CreatedAt = time.UnixMilli(createdAt)
+	return chatErr, nil
+}
+
+func deleteChatError(ctx context.Context, db *sql.DB, chatID int64) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM chat_errors WHERE chat_id = ?", chatID); err != nil {
+		return fmt.Errorf("failed to delete chat error from database: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	exportFormatVersion = 1
+	exportFilename      = "chat_history.json"
+
+	exportRoleHuman = "human"
+	exportRoleAI    = "ai"
+
+	importFileSizeMax = 10 << 20
+)
+
+// exportedHistory is the JSON document produced by /export and accepted by /import.
+type exportedHistory struct {
+	Version  int               `json:"version"`
+	Messages []exportedMessage `json:"messages"`
+}
+
+type exportedMessage struct {
+	Role      string    `json:"role"`
+	Username  string    `json:"username,omitempty"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (p *messageProcessor) handleExportCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	history, err := p.messages.History(ctx, conversationOwnerID(update.Message), "")
+	if err != nil {
+		slog.Error("failed to get conversation history from the database", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	if len(history) == 0 {
+		sendTextMessage(p.bot, chatID, parseMode, "Conversation history is empty, there is nothing to export.")
+		return
+	}
+
+	data, err := json.MarshalIndent(exportHistory(history), "", "  ")
+	if err != nil {
+		slog.Error("failed to encode conversation history", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	doc := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Name: exportFilename, Bytes: data})
+	doc.Caption = "Reply with /import to this file to restore the conversation."
+	if _, err := p.bot.Send(doc); err != nil {
+		slog.Error("failed to send exported conversation history", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	log.Printf("sent exported conversation history with %d messages\n", len(history))
+}
+
+// handleImportCommand replaces the conversation history with the one from the exported file the command replies to.
+func (p *messageProcessor) handleImportCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	reply := update.Message.ReplyToMessage
+
+	if reply == nil || reply.Document == nil {
+		sendTextMessage(p.bot, chatID, parseMode, "Reply with /import to a file produced by /export to restore the conversation.")
+		return
+	}
+	if reply.Document.FileSize > importFileSizeMax {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("The file is too large, at most %d MB can be imported.", importFileSizeMax>>20))
+		return
+	}
+
+	data, err := p.downloadFile(ctx, reply.Document.FileID, importFileSizeMax)
+	if err != nil {
+		slog.Error("failed to download the file to import", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	history, err := parseExportedHistory(data, conversationOwnerID(update.Message), update.Message.From.ID, time.Now())
+	if err != nil {
+		slog.Warn("rejecting conversation history to import", "error", err)
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("The file can't be imported: %v", err))
+		return
+	}
+
+	if err := p.messages.ReplaceAll(ctx, conversationOwnerID(update.Message), history); err != nil {
+		slog.Error("failed to import conversation history", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	p.completionCache.clear()
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Imported %d messages, the previous conversation history is replaced.", len(history)))
+}
+
+func exportHistory(history []*dbMessage) *exportedHistory {
+	exported := &exportedHistory{
+		Version:  exportFormatVersion,
+		Messages: make([]exportedMessage, 0, len(history)),
+	}
+	for _, msg := range history {
+		role := exportRoleAI
+		if msg.isHuman() {
+			role = exportRoleHuman
+		}
+		exported.Messages = append(exported.Messages, exportedMessage{
+			Role:      role,
+			Username:  msg.Username,
+			Text:      msg.Text,
+			CreatedAt: msg.CreatedAt,
+		})
+	}
+	return exported
+}
+
+// parseExportedHistory validates the exported document and converts it to messages.
+// Human messages are attributed to the importing user, since user IDs are specific to the bot.
+func parseExportedHistory(data []byte, ownerID, userID int, now time.Time) ([]*dbMessage, error) {
+	var exported exportedHistory
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&exported); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %w", err)
+	}
+	if exported.Version != exportFormatVersion {
+		return nil, fmt.Errorf("unsupported version %d, expected %d", exported.Version, exportFormatVersion)
+	}
+	if len(exported.Messages) == 0 {
+		return nil, errors.New("there are no messages")
+	}
+
+	history := make([]*dbMessage, 0, len(exported.Messages))
+	for i, m := range exported.Messages {
+		n := i + 1
+
+		msg := &dbMessage{OwnerID: ownerID, Text: m.Text, CreatedAt: m.CreatedAt}
+		switch m.Role {
+		case exportRoleHuman:
+			msg.UserID = userID
+			msg.Role = messageRoleUser
+			msg.Username = m.Username
+		case exportRoleAI:
+			msg.Role = messageRoleAssistant
+		default:
+			return nil, fmt.Errorf("message %d has unknown role '%v', expected '%v' or '%v'", n, m.Role, exportRoleHuman, exportRoleAI)
+		}
+
+		if strings.TrimSpace(m.Text) == "" {
+			return nil, fmt.Errorf("message %d has no text", n)
+		}
+		if m.CreatedAt.IsZero() {
+			return nil, fmt.Errorf("message %d has no creation time", n)
+		}
+		if m.CreatedAt.After(now) {
+			return nil, fmt.Errorf("message %d is created in the future at %v", n, m.CreatedAt)
+		}
+		if i > 0 && m.CreatedAt.Before(exported.Messages[i-1].CreatedAt) {
+			return nil, fmt.Errorf("message %d is created before the previous one", n)
+		}
+
+		history = append(history, msg)
+	}
+	return history, nil
+}
+
+// downloadFile returns at most maxSize bytes of the file sent to the bot.
+func (p *messageProcessor) downloadFile(ctx context.Context, fileID string, maxSize int64) ([]byte, error) {
+	url, err := p.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file URL: %w", err)
+	}
+	return download(ctx, p.bot.Client, url, maxSize)
+}
+
+// download returns at most maxSize bytes of the file at the URL.
+func download(ctx context.Context, client *http.Client, url string, maxSize int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download file: %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSize))
+}
+
+// replaceAllMessages deletes the conversation history of the user and saves the messages instead, all or nothing.
+func replaceAllMessages(ctx context.Context, db *sql.DB, ownerID int, history []*dbMessage) error {
+	const query = `
+		INSERT INTO chat_history(user_id, owner_id, role, username, message, created_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_history WHERE owner_id = ?", ownerID); err != nil {
+		return fmt.Errorf("failed to delete messages from database: %w", err)
+	}
+	for _, msg := range history {
+		row := tx.QueryRowContext(ctx, query, msg.UserID, ownerID, msg.Role, msg.Username, msg.Text, msg.CreatedAt.UnixMilli())
+		if err := row.Scan(&msg.ID); err != nil {
+			return fmt.Errorf("failed to save message to the database: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if err := deleteConversationSummaries(ctx, db, ownerID, 0); err != nil {
+		return err
+	}
+	return deleteOrphanMessageTags(ctx, db)
+}
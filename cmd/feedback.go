@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	feedbackGood  = "good"
+	feedbackBad   = "bad"
+	feedbackStats = "stats"
+)
+
+type dbFeedback struct {
+	ChatID    int64
+	UserID    int
+	MessageID int
+	Text      string
+	Rating    string
+	Comment   string
+	CreatedAt time.Time
+}
+
+func (p *messageProcessor) handleFeedbackCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	args := strings.Fields(update.Message.CommandArguments())
+
+	if len(args) > 0 && strings.ToLower(args[0]) == feedbackStats {
+		if !p.isAdmin(update.Message.From.ID) {
+			sendTextMessage(p.bot, chatID, parseMode, "Feedback statistics are available to the administrator only.")
+			return
+		}
+		p.sendFeedbackStats(ctx, update, parseMode)
+		return
+	}
+
+	if len(args) == 0 || (strings.ToLower(args[0]) != feedbackGood && strings.ToLower(args[0]) != feedbackBad) {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Reply to one of my messages with /feedback %v|%v [comment] to rate it.", feedbackGood, feedbackBad))
+		return
+	}
+
+	reply := update.Message.ReplyToMessage
+	if reply == nil || reply.From == nil || reply.From.ID != p.bot.Self.ID || reply.Text == "" {
+		sendTextMessage(p.bot, chatID, parseMode, "Feedback has to be sent as a reply to one of my messages.")
+		return
+	}
+
+	if err := p.activity.SaveFeedback(ctx, &dbFeedback{
+		ChatID:    chatID,
+		UserID:    update.Message.From.ID,
+		MessageID: reply.MessageID,
+		Text:      reply.Text,
+		Rating:    strings.ToLower(args[0]),
+		Comment:   strings.Join(args[1:], " "),
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		slog.Error("failed to save feedback", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, "Thank you for your feedback!")
+}
+
+func (p *messageProcessor) sendFeedbackStats(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	good, bad, err := p.activity.FeedbackStats(ctx)
+	if err != nil {
+		slog.Error("failed to get feedback statistics", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	up, down, err := p.messages.RatingStats(ctx)
+	if err != nil {
+		slog.Error("failed to get rating statistics", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	text := "No feedback yet."
+	if good+bad > 0 {
+		text = fmt.Sprintf("Feedback: %d good, %d bad, %.0f%% approval.", good, bad, approvalRate(good, bad))
+	}
+	if up+down > 0 {
+		text += fmt.Sprintf("\nReply ratings: %d 👍, %d 👎, %.0f%% approval.", up, down, approvalRate(up, down))
+	}
+	sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, text)
+}
+
+func saveFeedback(ctx context.Context, db *sql.DB, feedback *dbFeedback) error {
+	const query = `
+		INSERT INTO feedback(chat_id, user_id, message_id, message, rating, comment, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if _, err := db.ExecContext(
+		ctx,
+		query,
+		feedback.ChatID,
+		feedback.UserID,
+		feedback.MessageID,
+		feedback.Text,
+		feedback.Rating,
+		feedback.Comment,
+		feedback.CreatedAt.UnixMilli(),
+	); err != nil {
+		return fmt.Errorf("failed to save feedback to the database: %w", err)
+	}
+	return nil
+}
+
+func getFeedbackStats(ctx context.Context, db *sql.DB) (good, bad int, err error) {
+	const query = `
+		SELECT
+			COALESCE(SUM(CASE WHEN rating = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN rating = ? THEN 1 ELSE 0 END), 0)
+		FROM feedback
+	`
+
+	if err := db.QueryRowContext(ctx, query, feedbackGood, feedbackBad).Scan(&good, &bad); err != nil {
+		return 0, 0, fmt.Errorf("failed to get feedback statistics from the database: %w", err)
+	}
+	return good, bad, nil
+}
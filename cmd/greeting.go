@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingGreetedAt = "greeted_at"
+
+	defaultWelcomeMessage = "*Hi!* " + helpIntroMessage + " Send /help to see what else I can do."
+)
+
+// greetOnFirstContact sends the configured greeting before the first reply in the chat, returns true if it is sent.
+// It has to be called before the first message is saved, the greeting is sent once and is not saved to the history.
+func (p *messageProcessor) greetOnFirstContact(ctx context.Context, chatID int64, ownerID int, parseMode string) bool {
+	if p.greeting == "" {
+		return false
+	}
+
+	greetedAt, err := p.settings.ChatSetting(ctx, chatID, chatSettingGreetedAt)
+	if err != nil {
+		slog.Error("failed to get chat greeting time", "error", err)
+		return false
+	}
+	if greetedAt != "" {
+		return false
+	}
+
+	empty, err := p.messages.IsEmpty(ctx, ownerID)
+	if err != nil {
+		slog.Error("failed to check conversation history", "error", err)
+		return false
+	}
+	if !empty {
+		return false
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingGreetedAt, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		slog.Error("failed to save chat greeting time", "error", err)
+		return false
+	}
+	sendTextMessage(p.bot, chatID, parseMode, p.greeting)
+	return true
+}
+
+// seedConversation starts the empty conversation with the opening AI message, so that the first prompt
+// is built the same way as the next ones. The message is sent to the chat too if announce is set,
+// it is tagged with the tags so that the conversation scoped to them starts with it as well.
+func (p *messageProcessor) seedConversation(ctx context.Context, chatID int64, ownerID int, tags []string, announce bool) {
+	empty, err := p.messages.IsEmpty(ctx, ownerID)
+	if err != nil {
+		slog.Error("failed to check conversation history", "error", err)
+		return
+	}
+	if !empty {
+		return
+	}
+
+	aiMsg := &dbMessage{
+		UserID:    0,
+		OwnerID:   ownerID,
+		Role:      messageRoleAssistant,
+		Text:      gptDefaultAIMessage,
+		CreatedAt: time.Now(),
+	}
+	if err := p.messages.SaveAll(ctx, []*dbMessage{aiMsg}, tags); err != nil {
+		slog.Error("failed to save the opening AI message to the database", "error", err)
+		return
+	}
+	if announce {
+		sendTextMessage(p.bot, chatID, "", gptDefaultAIMessage)
+	}
+}
+
+// handleStartCommand welcomes the user with the welcome message, which is sent as Markdown. Conversation that is
+// just started is seeded with the opening AI message, the history of the returning user is left as is.
+func (p *messageProcessor) handleStartCommand(ctx context.Context, update tgbotapi.Update) {
+	chatID := update.Message.Chat.ID
+
+	sendTextMessage(p.bot, chatID, tgbotapi.ModeMarkdown, p.welcomeMessage)
+	p.seedConversation(ctx, chatID, conversationOwnerID(update.Message), nil, true)
+}
+
+func isHistoryEmpty(ctx context.Context, db *sql.DB, ownerID int) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM chat_history WHERE owner_id = ?)", ownerID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check for messages in the database: %w", err)
+	}
+	return !exists, nil
+}
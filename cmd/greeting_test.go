@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestGreetingIsSentOncePerChat(t *testing.T) {
+	const greeting = "Welcome!"
+
+	tests := []struct {
+		name          string
+		updates       []tgbotapi.Update
+		wantGreetings int
+	}{
+		{name: "first message", updates: []tgbotapi.Update{privateMessage(1, "hello")}, wantGreetings: 1},
+		{
+			name:          "next messages",
+			updates:       []tgbotapi.Update{privateMessage(1, "hello"), privateMessage(1, "and again"), privateMessage(1, "and again")},
+			wantGreetings: 1,
+		},
+		{
+			name:          "each chat",
+			updates:       []tgbotapi.Update{privateMessage(1, "hello"), privateMessage(2, "hello"), privateMessage(1, "and again")},
+			wantGreetings: 2,
+		},
+		{
+			name:          "after the conversation is reset",
+			updates:       []tgbotapi.Update{privateMessage(1, "hello"), commandMessage(1, "/reset"), privateMessage(1, "hello")},
+			wantGreetings: 1,
+		},
+		{name: "command", updates: []tgbotapi.Update{commandMessage(1, "/help")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+			p.greeting = greeting
+
+			for _, update := range tt.updates {
+				p.processMessage(context.Background(), update)
+			}
+
+			greetings := 0
+			for _, text := range telegram.sent {
+				if text == greeting {
+					greetings++
+				}
+			}
+			if greetings != tt.wantGreetings {
+				t.Errorf("greetings = %d, want %d, sent %q", greetings, tt.wantGreetings, telegram.sent)
+			}
+		})
+	}
+}
+
+func TestFirstPromptStartsWithOpeningAIMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		completionAPI bool
+		want          string
+	}{
+		{
+			name: "chat prompt",
+			want: "system: S\n" + "assistant: " + gptDefaultAIMessage + "\n" + "user: hello\n",
+		},
+		{
+			name:          "text prompt",
+			completionAPI: true,
+			want:          defaultFormatPrompt("S", "ai "+gptDefaultAIMessage, "human hello"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p := newTestProcessor(t, &fakeTelegram{}, &fakeChatCompletions{})
+			api := &contextLengthExceeded{}
+			p.gptClient = newTestOpenAIClient(t, api.handle)
+			p.persona = "S"
+			if tt.completionAPI {
+				p.model = chatModel{name: openai.GPT3TextDavinci003, completionAPI: true}
+				p.countTokens = newTokenCounter(openai.GPT3TextDavinci003)
+			}
+
+			p.processMessage(ctx, privateMessage(1, "hello"))
+
+			if len(api.prompts) != 1 || api.prompts[0] != tt.want {
+				t.Fatalf("prompts = %q, want %q", api.prompts, tt.want)
+			}
+			history, err := p.messages.History(ctx, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, msg := range history {
+				got = append(got, msg.Text)
+			}
+			if want := []string{gptDefaultAIMessage, "hello", "hi"}; !equalStrings(got, want) {
+				t.Errorf("history = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// isGroupChat reports whether the chat is a group, where the bot only answers messages addressed to it.
+func isGroupChat(chat *tgbotapi.Chat) bool {
+	return chat.IsGroup() || chat.IsSuperGroup()
+}
+
+// conversationOwnerID returns the ID the conversation history of the message is kept under: the sender
+// in private chat, the chat in group, so that members of the group take part in the same conversation.
+func conversationOwnerID(msg *tgbotapi.Message) int {
+	if isGroupChat(msg.Chat) {
+		return int(msg.Chat.ID)
+	}
+	return msg.From.ID
+}
+
+// isAddressedToBot reports whether the group message is meant for the bot: it mentions the bot,
+// replies to the bot's message or is a command without the name of another bot.
+func (p *messageProcessor) isAddressedToBot(msg *tgbotapi.Message) bool {
+	if msg.IsCommand() {
+		command := msg.CommandWithAt()
+		i := strings.Index(command, "@")
+		return i == -1 || strings.EqualFold(command[i+1:], p.bot.Self.UserName)
+	}
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == p.bot.Self.ID {
+		return true
+	}
+	return strings.Contains(strings.ToLower(msg.Text), strings.ToLower(p.botMention()))
+}
+
+// withoutBotMention removes mentions of the bot from the text, they mean nothing to the model.
+func (p *messageProcessor) withoutBotMention(text string) string {
+	mention := p.botMention()
+	for {
+		i := strings.Index(strings.ToLower(text), strings.ToLower(mention))
+		if i == -1 {
+			return strings.TrimSpace(text)
+		}
+		text = text[:i] + text[i+len(mention):]
+	}
+}
+
+func (p *messageProcessor) botMention() string {
+	return "@" + p.bot.Self.UserName
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestOwnMessagesAreIgnored(t *testing.T) {
+	const botID, userID, groupID = 99, 1, -100
+
+	ownMessage := tgbotapi.Update{UpdateID: 1, Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: botID, UserName: "test_bot", IsBot: true},
+		Chat: &tgbotapi.Chat{ID: groupID, Type: "group"},
+		Text: "@test_bot how can I help you?",
+	}}
+	userMessage := privateMessage(userID, "hello")
+	userMessage.UpdateID = 2
+
+	completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+	p := newTestProcessor(t, &fakeTelegram{}, completions)
+	p.bot.Self = tgbotapi.User{ID: botID, UserName: "test_bot", IsBot: true}
+	// Bot is allowed as a user too, so that only the check of its own messages skips them
+	p.allowedUserIDs = map[int]struct{}{botID: {}, userID: {}}
+	p.workerCount = 1
+	p.updatesBufferSize = 10
+	p.updatesSilenceTimeout = time.Hour
+	source := newFakeUpdatesSource([]tgbotapi.Update{ownMessage, userMessage})
+	p.updatesSource = source
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go p.processIncomingMessages(ctx, context.Background(), done)
+	defer func() {
+		cancel()
+		close(source.release)
+		<-done
+	}()
+
+	// Messages are processed in order by the only worker, so the own message is done with by the time the user's is
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		processed, err := p.activity.LastUpdateID(context.Background(), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed == userMessage.UpdateID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message of the user is not processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := len(completions.requests); got != 1 {
+		t.Fatalf("requests = %d, want 1", got)
+	}
+	if processed, _ := p.activity.LastUpdateID(context.Background(), groupID); processed != 0 {
+		t.Errorf("own message %d is processed", processed)
+	}
+	if empty, _ := p.messages.IsEmpty(context.Background(), groupID); !empty {
+		t.Error("own message is saved to the history")
+	}
+}
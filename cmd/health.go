@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthCheckPath    = "/healthz"
+	readyCheckPath     = "/readyz"
+	healthCheckTimeout = 2 * time.Second
+)
+
+var (
+	errNotReady           = errors.New("application is initializing")
+	errUpdatesNotReceived = errors.New("Telegram updates are not being received")
+)
+
+// healthChecks serve the health check endpoints from the start of the application. The application is ready
+// once the processor is set, after the database is migrated and Telegram updates are set up.
+type healthChecks struct {
+	processor atomic.Pointer[messageProcessor]
+}
+
+func (h *healthChecks) setReady(p *messageProcessor) {
+	h.processor.Store(p)
+}
+
+// handleReadyCheck responds with 200 once the application is initialized, with 503 until then.
+func (h *healthChecks) handleReadyCheck(w http.ResponseWriter, r *http.Request) {
+	if h.processor.Load() == nil {
+		http.Error(w, errNotReady.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleHealthCheck responds as the processor does, with 503 while the application is initializing.
+func (h *healthChecks) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	p := h.processor.Load()
+	if p == nil {
+		http.Error(w, errNotReady.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	p.handleHealthCheck(w, r)
+}
+
+// handleHealthCheck responds with 200 while updates are received and the database is reachable, with 503 otherwise.
+func (p *messageProcessor) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if err := p.checkHealth(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (p *messageProcessor) checkHealth(ctx context.Context) error {
+	if !p.updatesHealthy.Load() {
+		return errUpdatesNotReceived
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := p.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database is unreachable: %w", err)
+	}
+	return nil
+}
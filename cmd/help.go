@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandHelp  = "help"
+	commandStart = "start"
+
+	helpIntroMessage = "Send me a message and I will reply, the conversation is remembered until you clear it."
+)
+
+// botCommand is a command listed in /help and in the command menu of Telegram clients.
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+	adminOnly   bool
+}
+
+var botCommands = []botCommand{
+	{Command: commandHelp, Description: "show this help"},
+	{Command: commandReset, Description: "clear the conversation history"},
+	{Command: commandCancel, Description: "stop generating the reply"},
+	{Command: commandRetry, Description: "regenerate the reply to the last unanswered message"},
+	{Command: commandCode, Description: "ask for code, e.g. /code a function that reverses a string"},
+	{Command: commandThink, Description: "get a more deliberate answer from a larger model, e.g. /think why is the sky blue"},
+	{Command: commandImage, Description: "generate an image, e.g. /image a cat in a hat"},
+	{Command: commandPersona, Description: "set the assistant persona for you, or reset it"},
+	{Command: commandModel, Description: "switch the model that answers you, e.g. /model gpt-4"},
+	{Command: commandMaxTokens, Description: "set how long your replies may be, e.g. /maxtokens 1000"},
+	{Command: commandStyle, Description: "set the response style in this chat"},
+	{Command: commandFormat, Description: "switch replies between Markdown and plain text"},
+	{Command: commandFocus, Description: "use only messages with the #tag in the conversation"},
+	{Command: commandTimeout, Description: "set how long to wait for a reply"},
+	{Command: commandNames, Description: "include sender names in the conversation"},
+	{Command: commandRules, Description: "turn the rules of the system prompt on or off"},
+	{Command: commandFormatting, Description: "turn the formatting instructions of the system prompt on or off"},
+	{Command: commandCount, Description: "show how many tokens the conversation takes"},
+	{Command: commandQuota, Description: "show how many messages are left today"},
+	{Command: commandUsage, Description: "show how many tokens you used and what they cost"},
+	{Command: commandStar, Description: "reply to a message to add it to the weekly digest"},
+	{Command: commandFeedback, Description: "rate the reply you reply to"},
+	{Command: commandHistory, Description: "show the conversation history as a transcript"},
+	{Command: commandExport, Description: "download the conversation history"},
+	{Command: commandImport, Description: "reply to an exported file to restore the conversation"},
+	{Command: commandPrompt, Description: "show the prompt that would be sent for the question", adminOnly: true},
+	{Command: commandLastError, Description: "show the last error in the chat", adminOnly: true},
+	{Command: commandMaintenance, Description: "turn maintenance mode on or off", adminOnly: true},
+}
+
+// handleHelpCommand replies with the list of commands, administrative ones are listed for administrator only.
+func (p *messageProcessor) handleHelpCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	isAdmin := p.isAdmin(update.Message.From.ID)
+
+	var b strings.Builder
+	b.WriteString(helpIntroMessage)
+	b.WriteString("\n")
+	for _, cmd := range botCommands {
+		if cmd.adminOnly && !isAdmin {
+			continue
+		}
+		b.WriteString("\n/" + cmd.Command + " - " + cmd.Description)
+	}
+
+	sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, b.String())
+}
+
+// registerBotCommands sets the commands shown in the command menu of Telegram clients, administrative ones are left out.
+func registerBotCommands(bot *tgbotapi.BotAPI) error {
+	commands := make([]botCommand, 0, len(botCommands))
+	for _, cmd := range botCommands {
+		if !cmd.adminOnly {
+			commands = append(commands, cmd)
+		}
+	}
+
+	data, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	_, err = bot.MakeRequest("setMyCommands", url.Values{"commands": {string(data)}})
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newTestDB returns the migrated SQLite database in the temporary directory of the test.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, migrator := newTestMigrator(t)
+	if err := migrator.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestMigrator returns the empty SQLite database in the temporary directory of the test and its migrator.
+func newTestMigrator(t *testing.T) (*sql.DB, *migrate.Migrate) {
+	t.Helper()
+
+	db := sql.OpenDB(newIORetryConnector(t.TempDir()+"/db.sqlite"+sqliteConcurrencyParams, 0))
+	t.Cleanup(func() { db.Close() })
+
+	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{DatabaseName: sqlDatabaseDriverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrate.NewWithDatabaseInstance("file://../database/migrations", databaseDriverSQLite, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, migrator
+}
+
+// hostRewriter sends the requests of the client to the test server, whatever host they are addressed to.
+type hostRewriter struct {
+	target *url.URL
+}
+
+func (r hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = r.target.Scheme, r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestBot returns the bot that talks to the fake Telegram API served by the handler.
+func newTestBot(t testing.TB, handler http.HandlerFunc) *tgbotapi.BotAPI {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tgbotapi.BotAPI{Token: "token", Client: &http.Client{Transport: hostRewriter{target: target}}}
+}
+
+// newTestOpenAIClient returns the client of the fake OpenAI API served by the handler.
+func newTestOpenAIClient(t testing.TB, handler http.HandlerFunc) *openai.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = srv.URL + "/v1"
+	return openai.NewClientWithConfig(cfg)
+}
+
+// commandMessage returns the private message from the user with the bot command, e.g. "/style formal".
+func commandMessage(userID int, text string) tgbotapi.Update {
+	update := privateMessage(userID, text)
+	command, _, _ := strings.Cut(text, " ")
+	update.Message.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	return update
+}
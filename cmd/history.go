@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandHistory = "history"
+
+	historyFilename   = "chat_history.txt"
+	historyTimeLayout = "2006-01-02 15:04 MST"
+)
+
+// handleHistoryCommand replies with the conversation history as a transcript,
+// the transcript that doesn't fit into a message is sent as a text file.
+func (p *messageProcessor) handleHistoryCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	history, err := p.messages.History(ctx, conversationOwnerID(update.Message), "")
+	if err != nil {
+		slog.Error("failed to get conversation history from the database", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	if len(history) == 0 {
+		sendTextMessage(p.bot, chatID, parseMode, "Conversation history is empty.")
+		return
+	}
+
+	transcript := formatTranscript(history)
+
+	// Transcript is sent as plain text, messages may contain anything
+	if utf8.RuneCountInString(transcript) <= telegramMessageLengthMax {
+		sendTextMessage(p.bot, chatID, "", transcript)
+		return
+	}
+
+	doc := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Name: historyFilename, Bytes: []byte(transcript)})
+	doc.Caption = fmt.Sprintf("Conversation history, %d messages.", len(history))
+	if _, err := p.bot.Send(doc); err != nil {
+		slog.Error("failed to send conversation history", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	log.Printf("sent conversation history with %d messages as a file\n", len(history))
+}
+
+// formatTranscript formats the messages as a readable transcript with UTC timestamps and role labels.
+func formatTranscript(history []*dbMessage) string {
+	var b strings.Builder
+	for i, msg := range history {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+
+		label := "AI"
+		if msg.isHuman() {
+			label = "Human"
+			if msg.Username != "" {
+				label += " (@" + msg.Username + ")"
+			}
+		}
+		fmt.Fprintf(&b, "[%v] %v:\n%v", msg.CreatedAt.UTC().Format(historyTimeLayout), label, msg.Text)
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	commandImage = "image"
+
+	defaultImageSize = "512"
+
+	// imageFileSizeMax is far above the size of generated images, it only guards against a broken response.
+	imageFileSizeMax = 20 << 20
+
+	openAIErrorCodeContentPolicyViolation = "content_policy_violation"
+	openAIErrorMessageSafetySystem        = "safety system"
+
+	contentPolicyMessage = "Sorry, this image can't be generated, the request was rejected by OpenAI content policy. Please try to describe it differently."
+)
+
+// imageSizes maps the configured image size to the size accepted by OpenAI API.
+var imageSizes = map[string]string{
+	"256":  openai.CreateImageSize256x256,
+	"512":  openai.CreateImageSize512x512,
+	"1024": openai.CreateImageSize1024x1024,
+}
+
+func parseImageSize(size string) (string, error) {
+	if size == "" {
+		size = defaultImageSize
+	}
+	if imageSize, ok := imageSizes[size]; ok {
+		return imageSize, nil
+	}
+	return "", fmt.Errorf("unsupported image size '%v', expected 256, 512 or 1024", size)
+}
+
+// handleImageCommand generates the image described in the command, e.g. /image a cat in a hat.
+// Images are kept in the blob store, but not in the conversation history, so they don't take the model context.
+func (p *messageProcessor) handleImageCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	description := strings.TrimSpace(update.Message.CommandArguments())
+
+	if description == "" {
+		sendTextMessage(p.bot, chatID, parseMode, "Use /image <description> to generate an image, e.g. /image a cat in a hat.")
+		return
+	}
+
+	if _, err := p.bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatUploadPhoto)); err != nil {
+		slog.Error("failed to send upload photo action", "error", err)
+	}
+
+	data, err := p.generateImage(ctx, description)
+	if err != nil {
+		if isContentPolicyError(err) {
+			slog.Warn("image request is rejected by content policy", "error", err)
+			p.saveLastError(ctx, chatID, err)
+			sendTextMessage(p.bot, chatID, parseMode, contentPolicyMessage)
+			return
+		}
+		if isOpenAITimeoutError(ctx, err) {
+			slog.Warn("image generation timed out", "error", err)
+			p.saveLastError(ctx, chatID, err)
+			sendTextMessage(p.bot, chatID, parseMode, openAITimeoutMessage)
+			return
+		}
+		slog.Error("failed to generate image", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	key := fmt.Sprintf("images/%d/%d.png", chatID, time.Now().UnixNano())
+	if err := p.blobs.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		slog.Error("failed to save generated image", "error", err)
+	}
+
+	photo := tgbotapi.NewPhotoUpload(chatID, tgbotapi.FileBytes{Name: "image.png", Bytes: data})
+	if _, err := p.bot.Send(photo); err != nil {
+		slog.Error("failed to send generated image", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	log.Printf("sent generated image with %d bytes\n", len(data))
+	p.clearLastError(ctx, chatID)
+}
+
+func (p *messageProcessor) generateImage(ctx context.Context, description string) ([]byte, error) {
+	requestCtx, cancel := p.withOpenAITimeout(ctx)
+	defer cancel()
+
+	resp, err := p.gptClient.CreateImage(requestCtx, openai.ImageRequest{
+		Prompt:         description,
+		N:              1,
+		Size:           p.imageSize,
+		ResponseFormat: openai.CreateImageResponseFormatURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, errors.New("OpenAI returned no images")
+	}
+	return download(ctx, p.bot.Client, resp.Data[0].URL, imageFileSizeMax)
+}
+
+// isContentPolicyError reports whether OpenAI refused to generate the image because of its content.
+func isContentPolicyError(err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code, _ := apiErr.Code.(string)
+	return code == openAIErrorCodeContentPolicyViolation || strings.Contains(apiErr.Message, openAIErrorMessageSafetySystem)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// lockFile is a no-op on platforms without flock support.
+func lockFile(ctx context.Context, path string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const fileLockPollInterval = 100 * time.Millisecond
+
+// lockFile acquires exclusive advisory lock on the file, waiting until it is released by other processes.
+// The returned function releases the lock.
+func lockFile(ctx context.Context, path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file '%v': %w", path, err)
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock file '%v': %w", path, err)
+		}
+
+		select {
+		case <-time.After(fileLockPollInterval):
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("failed to lock file '%v': %w", path, ctx.Err())
+		}
+	}
+
+	return func() error {
+		defer f.Close()
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging makes the default logger write records of the level and above in the format,
+// lines logged with the standard log package become records of info level.
+// Empty level and format mean info and text, the invalid ones are reported and replaced with them.
+func setupLogging(w io.Writer, level, format string) error {
+	var logLevel slog.Level
+	var err error
+	if level != "" {
+		if levelErr := logLevel.UnmarshalText([]byte(level)); levelErr != nil {
+			err = fmt.Errorf("invalid log level '%v', expected debug, info, warn or error", level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", logFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		err = errors.Join(err, fmt.Errorf("invalid log format '%v', expected %v or %v", format, logFormatText, logFormatJSON))
+	}
+	if err != nil {
+		handler = slog.NewTextHandler(w, nil)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return err
+}
+
+// fatal logs the error with the default logger and exits, like log.Fatal does with the standard one.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
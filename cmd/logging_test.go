@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	tests := []struct {
+		name   string
+		level  string
+		format string
+		// wantInfo is whether the line of the standard log package is written, errors are written always.
+		wantErr   bool
+		wantInfo  bool
+		wantDebug bool
+		wantJSON  bool
+	}{
+		{name: "defaults", wantInfo: true},
+		{name: "debug", level: "debug", wantInfo: true, wantDebug: true},
+		{name: "warn drops info lines only", level: "warn"},
+		{name: "error as JSON", level: "ERROR", format: "json", wantJSON: true},
+		{name: "invalid level falls back to defaults", level: "verbose", format: "json", wantErr: true, wantInfo: true},
+		{name: "invalid format falls back to defaults", level: "error", format: "xml", wantErr: true, wantInfo: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := setupLogging(&buf, tt.level, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			slog.Error("failed to save", "error", "disk is full")
+			log.Println("started")
+			slog.Debug("prompt")
+			out := buf.String()
+
+			if !strings.Contains(out, "failed to save") || !strings.Contains(out, "disk is full") {
+				t.Errorf("error record is not written: %q", out)
+			}
+			if got := strings.Contains(out, "started"); got != tt.wantInfo {
+				t.Errorf("info line is written = %v, want %v: %q", got, tt.wantInfo, out)
+			}
+			if got := strings.Contains(out, "prompt"); got != tt.wantDebug {
+				t.Errorf("debug record is written = %v, want %v: %q", got, tt.wantDebug, out)
+			}
+			if got := strings.HasPrefix(out, "{"); got != tt.wantJSON {
+				t.Errorf("output is JSON = %v, want %v: %q", got, tt.wantJSON, out)
+			}
+		})
+	}
+}
@@ -6,158 +6,306 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/database/sqlite3"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/mattn/go-sqlite3"
-	gpt3 "github.com/sashabaranov/go-gpt3"
+	openai "github.com/sashabaranov/go-openai"
 )
 
 const (
 	initTimeout                      = 60 * time.Second
 	telegramBotUpdaterTimeoutSeconds = 60
+	telegramBotRequestTimeoutMargin  = 30 * time.Second
 	sqlDatabaseDriverName            = "sqlite3"
 
+	databaseDriverSQLite   = sqlDatabaseDriverName
+	databaseDriverPostgres = "postgres"
+
 	defaultMaxMessagesInHistory         = 101
 	defaultMaxTokensToGenerate          = 301
 	defaultSQLMigrationsDirPathRelative = "database/migrations/"
 	defaultApplicationDataRootDirPath   = "/data"
 	defaultDatabaseFilename             = "db.sqlite"
+	defaultUpdatesSilenceTimeout        = 10 * time.Minute
+	defaultCompletionCacheNormalize     = "trim,lower,spaces"
+	// defaultShutdownTimeout is below 10 seconds Docker waits for the container to stop before killing it.
+	defaultShutdownTimeout = 8 * time.Second
+
+	// configPlaceholder is the value of required parameters in Dockerfile, it has to be replaced.
+	configPlaceholder = "xxxxxx"
+
+	ps = string(os.PathSeparator)
+
+	telegramMessageLengthMax = 4096
+
+	messageRoleUser      = "user"
+	messageRoleAssistant = "assistant"
 
-	ps                     = string(os.PathSeparator)
-	databaseDateTimeLayout = "2006-01-02 15:04:05.999999999Z07:00"
+	telegramParseModeMarkdownV2       = "MarkdownV2"
+	telegramParseEntitiesErrorMessage = "can't parse entities"
 
-	gptModel                 = gpt3.GPT3TextDavinci003
-	gptModelContextLengthMax = 4097
-	gptContextInitial        = "The following is a conversation with an AI assistant. The assistant is helpful, creative, clever, and very friendly.\n" +
+	// telegramSendRetries is how many times the message is sent again when Telegram asks to slow down.
+	telegramSendRetries = 2
+	// telegramRetryAfterMax is the longest wait for Telegram to accept the message, longer waits give up on it.
+	telegramRetryAfterMax = time.Minute
+
+	defaultChatModel       = openai.GPT3Dot5Turbo
+	defaultCompletionModel = openai.GPT3TextDavinci003
+	gptSystemPrompt        = "The following is a conversation with an AI assistant. The assistant is helpful, creative, clever, and very friendly."
+	gptContextExample      = "\n" +
 		"\nHuman: Hello, who are you?" +
 		"\nAI: I am an AI created by OpenAI. How can I help you today?" +
 		"\nHuman: "
 	gptDefaultAIMessage = "How can I help you today?"
+	// promptRowsSeparator separates the texts of consecutive messages of the same role merged into one.
+	promptRowsSeparator = "\n\n"
 	gptPromptAI         = "\nAI: "
 	gptPromptHuman      = "\nHuman: "
+
+	promptTooLongMessage = "Your message is too long for me to process. Please shorten it, or use /reset to start a new conversation."
+	emptyMessageMessage  = "Please send me a text message."
+	inputTooLongMessage  = "Your message is too long, I accept messages of up to %d characters. Please shorten it."
+
+	// defaultMaxInputChars is high enough for any message typed by hand, longer ones are pasted documents.
+	defaultMaxInputChars = 100000
 )
 
+// fallbackParseModes maps parse mode to a simpler one to retry with when Telegram can't parse the message.
+var fallbackParseModes = map[string]string{
+	telegramParseModeMarkdownV2: tgbotapi.ModeMarkdown,
+	tgbotapi.ModeMarkdown:       "",
+	tgbotapi.ModeHTML:           "",
+}
+
 type dbMessage struct {
-	ID        int
-	UserID    int
+	ID     int
+	UserID int
+	// OwnerID is the user, or the group chat, whose conversation the message belongs to, for AI messages too.
+	OwnerID   int
+	Role      string
 	Username  string
 	Text      string
 	CreatedAt time.Time
+
+	// Token usage of the completion, only set for AI messages.
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	// FinishReason is why the model stopped generating the AI message, e.g. "length" if it is truncated.
+	FinishReason string
+}
+
+// isHuman reports whether the message is sent by human rather than generated by AI.
+func (m *dbMessage) isHuman() bool {
+	return m.Role == messageRoleUser
 }
 
 func main() {
-	apiKeyOpenAI := os.Getenv("API_KEY_OPENAPI")
-	apiKeyTelegram := os.Getenv("API_KEY_TELEGRAM")
-	userIDTelegram := os.Getenv("USER_ID_TELEGRAM")
-	applicationDataRootDirPath := os.Getenv("APPLICATION_DATA_ROOT_DIR_PATH")
-	databaseFilename := os.Getenv("DATABASE_FILENAME")
-	sqlMigrationsDirPathRelative := os.Getenv("SQL_MIGRATIONS_PATH_RELATIVE")
-	maxMessagesInHistoryStr := os.Getenv("MAX_MESSAGES_IN_HISTORY")
-	maxTokensToGenerateStr := os.Getenv("MAX_TOKENS_TO_GENERATE")
-	debugLogPromptsStr := os.Getenv("DEBUG_LOG_PROMPTS")
+	cfg, cfgErr := loadConfig()
+
+	// Configuration is checked before anything is initialized, so that its problems are reported first,
+	// with the default logger as the configured one may be invalid too
+	if cfgErr != nil {
+		fatal("invalid configuration", "error", cfgErr)
+	}
+	if err := setupLogging(os.Stderr, cfg.logLevel, cfg.logFormat); err != nil {
+		slog.Error("invalid logging configuration, logging at info level as text", "error", err)
+	}
 
 	ctxInit, ctxInitCancel := context.WithTimeout(context.Background(), initTimeout)
 	defer ctxInitCancel()
 
+	// Startup failures are configuration or environment problems, a stack trace would only obscure the cause
 	ensureNoError := func(err error, entiry string) {
 		if err != nil {
-			log.Panicf("failed to initialize %v: %v", entiry, err)
+			fatal("failed to initialize "+entiry, "error", err)
 		}
 	}
 
 	// ==== Initialize the application ====
 
 	log.Println("initializing")
+	log.Println("configuration:", strings.Join(cfg.summary, ", "))
 
 	cwd, err := os.Getwd()
 	ensureNoError(err, "current working directory")
 
 	// ---- Parameters ----
 
-	if applicationDataRootDirPath == "" {
-		applicationDataRootDirPath = defaultApplicationDataRootDirPath
+	if len(cfg.allowedUserIDs) == 0 {
+		slog.Warn("there are no allowed Telegram users, all messages are rejected")
 	}
 
-	if sqlMigrationsDirPathRelative == "" {
-		sqlMigrationsDirPathRelative = defaultSQLMigrationsDirPathRelative
+	cfg.applicationDataRootDirPath, err = prepareDataDir(cfg.applicationDataRootDirPath)
+	ensureNoError(err, "application data directory")
+
+	var limiter *rateLimiter
+	if cfg.rateLimitPerMinute > 0 {
+		limiter = newRateLimiter(cfg.rateLimitPerMinute, rateLimitWindow)
 	}
 
-	maxMessagesInHistory := defaultMaxMessagesInHistory
-	if maxMessagesInHistoryStr != "" {
-		maxMessagesInHistory, err = strconv.Atoi(maxMessagesInHistoryStr)
-		ensureNoError(err, "maximum number of messages in history")
+	var metrics *botMetrics
+	if cfg.metricsAddr != "" {
+		metrics = newBotMetrics()
 	}
 
-	maxTokensToGenerate := defaultMaxTokensToGenerate
-	if maxTokensToGenerateStr != "" {
-		maxTokensToGenerate, err = strconv.Atoi(maxTokensToGenerateStr)
-		ensureNoError(err, "maximum number of tokens to generate")
+	var cache *completionCache
+	if cfg.completionCacheSize > 0 {
+		cache, err = newCompletionCache(cfg.completionCacheSize, cfg.completionCacheNormalize)
+		ensureNoError(err, "completion cache")
 	}
 
-	debugLogPrompts := debugLogPromptsStr == "true"
+	responseProcessorChain, err := newResponseProcessorChain(cfg.responseProcessorNames, responseProcessorOptions{
+		disclaimer:     cfg.responseDisclaimer,
+		profanityWords: cfg.responseProfanityWords,
+	})
+	ensureNoError(err, "response processors")
 
-	// ---- Database ----
+	persona, err := loadPersona(cfg.systemPromptPersona, cfg.systemPromptPersonaFilePath)
+	ensureNoError(err, "system prompt persona")
+
+	ctxRun, ctxRunCancel := context.WithCancel(context.Background())
+	defer ctxRunCancel()
+
+	// ---- Health checks ----
 
-	if databaseFilename == "" {
-		databaseFilename = defaultDatabaseFilename
+	// Endpoints are served from the start, so that the application is reported as not ready while it initializes
+	health := &healthChecks{}
+	endpoints := make(httpEndpoints)
+	if cfg.healthAddr != "" {
+		endpoints.handle(cfg.healthAddr, healthCheckPath, http.HandlerFunc(health.handleHealthCheck))
+		endpoints.handle(cfg.healthAddr, readyCheckPath, http.HandlerFunc(health.handleReadyCheck))
 	}
-	databaseFilePath := applicationDataRootDirPath + ps + databaseFilename
-	sqlMigrationsDirPath := cwd + ps + sqlMigrationsDirPathRelative
+	if cfg.metricsAddr != "" {
+		endpoints.handle(cfg.metricsAddr, metricsPath, metrics.handler())
+	}
+	endpoints.serve(ctxRun, cfg.shutdownTimeout)
 
-	db, err := sql.Open(sqlDatabaseDriverName, databaseFilePath)
-	ensureNoError(err, "SQLite database")
-	defer db.Close()
+	// ---- Database ----
 
-	dbDriver, err := sqlite3.WithInstance(db, &sqlite3.Config{
-		DatabaseName: sqlDatabaseDriverName,
-	})
-	ensureNoError(err, "SQLite driver for database migration")
+	sqlMigrationsDirPath := cwd + ps + cfg.sqlMigrationsDirPathRelative
+
+	var (
+		db               *sql.DB
+		dbDriver         database.Driver
+		unlockMigrations = func() error { return nil }
+	)
+	switch cfg.databaseDriver {
+	case databaseDriverSQLite:
+		databaseFilePath := cfg.applicationDataRootDirPath + ps + cfg.databaseFilename
+		slog.Info("using SQLite database", "path", databaseFilePath)
+
+		db = sql.OpenDB(newIORetryConnector(databaseFilePath+sqliteConcurrencyParams, cfg.diskIOErrorRetries))
 
-	log.Println("run database migrations from", sqlMigrationsDirPath)
+		// Only one instance sharing the database file may run migrations at a time, others wait for it to finish.
+		// The lock is taken before the driver is opened, the driver creates the migrations table
+		unlockMigrations, err = lockFile(ctxInit, databaseFilePath+".migrate.lock")
+		ensureNoError(err, "SQLite database migration lock")
+
+		dbDriver, err = sqlite3.WithInstance(db, &sqlite3.Config{
+			DatabaseName: sqlDatabaseDriverName,
+		})
+		ensureNoError(err, "SQLite driver for database migration")
+	case databaseDriverPostgres:
+		connector, err := newPostgresConnector(cfg.databaseDSN)
+		ensureNoError(err, "PostgreSQL connection string")
+
+		db = sql.OpenDB(connector)
+
+		// PostgreSQL driver holds an advisory lock while migrations run
+		dbDriver, err = postgres.WithInstance(db, &postgres.Config{})
+		ensureNoError(err, "PostgreSQL driver for database migration")
+
+		sqlMigrationsDirPath = filepath.Join(sqlMigrationsDirPath, postgresMigrationsDirName)
+	}
+	defer db.Close()
+
+	slog.Info("running database migrations", "driver", cfg.databaseDriver, "path", sqlMigrationsDirPath)
 
 	dbMigrator, err := migrate.NewWithDatabaseInstance(
 		"file://"+sqlMigrationsDirPath,
-		sqlDatabaseDriverName,
+		cfg.databaseDriver,
 		dbDriver,
 	)
-	ensureNoError(err, "SQLite database migrator")
+	ensureNoError(err, "database migrator")
 
 	if err = dbMigrator.Up(); errors.Is(err, migrate.ErrNoChange) {
 		err = nil
 	}
-	ensureNoError(err, "SQLite database schema")
+	ensureNoError(err, "database schema")
+
+	err = unlockMigrations()
+	ensureNoError(err, "database migration unlock")
+
+	// ---- Blob store ----
+
+	if cfg.blobStoreLocation == "" {
+		cfg.blobStoreLocation = cfg.applicationDataRootDirPath + ps + defaultBlobStoreDirName
+	}
+
+	blobs, err := newBlobStore(cfg.blobStoreBackend, cfg.blobStoreLocation)
+	ensureNoError(err, "blob store")
 
 	// ---- OpenAI API ----
 
-	gptClient := gpt3.NewClient(apiKeyOpenAI)
+	if cfg.useCompletionAPI {
+		log.Printf("using model '%v' with completion API\n", cfg.openAIModel)
+	} else {
+		log.Printf("using model '%v' with chat completions API\n", cfg.openAIModel)
+	}
+	log.Println("using sampling parameters:", cfg.sampling)
+	log.Printf("using stop sequences with completion API: %q\n", cfg.stopSequences)
+	if cfg.choices > 1 {
+		log.Printf("replying with %d choices\n", cfg.choices)
+	}
+	if cfg.choices > choicesCostWarning {
+		slog.Warn("completion tokens of every choice are paid for, replies cost several times more", "choices", cfg.choices)
+	}
+
+	countTokens := newTokenCounter(cfg.openAIModel)
+
+	gptConfig := newOpenAIConfig(cfg.apiKeyOpenAI, cfg.openAIBaseURL, cfg.openAIOrgID)
+	// Proxy URL may have credentials in it
+	endpoint, _ := url.Parse(gptConfig.BaseURL)
+	slog.Info("using OpenAI API endpoint", "base_url", endpoint.Redacted(), "api_type", gptConfig.APIType, "org_id", cfg.openAIOrgID)
+	gptConfig.HTTPClient = retryAfterRecorder{client: &http.Client{}}
+	gptClient := openai.NewClientWithConfig(gptConfig)
 
 	// ---- Telegram API ----
 
-	bot, err := tgbotapi.NewBotAPI(apiKeyTelegram)
+	bot, err := tgbotapi.NewBotAPI(cfg.apiKeyTelegram)
 	ensureNoError(err, "Telegram bot API client")
 
-	// Set up an update listener to receive incoming messages
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = telegramBotUpdaterTimeoutSeconds
-	tgUpdates, err := bot.GetUpdatesChan(u)
-	ensureNoError(err, "Telegram bot updates channel")
+	// Hung long-polling request fails after the timeout and is retried, so that updates don't stop silently
+	bot.Client.Timeout = telegramBotUpdaterTimeoutSeconds*time.Second + telegramBotRequestTimeoutMargin
+
+	// Command menu is a convenience, the bot works without it
+	if err := registerBotCommands(bot); err != nil {
+		slog.Error("failed to register bot commands", "error", err)
+	}
 
 	// ==== Run the application ====
 
 	log.Println("started")
 
-	ctxRun, ctxRunCancel := context.WithCancel(context.Background())
-	defer ctxRunCancel()
-
 	// ---- Handle OS signals to shutdown gracefully ----
 
 	sigChan := make(chan os.Signal, 1)
@@ -168,30 +316,86 @@ func main() {
 		ctxRunCancel()
 	}()
 
-	go func(ctx context.Context) {
-		<-ctx.Done()
+	// ---- Process incoming messages ----
 
-		tgUpdates.Clear()
-		bot.StopReceivingUpdates()
-	}(ctxRun)
+	store := newSQLStore(db)
+	processor := &messageProcessor{
+		allowedUserIDs:          cfg.allowedUserIDs,
+		adminUserID:             cfg.adminUserID,
+		maxMessagesInHistory:    cfg.maxMessagesInHistory,
+		historyTTL:              cfg.historyTTL,
+		maxTokensToGenerate:     cfg.maxTokensToGenerate,
+		dailyMessageLimit:       cfg.dailyMessageLimit,
+		rateLimiter:             limiter,
+		metrics:                 metrics,
+		promptTemplate:          cfg.promptTemplate,
+		starDigestLocation:      cfg.starDigestLocation,
+		updatesSilenceTimeout:   cfg.updatesSilenceTimeout,
+		workerCount:             cfg.workerCount,
+		updatesBufferSize:       cfg.updatesBufferSize,
+		maxInputChars:           cfg.maxInputChars,
+		completionCache:         cache,
+		botDisplayName:          cfg.botDisplayName,
+		persona:                 persona,
+		systemPromptRules:       cfg.systemPromptRules,
+		systemPromptFormatting:  cfg.systemPromptFormatting,
+		maintenanceMessage:      cfg.maintenanceMessage,
+		greeting:                cfg.greeting,
+		welcomeMessage:          cfg.welcomeMessage,
+		documentQAThreshold:     cfg.documentQAThreshold,
+		adaptiveMaxTokens:       cfg.adaptiveMaxTokens,
+		adaptiveMaxTokensMin:    cfg.adaptiveMaxTokensMin,
+		adaptiveMaxTokensMax:    cfg.adaptiveMaxTokensMax,
+		responseProcessors:      responseProcessorChain,
+		db:                      db,
+		messages:                store,
+		settings:                store,
+		activity:                store,
+		blobs:                   blobs,
+		bot:                     bot,
+		updatesSource:           bot,
+		gptClient:               gptClient,
+		model:                   chatModel{name: cfg.openAIModel, completionAPI: cfg.useCompletionAPI},
+		sampling:                cfg.sampling,
+		stopSequencesCompletion: cfg.stopSequences,
+		choices:                 cfg.choices,
+		think:                   newThinkConfig(cfg.thinkModel, cfg.sampling, cfg.thinkTemperature, cfg.thinkMaxTokens),
+		writeRetries:            make(chan pendingWrite, writeRetryQueueSize),
+		replyRating:             cfg.replyRating,
+		openAITimeout:           cfg.openAITimeout,
+		openAIRetryMaxWait:      cfg.openAIRetryMaxWait,
+		moderation:              cfg.moderation,
+		summarization:           cfg.summarization,
+		moderationFailClosed:    cfg.moderationFailClosed,
+		tokenPricePer1K:         cfg.tokenPricePer1K,
+		imageSize:               cfg.imageSize,
+		voiceLanguage:           cfg.voiceLanguage,
+		countTokens:             countTokens,
+	}
+	processor.maintenance.Store(cfg.maintenance)
 
-	// ---- Process incoming messages ----
+	// Message being processed on shutdown is allowed to finish within the shutdown timeout,
+	// so its processing has a context that outlives ctxRun
+	ctxProcess, ctxProcessCancel := context.WithCancel(context.Background())
+	defer ctxProcessCancel()
 
 	done := make(chan struct{})
-	go processIncomingMessages(
-		ctxRun,
-		userIDTelegram,
-		maxMessagesInHistory,
-		maxTokensToGenerate,
-		db,
-		bot,
-		gptClient,
-		tgUpdates,
-		debugLogPrompts,
-		done,
-	)
+	go processor.processIncomingMessages(ctxRun, ctxProcess, done)
+	go processor.runStarDigest(ctxRun)
+	go processor.retryWrites(ctxProcess)
+
+	// Database is migrated and Telegram updates are received by now
+	health.setReady(processor)
 
-	_ = ctxInit
+	go func() {
+		<-ctxRun.Done()
+		select {
+		case <-done:
+		case <-time.After(cfg.shutdownTimeout):
+			slog.Warn("message is still being processed after the shutdown timeout, aborting it", "timeout", cfg.shutdownTimeout)
+			ctxProcessCancel()
+		}
+	}()
 
 	// ---- Wait for shutdown ----
 
@@ -200,178 +404,959 @@ func main() {
 	log.Println("terminated")
 }
 
-func processIncomingMessages(
+// messageProcessor holds dependencies and parameters needed to process incoming messages.
+type messageProcessor struct {
+	allowedUserIDs         map[int]struct{}
+	adminUserID            int
+	maxMessagesInHistory   int
+	historyTTL             time.Duration
+	now                    func() time.Time
+	maxTokensToGenerate    int
+	dailyMessageLimit      int
+	rateLimiter            *rateLimiter
+	metrics                *botMetrics
+	promptTemplate         *template.Template
+	starDigestLocation     *time.Location
+	updatesSilenceTimeout  time.Duration
+	workerCount            int
+	updatesBufferSize      int
+	maxInputChars          int
+	completionCache        *completionCache
+	botDisplayName         string
+	persona                string
+	systemPromptRules      string
+	systemPromptFormatting string
+	maintenanceMessage     string
+	greeting               string
+	welcomeMessage         string
+	documentQAThreshold    int
+	adaptiveMaxTokens      bool
+	adaptiveMaxTokensMin   int
+	adaptiveMaxTokensMax   int
+	responseProcessors     responseProcessorChain
+	moderation             bool
+	moderationFailClosed   bool
+	summarization          bool
+
+	db                      *sql.DB
+	messages                messageStore
+	settings                settingsStore
+	activity                activityStore
+	blobs                   blobStore
+	bot                     *tgbotapi.BotAPI
+	updatesSource           updatesSource
+	gptClient               *openai.Client
+	model                   chatModel
+	sampling                samplingParams
+	stopSequencesCompletion []string
+	choices                 int
+	think                   thinkConfig
+	writeRetries            chan pendingWrite
+	replyRating             bool
+	openAITimeout           time.Duration
+	openAIRetryMaxWait      time.Duration
+	tokenPricePer1K         float64
+	imageSize               string
+	voiceLanguage           string
+	countTokens             tokenCounter
+
+	// updatesHealthy is cleared when Telegram updates stop arriving and Telegram API doesn't respond.
+	updatesHealthy atomic.Bool
+	// lastUpdateID is the ID of the last received update, used to resume receiving updates.
+	lastUpdateID int
+
+	// editableMessages are the last messages of users by user ID, see removeEditedExchange.
+	editableMessages   map[int]editableMessage
+	editableMessagesMu sync.Mutex
+
+	// activeCompletions cancel the replies being generated by conversation owner ID, see handleCancelCommand.
+	activeCompletions   map[int]context.CancelFunc
+	activeCompletionsMu sync.Mutex
+
+	// maintenance is set when the bot only answers with the maintenance notice, see isAllowedInMaintenance.
+	maintenance atomic.Bool
+
+	// outOfCreditsAlertSent is set when administrator is already notified that OpenAI account is out of credits.
+	outOfCreditsAlertSent atomic.Bool
+}
+
+// processIncomingMessages receives updates until ctxRun is cancelled, messages are processed by the workers with ctx,
+// so that the messages being processed when ctxRun is cancelled are answered before returning.
+func (p *messageProcessor) processIncomingMessages(
+	ctxRun context.Context,
 	ctx context.Context,
-	userIDTelegram string,
-	maxMessagesInHistory int,
-	maxTokensToGenerate int,
-	db *sql.DB,
-	bot *tgbotapi.BotAPI,
-	gptClient *gpt3.Client,
-	tgUpdates tgbotapi.UpdatesChannel,
-	debugLogPrompts bool,
 	done chan<- struct{},
 ) {
 	defer func() { close(done) }()
 
+	workers := p.startWorkers(ctxRun, ctx, p.workerCount)
+	defer workers.stop()
+
+	poller := p.pollUpdates(ctxRun, 0)
+	defer func() { poller.stop() }()
+	// reconnecting is set when the poller is stopped, the updates it has received are processed before reconnecting
+	reconnecting := false
+
+	// Bot is unhealthy once it stops receiving updates
+	defer p.updatesHealthy.Store(false)
+	p.updatesHealthy.Store(true)
+	silenceTimer := newSilenceTimer(p.updatesSilenceTimeout)
+	defer silenceTimer.Stop()
+
 UPDATES:
-	for {
-		var update tgbotapi.Update
+	for ctxRun.Err() == nil {
+		var (
+			update tgbotapi.Update
+			ok     bool
+		)
 		select {
-		case update = <-tgUpdates:
-		case <-ctx.Done():
+		case update, ok = <-poller.updates:
+		case <-silenceTimer.C:
+			if !p.checkUpdatesHealth() && !reconnecting {
+				log.Println("restarting Telegram updates polling")
+				poller.stop()
+				reconnecting = true
+			}
+			silenceTimer.Reset(p.updatesSilenceTimeout)
+			continue
+		case <-ctxRun.Done():
 			break UPDATES
 		}
 
-		if update.Message == nil {
-			continue
-		}
-		if strconv.FormatInt(int64(update.Message.From.ID), 10) != userIDTelegram {
-			log.Println("rejecting message from unknown user", update.Message.From.ID)
+		if !ok {
+			log.Println("Telegram updates polling is stopped, reconnecting")
+			poller = p.pollUpdates(ctxRun, p.lastUpdateID+1)
+			reconnecting = false
 			continue
 		}
+		p.lastUpdateID = update.UpdateID
+		p.updatesHealthy.Store(true)
+		resetSilenceTimer(silenceTimer, p.updatesSilenceTimeout)
 
-		if err := deleteOldMessages(ctx, db, maxMessagesInHistory); err != nil {
-			log.Println("failed to delete old messages from the database:", err)
+		// Edited message goes through the same checks as a new one, see removeEditedExchange
+		if update.Message == nil && update.EditedMessage != nil {
+			update.Message = update.EditedMessage
 		}
 
-		log.Printf("recieved new message with %d bytes\n", len(update.Message.Text))
+		// Button presses are answered right away, the same as /cancel they don't wait for the worker
+		if update.CallbackQuery != nil {
+			if update.CallbackQuery.From != nil && p.isAllowedUser(update.CallbackQuery.From.ID) {
+				p.handleCallbackQuery(ctx, update.CallbackQuery)
+			}
+			continue
+		}
 
-		history, err := getAllMesssages(ctx, db)
-		if err != nil {
-			log.Println("failed to get conversation history from the database:", err)
-			sendErrorMessage(bot, update, err)
+		if update.Message == nil || update.Message.From == nil {
+			continue
+		}
+		// Bot's own posts come back as updates in channels where it is an administrator, answering them would loop
+		if update.Message.From.ID == p.bot.Self.ID {
+			continue
+		}
+		if !p.isAllowedUser(update.Message.From.ID) {
+			slog.Warn("rejected message from unknown user", "user_id", update.Message.From.ID)
+			continue
+		}
+		// In group the bot takes part in the conversation only when it is addressed
+		if isGroupChat(update.Message.Chat) && !p.isAddressedToBot(update.Message) {
 			continue
 		}
+		slog.Info("accepted message", "user_id", update.Message.From.ID, "chat_id", update.Message.Chat.ID)
+		p.metrics.messageReceived()
 
-		if err := saveMessage(ctx, db, &dbMessage{
-			UserID:    update.Message.From.ID,
-			Username:  update.Message.From.UserName,
-			Text:      update.Message.Text,
-			CreatedAt: time.Now(),
-		}); err != nil {
-			log.Printf("failed to save incoming message to the database: %v\n", err)
-			sendErrorMessage(bot, update, err)
+		// Worker of the conversation is busy with the reply to be cancelled, so the command can't wait for it
+		if isCancelCommand(update.Message) {
+			p.handleCancelCommand(update)
 			continue
 		}
+		workers.dispatch(ctxRun, update)
+	}
+}
+
+// processMessage processes the accepted message, the edited one too.
+func (p *messageProcessor) processMessage(ctx context.Context, update tgbotapi.Update) {
+	edited := update.EditedMessage != nil
+
+	if p.maintenance.Load() && !p.isAllowedInMaintenance(update.Message) {
+		sendTextMessage(p.bot, update.Message.Chat.ID, "", p.maintenanceMessage)
+		return
+	}
+
+	parseMode, err := getChatParseMode(ctx, p.settings, update.Message.Chat.ID)
+	if err != nil {
+		slog.Error("failed to get chat parse mode from the database", "error", err)
+	}
+
+	// Command is not run again when it is edited
+	if edited && update.Message.IsCommand() {
+		return
+	}
+	if p.handleCommand(ctx, update, parseMode) {
+		return
+	}
 
-		prompt := buildPromptFromHistory(maxTokensToGenerate, history, update.Message.Text)
+	if edited {
+		if err := p.removeEditedExchange(ctx, update.Message); err != nil {
+			slog.Error("failed to replace edited message", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+	}
+	p.forgetEditableMessage(conversationOwnerID(update.Message))
 
-		if debugLogPrompts {
-			log.Println("==== PROMPT:", prompt)
+	if err := p.messages.DeleteOld(ctx, conversationOwnerID(update.Message), p.maxMessagesInHistory); err != nil {
+		slog.Error("failed to delete old messages from the database", "error", err)
+	}
+	if p.historyTTL > 0 {
+		if err := p.messages.DeleteExpired(ctx, conversationOwnerID(update.Message), p.currentTime().Add(-p.historyTTL)); err != nil {
+			slog.Error("failed to delete expired messages from the database", "error", err)
 		}
+	}
 
-		req := gpt3.CompletionRequest{
-			Model:            gptModel,
-			Prompt:           prompt,
-			Temperature:      0.9,
-			MaxTokens:        maxTokensToGenerate,
-			TopP:             1,
-			FrequencyPenalty: 0,
-			PresencePenalty:  0.6,
-			Stop:             []string{" Human:", " AI:"},
+	if update.Message.Voice != nil {
+		text, err := p.transcribeVoice(ctx, update.Message.Voice)
+		if errors.Is(err, errVoiceTooLarge) {
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, voiceTooLargeMessage)
+			return
+		}
+		if isOpenAITimeoutError(ctx, err) {
+			slog.Warn("voice message transcription timed out", "error", err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, openAITimeoutMessage)
+			return
 		}
-		resp, err := gptClient.CreateCompletion(ctx, req)
 		if err != nil {
-			log.Println("failed to get response from GPT model:", err)
-			sendErrorMessage(bot, update, err)
-			continue
+			slog.Error("failed to transcribe voice message", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		log.Printf("transcribed voice message of %d seconds\n", update.Message.Voice.Duration)
+		update.Message.Text = text
+	}
+
+	if isGroupChat(update.Message.Chat) {
+		update.Message.Text = p.withoutBotMention(update.Message.Text)
+	}
+	// /think is answered as the regular message, only with the thinking configuration, see thinkConfig
+	if question, ok := thinkQuestion(update.Message.Text); ok {
+		update.Message.Text = question
+		ctx = withThinking(ctx, p.think)
+	}
+	// Code request is answered in code mode, the /code command itself is neither in the prompt nor in the history
+	if question, ok := codeQuestion(update.Message.Text); ok {
+		update.Message.Text = question
+		ctx = withCodeMode(ctx)
+	}
+
+	slog.Info("received message", "user_id", update.Message.From.ID, "bytes", len(update.Message.Text))
+
+	if strings.TrimSpace(update.Message.Text) == "" {
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, emptyMessageMessage)
+		return
+	}
+	// Message is rejected before it is saved, so that it doesn't take up the history
+	if p.maxInputChars > 0 && utf8.RuneCountInString(update.Message.Text) > p.maxInputChars {
+		slog.Warn("message is longer than the limit of characters", "user_id", update.Message.From.ID, "limit", p.maxInputChars)
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, fmt.Sprintf(inputTooLongMessage, p.maxInputChars))
+		return
+	}
+
+	if !p.rateLimiter.allow(update.Message.From.ID, time.Now()) {
+		slog.Warn("rate limit is exceeded", "user_id", update.Message.From.ID)
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, rateLimitedMessage)
+		return
+	}
+
+	// Flagged message is neither answered nor saved
+	if refusal := p.moderationRefusal(ctx, update.Message.Text, flaggedMessageMessage); refusal != "" {
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, refusal)
+		return
+	}
+
+	if p.dailyMessageLimit > 0 {
+		remaining, err := p.remainingDailyMessages(ctx, update.Message.From.ID)
+		if err != nil {
+			slog.Error("failed to get daily message count from the database", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		if remaining <= 0 {
+			slog.Warn("daily message limit is reached", "user_id", update.Message.From.ID)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, dailyLimitReachedMessage(p.dailyMessageLimit))
+			return
+		}
+		if err := p.activity.IncrementDailyMessageCount(ctx, update.Message.From.ID, time.Now()); err != nil {
+			slog.Error("failed to update daily message count in the database", "error", err)
+		}
+	}
+
+	focus, err := p.settings.ChatSetting(ctx, update.Message.Chat.ID, chatSettingFocus)
+	if err != nil {
+		slog.Error("failed to get chat focus from the database", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	tags := appendTag(parseTags(update.Message.Text), focus)
+
+	if p.documentQAThreshold > 0 && p.countTokens(update.Message.Text) > p.documentQAThreshold {
+		p.answerAboutDocument(ctx, update, parseMode, tags)
+		return
+	}
+
+	// Greeting is sent before the conversation is seeded, while it is still empty
+	ownerID := conversationOwnerID(update.Message)
+	greeted := p.greetOnFirstContact(ctx, update.Message.Chat.ID, ownerID, parseMode)
+	p.seedConversation(ctx, update.Message.Chat.ID, ownerID, tags, !greeted)
+
+	// Human message is created after the seed, so that the opening AI message comes first in the history
+	humanMsg := &dbMessage{
+		UserID:    update.Message.From.ID,
+		OwnerID:   ownerID,
+		Role:      messageRoleUser,
+		Username:  update.Message.From.UserName,
+		Text:      update.Message.Text,
+		CreatedAt: time.Now(),
+	}
+
+	// Continue request is saved as it is sent, only the prompt asks the model to continue the truncated reply
+	promptMsg := humanMsg
+	if isContinueRequest(humanMsg.Text) {
+		truncated, err := p.messages.LastReplyTruncated(ctx, humanMsg.OwnerID)
+		if err != nil {
+			slog.Error("failed to check whether the last reply is truncated", "error", err)
+		}
+		if truncated {
+			continued := *humanMsg
+			continued.Text = continuePrompt
+			promptMsg = &continued
+		}
+	}
+
+	prompt, err := p.buildPrompt(ctx, update.Message.Chat.ID, focus, promptMsg)
+	if errors.Is(err, errPromptTooLong) {
+		slog.Warn("prompt doesn't fit into the model context")
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, promptTooLongMessage)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to build prompt", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	p.reply(ctx, update, parseMode, humanMsg, prompt, tags)
+}
+
+// reply requests completion of the prompt, saves it with the human message and sends it to the chat.
+// Human message that isn't saved yet is saved unanswered if there is no reply, see saveExchange.
+func (p *messageProcessor) reply(ctx context.Context, update tgbotapi.Update, parseMode string, humanMsg *dbMessage, prompt modelPrompt, tags []string) {
+	slog.Debug("prompt", "chat_id", update.Message.Chat.ID, "prompt", prompt)
+
+	answered := false
+	defer func() {
+		if !answered {
+			p.saveUnansweredMessage(ctx, update, humanMsg, tags)
+		}
+	}()
+
+	completionCtx, done := p.startCancellableCompletion(ctx, conversationOwnerID(update.Message))
+	defer done()
+	cancelCtx := completionCtx
+	timeout, err := getChatResponseTimeout(ctx, p.settings, update.Message.Chat.ID)
+	if err != nil {
+		slog.Error("failed to get chat response timeout", "error", err)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		completionCtx, cancel = context.WithTimeout(completionCtx, timeout)
+		defer cancel()
+	}
+
+	maxTokens, adaptive := p.chatMaxTokensToGenerate(ctx, update.Message.Chat.ID, update.Message.From.ID, prompt)
+
+	stopTyping := p.startTyping(ctx, update.Message.Chat.ID)
+	resp, err := p.completeWithChoices(completionCtx, prompt, maxTokens, p.choices)
+	// Token count is an estimate, so the prompt that should fit may still be too long for the model
+	if isContextLengthExceededError(err) {
+		if shorter, ok := p.shrinkPrompt(prompt); ok {
+			slog.Warn("prompt exceeds the model context, retrying with shorter history", "error", err)
+			resp, err = p.completeWithChoices(completionCtx, shorter, maxTokens, p.choices)
+		}
+	}
+	stopTyping()
+	// Completion that is done by the time it is cancelled is dropped too, nothing is saved to the history
+	if p.isReplyCancelled(ctx, cancelCtx, update, parseMode) {
+		return
+	}
+	if err != nil {
+		// Human message is left unanswered, so that the reply can be requested again with /retry
+		if errors.Is(completionCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			slog.Warn("response from GPT model timed out", "timeout", timeout, "error", err)
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, responseTimeoutMessage)
+			return
 		}
-		respText := resp.Choices[0].Text
+		if isOpenAITimeoutError(ctx, err) {
+			slog.Warn("request to OpenAI timed out", "error", err)
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, openAITimeoutMessage)
+			return
+		}
+		if isContextLengthExceededError(err) {
+			slog.Warn("prompt exceeds the model context", "error", err)
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, promptTooLongMessage)
+			return
+		}
+		if isInsufficientQuotaError(err) {
+			slog.Error("OpenAI account is out of credits", "error", err)
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, outOfCreditsMessage)
+			p.alertAdminOutOfCredits()
+			return
+		}
+		if errors.Is(err, errNoCompletionChoices) {
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, noCompletionMessage)
+			return
+		}
+		if isTransientOpenAIError(err) {
+			slog.Error("OpenAI is unavailable", "error", err)
+			p.saveLastError(ctx, update.Message.Chat.ID, err)
+			sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, openAIBusyMessage)
+			return
+		}
+		slog.Error("failed to get response from GPT model", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	p.outOfCreditsAlertSent.Store(false)
+	if adaptive {
+		p.adaptMaxTokensToGenerate(ctx, update.Message.Chat.ID, resp, maxTokens)
+	}
+	respText := resp.Text
+
+	// Human message is left unanswered, the same as when the reply fails
+	if refusal := p.moderationRefusal(ctx, respText, flaggedReplyMessage); refusal != "" {
+		sendTextMessage(p.bot, update.Message.Chat.ID, parseMode, refusal)
+		return
+	}
+	if p.isReplyCancelled(ctx, cancelCtx, update, parseMode) {
+		return
+	}
 
-		if err := saveMessage(ctx, db, &dbMessage{
-			UserID:    0,
-			Username:  "",
-			Text:      respText,
-			CreatedAt: time.Now(),
-		}); err != nil {
-			log.Printf("failed to save outgoing message to the database: %v\n", err)
-			sendErrorMessage(bot, update, err)
+	aiMsg := &dbMessage{
+		UserID:    0,
+		OwnerID:   conversationOwnerID(update.Message),
+		Role:      messageRoleAssistant,
+		Username:  "",
+		Text:      respText,
+		CreatedAt: time.Now(),
+
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.Tokens,
+		TotalTokens:      resp.TotalTokens,
+		FinishReason:     resp.FinishReason,
+	}
+	answered = true
+	// Tag the reply the same way as the message it answers, so scoped history keeps whole exchanges
+	saved := p.saveExchange(ctx, update, humanMsg, aiMsg, tags)
+
+	// Reply is saved to the history as generated, so that e.g. disclaimers don't take up the prompt
+	for i, text := range p.replyChoices(ctx, respText, resp.Alternatives) {
+		// Only the first choice is saved to the history, so only it can be rated once it is saved
+		var markup interface{}
+		if i == 0 && p.replyRating && saved {
+			markup = ratingKeyboard(aiMsg.ID)
+		}
+		text = p.responseProcessors.process(text)
+		if _, ok := thinking(ctx); ok && i == 0 {
+			text = withThinkFooter(text, prompt.model)
+		}
+		// Formatted code reply is sent as HTML, so the note is added as plain text
+		if codeMode(ctx) && parseMode != "" {
+			if isTruncated(resp) && i == 0 {
+				text = withTruncatedNote(text, "")
+			}
+			sendCodeReply(ctx, p.bot, update.Message.Chat.ID, text, markup)
 			continue
 		}
+		if isTruncated(resp) && i == 0 {
+			text = withTruncatedNote(text, parseMode)
+		}
+		sendLongTextMessageWithMarkup(ctx, p.bot, update.Message.Chat.ID, parseMode, text, markup)
+	}
+	p.clearLastError(ctx, update.Message.Chat.ID)
+}
 
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, respText)
-		msg.ParseMode = tgbotapi.ModeMarkdown
-		sendMessage(bot, msg)
+// currentTime returns the current time messages expire by, tests replace time.Now with now.
+func (p *messageProcessor) currentTime() time.Time {
+	if p.now != nil {
+		return p.now()
 	}
+	return time.Now()
 }
 
-func buildPromptFromHistory(maxTokensToGenerate int, history []*dbMessage, humanMessage string) string {
-	initial := gptContextInitial
+// buildPrompt builds the prompt for the new human message from the conversation history scoped to the focus tag.
+// If sender names are enabled in the chat, human messages are prefixed with the sender's username.
+func (p *messageProcessor) buildPrompt(ctx context.Context, chatID int64, focus string, humanMsg *dbMessage) (modelPrompt, error) {
+	history, err := p.messages.History(ctx, humanMsg.OwnerID, focus)
+	if err != nil {
+		return modelPrompt{}, fmt.Errorf("failed to get conversation history from the database: %w", err)
+	}
+	return p.buildPromptWithHistory(ctx, chatID, focus, history, humanMsg)
+}
 
-	buf := new(strings.Builder)
-	buf.WriteString(initial)
+// buildPromptWithHistory builds the prompt for the new human message from the given conversation history.
+// If summarization is enabled, messages that don't fit into the model context are replaced with their summary.
+func (p *messageProcessor) buildPromptWithHistory(ctx context.Context, chatID int64, focus string, history []*dbMessage, humanMsg *dbMessage) (modelPrompt, error) {
+	model, err := p.userModel(ctx, humanMsg.UserID)
+	if err != nil {
+		return modelPrompt{}, err
+	}
+	think, isThinking := thinking(ctx)
+	if isThinking {
+		model = think.model
+	}
+
+	system, err := p.systemPrompt(ctx, chatID, humanMsg.UserID)
+	if err != nil {
+		return modelPrompt{}, err
+	}
+
+	includeNames, err := getChatIncludeNames(ctx, p.settings, chatID)
+	if err != nil {
+		return modelPrompt{}, err
+	}
+
+	if codeMode(ctx) {
+		system = withCodeInstruction(system)
+	}
+
+	humanMessage := humanMsg.Text
+	if includeNames {
+		history = withSenderNames(history)
+		humanMessage = withSenderName(humanMsg)
+	}
+
+	// Prompt leaves room for the limit the user has set, adaptive limit only grows into the room left unused
+	maxTokens, err := p.userMaxTokensToGenerate(ctx, humanMsg.UserID)
+	if err != nil {
+		return modelPrompt{}, err
+	}
+	var sampling *samplingParams
+	if isThinking {
+		maxTokens, sampling = think.maxTokens, &think.sampling
+	}
+
+	countTokens := p.tokenCounterFor(model.name)
+	build := func(system string, history []*dbMessage) (modelPrompt, int, error) {
+		if model.completionAPI {
+			prompt, trimmedThroughID, err := buildPromptFromHistory(countTokens, modelContextLength(model.name), maxTokens, p.promptTemplate, system, history, humanMessage)
+			prompt.model, prompt.ownerID, prompt.sampling = model.name, humanMsg.OwnerID, sampling
+			return prompt, trimmedThroughID, err
+		}
+		messages, trimmedThroughID, err := buildChatMessagesFromHistory(countTokens, modelContextLength(model.name), maxTokens, system, history, humanMessage)
+		return modelPrompt{model: model.name, ownerID: humanMsg.OwnerID, messages: messages, sampling: sampling}, trimmedThroughID, err
+	}
+
+	if p.summarization {
+		return p.buildPromptWithSummary(ctx, humanMsg.OwnerID, focus, system, history, build)
+	}
+	prompt, _, err := build(system, history)
+	return prompt, err
+}
+
+// errPromptTooLong is returned when the prompt doesn't fit into the model context even without history.
+var errPromptTooLong = errors.New("prompt is too long")
+
+// promptRow is a single message of the conversation in the prompt.
+type promptRow struct {
+	// id is the ID of the message in the database, zero for the new human message and the default AI message.
+	id    int
+	human bool
+	text  string
+}
+
+// promptTemplateData is passed to the custom prompt template set via PROMPT_TEMPLATE.
+type promptTemplateData struct {
+	// System is the description of the assistant.
+	System string
+	// History is the previous conversation, each message is prefixed with "\nHuman: " or "\nAI: ".
+	History string
+	// Input is the new message from the human.
+	Input string
+}
+
+// promptExchange is a human message followed by the AI reply to it.
+// The exchange with the new human message has no reply yet.
+type promptExchange []promptRow
+
+func buildPromptFromHistory(
+	countTokens tokenCounter,
+	contextLength int,
+	maxTokensToGenerate int,
+	promptTemplate *template.Template,
+	system string,
+	history []*dbMessage,
+	humanMessage string,
+) (modelPrompt, int, error) {
+	exchanges := groupExchanges(history, humanMessage)
+	rows := flattenExchanges(exchanges)
+
+	var (
+		prompt  string
+		trimmed int
+	)
+	err := trimExchanges(exchanges, func(deleted int) (bool, error) {
+		var err error
+		prompt, err = renderPrompt(promptTemplate, system, rows[countRows(exchanges[:deleted]):])
+		trimmed = deleted
+		return err == nil && !exceedsLimit(countTokens, prompt, contextLength, maxTokensToGenerate), err
+	})
+	if err != nil {
+		return modelPrompt{}, 0, err
+	}
+	return modelPrompt{text: prompt, system: system, rows: rows[countRows(exchanges[:trimmed]):]}, lastMessageID(exchanges[:trimmed]), nil
+}
 
-	rows := make([]string, 0, len(history))
-	wantHumanMessage := true
+// groupExchanges groups the conversation history followed by the new human message into exchanges.
+// The opening AI message the conversation is seeded with is the exchange of its own, see seedConversation.
+// Messages that break "Human -> AI -> ..." order are merged rather than dropped, so that no content is lost:
+// human messages left without reply, e.g. after a failed turn, are merged with the next human message,
+// consecutive AI messages with each other.
+func groupExchanges(history []*dbMessage, humanMessage string) []promptExchange {
+	exchanges := make([]promptExchange, 0, len(history)/2+2)
 	for _, msg := range history {
-		if (wantHumanMessage && msg.UserID == 0) || (!wantHumanMessage && msg.UserID != 0) {
-			// Skip messages that are out of "Human -> AI -> Human -> AI -> ..." order
+		last := len(exchanges) - 1
+		unanswered := last >= 0 && len(exchanges[last]) == 1 && exchanges[last][0].human
+		if msg.isHuman() {
+			if unanswered {
+				exchanges[last][0] = mergeRows(exchanges[last][0], msg.ID, msg.Text)
+				continue
+			}
+			exchanges = append(exchanges, promptExchange{{id: msg.ID, human: true, text: msg.Text}})
 			continue
 		}
+		switch {
+		case last < 0:
+			exchanges = append(exchanges, promptExchange{{id: msg.ID, human: false, text: msg.Text}})
+		case unanswered:
+			exchanges[last] = append(exchanges[last], promptRow{id: msg.ID, human: false, text: msg.Text})
+		default:
+			exchange := exchanges[last]
+			exchange[len(exchange)-1] = mergeRows(exchange[len(exchange)-1], msg.ID, msg.Text)
+		}
+	}
+	if last := len(exchanges) - 1; last >= 0 && len(exchanges[last]) == 1 && exchanges[last][0].human {
+		// Unanswered human message is sent together with the new one
+		unanswered := exchanges[last][0]
+		return append(exchanges[:last], promptExchange{{human: true, text: unanswered.text + promptRowsSeparator + humanMessage}})
+	}
+	return append(exchanges, promptExchange{{human: true, text: humanMessage}})
+}
+
+// mergeRows appends the text of the next message of the same role to the row.
+func mergeRows(row promptRow, id int, text string) promptRow {
+	return promptRow{id: max(row.id, id), human: row.human, text: row.text + promptRowsSeparator + text}
+}
+
+// trimExchanges deletes older exchanges if the prompt built without them doesn't fit into the model context.
+// The build function builds the prompt without the given number of the oldest exchanges and reports whether it fits,
+// trimExchanges returns after the call for the resulting prompt, or errPromptTooLong if even the last exchange alone doesn't fit.
+// The prompt only gets shorter as exchanges are deleted, so the fewest to delete are found with binary search.
+func trimExchanges(exchanges []promptExchange, build func(deleted int) (bool, error)) error {
+	fits, err := build(0)
+	if err != nil || fits {
+		return err
+	}
+
+	if len(exchanges) > 1 {
+		low, high := 1, len(exchanges)-1
+		for low < high {
+			middle := (low + high) / 2
+			fits, err := build(middle)
+			if err != nil {
+				return err
+			}
+			if fits {
+				high = middle
+			} else {
+				low = middle + 1
+			}
+		}
+		if fits, err = build(low); err != nil || fits {
+			return err
+		}
+	}
+
+	// Even the new message alone doesn't fit, the model would get truncated or rejected request
+	return errPromptTooLong
+}
+
+// lastMessageID returns the largest ID of the messages in the exchanges, zero if there are none.
+func lastMessageID(exchanges []promptExchange) int {
+	id := 0
+	for _, exchange := range exchanges {
+		for _, row := range exchange {
+			id = max(id, row.id)
+		}
+	}
+	return id
+}
+
+func countRows(exchanges []promptExchange) int {
+	rows := 0
+	for _, exchange := range exchanges {
+		rows += len(exchange)
+	}
+	return rows
+}
+
+func flattenExchanges(exchanges []promptExchange) []promptRow {
+	rows := make([]promptRow, 0, 2*len(exchanges))
+	for _, exchange := range exchanges {
+		rows = append(rows, exchange...)
+	}
+	return rows
+}
+
+// renderPrompt builds the prompt from the conversation rows, the last row is the new message from the human.
+// If promptTemplate is nil, the default "Human: ... AI: ..." format is used.
+func renderPrompt(promptTemplate *template.Template, system string, rows []promptRow) (string, error) {
+	buf := new(strings.Builder)
+
+	if promptTemplate == nil {
+		size := len(system) + len(gptContextExample)
+		for _, row := range rows {
+			size += len(row.text) + len(gptPromptHuman)
+		}
+		buf.Grow(size)
 
-		row := msg.Text
-		if wantHumanMessage {
-			row += gptPromptAI
+		buf.WriteString(system)
+		if len(rows) > 0 && !rows[0].human {
+			// Opening AI message starts the conversation in place of the example exchange
+			buf.WriteString("\n")
+			buf.WriteString(gptPromptAI)
 		} else {
-			row += gptPromptHuman
+			buf.WriteString(gptContextExample)
 		}
-		rows = append(rows, row)
+		for _, row := range rows {
+			buf.WriteString(row.text)
+			if row.human {
+				buf.WriteString(gptPromptAI)
+			} else {
+				buf.WriteString(gptPromptHuman)
+			}
+		}
+		return buf.String(), nil
+	}
 
-		wantHumanMessage = !wantHumanMessage
+	history := new(strings.Builder)
+	for _, row := range rows[:len(rows)-1] {
+		if row.human {
+			history.WriteString(gptPromptHuman)
+		} else {
+			history.WriteString(gptPromptAI)
+		}
+		history.WriteString(row.text)
 	}
-	if !wantHumanMessage {
-		// If last message in the prompt is Human message, add default AI message to the end
-		rows = append(rows, gptDefaultAIMessage+gptPromptHuman)
+
+	if err := promptTemplate.Execute(buf, promptTemplateData{
+		System:  system,
+		History: history.String(),
+		Input:   rows[len(rows)-1].text,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render prompt template: %w", err)
 	}
-	rows = append(rows, humanMessage+gptPromptAI)
+	return buf.String(), nil
+}
+
+// parsePromptTemplate parses the custom prompt template and checks that it can be rendered.
+func parsePromptTemplate(text string) (*template.Template, error) {
+	promptTemplate, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderPrompt(promptTemplate, gptSystemPrompt, []promptRow{{human: true, text: gptDefaultAIMessage}}); err != nil {
+		return nil, err
+	}
+	return promptTemplate, nil
+}
+
+// completionPrefixes are speaker labels the completion model sometimes echoes at the start of the reply.
+var completionPrefixes = []string{"AI:", "Assistant:"}
+
+// stripCompletionPrefix removes leading speaker label and surrounding whitespace from the completion text.
+// Only the completion API is prompted with speaker labels, chat replies are kept as they are.
+func stripCompletionPrefix(text string) string {
+	text = strings.TrimSpace(text)
+	for _, prefix := range completionPrefixes {
+		if len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			return strings.TrimSpace(text[len(prefix):])
+		}
+	}
+	return text
+}
+
+func exceedsLimit(countTokens tokenCounter, prompt string, contextLength, maxTokensToGenerate int) bool {
+	return countTokens(prompt)+maxTokensToGenerate > contextLength
+}
 
-	// Delete older rows if total prompt length plus completion length exceed model limit
-	for exceedsLimit(initial, rows, maxTokensToGenerate) && len(rows) >= 2 {
-		// Remove two oldest rows (rows are ordered to be "Human -> AI -> ..." here)
-		rows = rows[2:]
+func sendErrorMessage(bot messageSender, update tgbotapi.Update, parseMode string, err error) {
+	text := fmt.Sprintf("Failed to process your request. ERROR: %v", err)
+	if parseMode == tgbotapi.ModeMarkdown {
+		text = "`" + text + "`"
 	}
+	sendTextMessage(bot, update.Message.Chat.ID, parseMode, text)
+}
+
+func sendTextMessage(bot messageSender, chatID int64, parseMode string, text string) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = parseMode
+	sendMessage(context.Background(), bot, msg)
+}
+
+// sendLongTextMessage sends the text as several messages if it exceeds Telegram message length limit.
+// Code blocks are split so that each message keeps them fenced.
+func sendLongTextMessage(ctx context.Context, bot messageSender, chatID int64, parseMode string, text string) {
+	sendLongTextMessageWithMarkup(ctx, bot, chatID, parseMode, text, nil)
+}
 
-	for _, row := range rows {
-		buf.WriteString(row)
+// sendLongTextMessageWithMarkup is the same as sendLongTextMessage, the reply markup is attached to the last message.
+func sendLongTextMessageWithMarkup(ctx context.Context, bot messageSender, chatID int64, parseMode string, text string, markup interface{}) {
+	chunks := splitFencedText(text, telegramMessageLengthMax)
+	for i, chunk := range chunks {
+		msg := tgbotapi.NewMessage(chatID, chunk)
+		msg.ParseMode = parseMode
+		if i == len(chunks)-1 {
+			msg.ReplyMarkup = markup
+		}
+		sendMessage(ctx, bot, msg)
 	}
-	return buf.String()
 }
 
-func exceedsLimit(initial string, rows []string, maxTokensToGenerate int) bool {
-	if len(rows) == 0 {
-		return false
+// splitText splits the text into chunks of at most maxLength characters.
+// Chunks end at sentence boundaries or, failing that, between words where possible,
+// a word is only split when there is no whitespace in the second half of the chunk.
+func splitText(text string, maxLength int) []string {
+	runes := []rune(text)
+	chunks := make([]string, 0, len(runes)/maxLength+1)
+	for len(runes) > maxLength {
+		end := textBreak(runes[:maxLength+1])
+		chunks = append(chunks, string(runes[:end]))
+		runes = runes[end:]
 	}
+	return append(chunks, string(runes))
+}
 
-	total := len(initial)
-	for _, row := range rows {
-		total += len(row)
+// textBreak returns where the text should be split so that the first part is shorter than the text,
+// whitespace at the break is kept at the end of the first part when it fits.
+func textBreak(runes []rune) int {
+	limit := len(runes) - 1
+	wordBreak := 0
+	for i := limit; i > len(runes)/2; i-- {
+		if !unicode.IsSpace(runes[i]) {
+			continue
+		}
+		end := i + 1
+		if end > limit {
+			end = limit
+		}
+		if strings.ContainsRune(".!?", runes[i-1]) {
+			return end
+		}
+		if wordBreak == 0 {
+			wordBreak = end
+		}
 	}
-	total += maxTokensToGenerate
+	if wordBreak > 0 {
+		return wordBreak
+	}
+	return limit
+}
 
-	return total > gptModelContextLengthMax
+// messageSender sends messages to Telegram, it is the bot.
+type messageSender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
 }
 
-func sendErrorMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update, err error) {
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("`Failed to process your request. ERROR: %v`", err))
-	msg.ParseMode = tgbotapi.ModeMarkdown
-	sendMessage(bot, msg)
+// sendMessage sends the message, if Telegram can't parse its formatting the message is sent again with
+// a simpler parse mode, down to plain text, so that the content is always delivered. If Telegram rate limits
+// the bot, e.g. when the long reply is sent in several messages, the message is sent again after the wait it asks for.
+func sendMessage(ctx context.Context, bot messageSender, msg tgbotapi.MessageConfig) {
+	requestedParseMode := msg.ParseMode
+	retries := 0
+	for {
+		_, err := bot.Send(msg)
+		if err == nil {
+			break
+		}
+		if wait, ok := telegramRetryAfter(err); ok && retries < telegramSendRetries {
+			retries++
+			slog.Warn("Telegram rate limit is exceeded, retrying after the wait",
+				"chat_id", msg.ChatID, "retry_after", wait, "retry", retries, "error", err)
+			select {
+			case <-ctx.Done():
+				slog.Error("failed to send message", "chat_id", msg.ChatID, "bytes", len(msg.Text), "error", ctx.Err())
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		fallback, ok := fallbackParseModes[msg.ParseMode]
+		if !ok || !isParseEntitiesError(err) {
+			slog.Error("failed to send message", "chat_id", msg.ChatID, "bytes", len(msg.Text), "error", err)
+			return
+		}
+		slog.Warn("failed to send message, retrying with simpler parse mode",
+			"chat_id", msg.ChatID, "parse_mode", msg.ParseMode, "fallback_parse_mode", fallback, "error", err)
+		msg.ParseMode = fallback
+	}
+
+	slog.Info("sent message", "chat_id", msg.ChatID, "bytes", len(msg.Text), "parse_mode", msg.ParseMode,
+		"parse_mode_fallback", msg.ParseMode != requestedParseMode)
 }
 
-func sendMessage(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig) {
-	if _, err := bot.Send(msg); err != nil {
-		log.Println("failed to send a message:", err)
-	} else {
-		log.Printf("sent a message with %d bytes\n", len(msg.Text))
+// telegramRetryAfter returns how long Telegram asks to wait before sending the message again, false if the error
+// is not due to the rate limit or the wait is longer than telegramRetryAfterMax.
+func telegramRetryAfter(err error) (time.Duration, bool) {
+	var tgErr tgbotapi.Error
+	if !errors.As(err, &tgErr) || tgErr.RetryAfter <= 0 {
+		return 0, false
 	}
+	wait := time.Duration(tgErr.RetryAfter) * time.Second
+	return wait, wait <= telegramRetryAfterMax
 }
 
-func getAllMesssages(ctx context.Context, db *sql.DB) ([]*dbMessage, error) {
+// isParseEntitiesError reports whether Telegram rejected the message because its formatting is malformed.
+func isParseEntitiesError(err error) bool {
+	var tgErr tgbotapi.Error
+	return errors.As(err, &tgErr) && strings.Contains(tgErr.Message, telegramParseEntitiesErrorMessage)
+}
+
+// getAllMesssages returns conversation history of the user. If tag is not empty, only messages with the tag are returned.
+func getAllMesssages(ctx context.Context, db *sql.DB, ownerID int, tag string) ([]*dbMessage, error) {
 	const query = `
-		SELECT id, user_id, username, message, created_at FROM chat_history ORDER BY created_at ASC
+		SELECT id, user_id, owner_id, role, username, message, created_at FROM chat_history
+		WHERE owner_id = ?
+		ORDER BY created_at ASC
+	`
+	const queryByTag = `
+		SELECT h.id, h.user_id, h.owner_id, h.role, h.username, h.message, h.created_at FROM chat_history h
+		JOIN message_tags t ON t.message_id = h.id
+		WHERE h.owner_id = ? AND t.tag = ?
+		ORDER BY h.created_at ASC
 	`
 
-	rows, err := db.QueryContext(ctx, query)
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if tag == "" {
+		rows, err = db.QueryContext(ctx, query, ownerID)
+	} else {
+		rows, err = db.QueryContext(ctx, queryByTag, ownerID, tag)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to query for all messages from the database: %w", err)
 	}
@@ -381,14 +1366,11 @@ func getAllMesssages(ctx context.Context, db *sql.DB) ([]*dbMessage, error) {
 	for rows.Next() {
 
 		msg := new(dbMessage)
-		var msgCreatedAt string
-		if err := rows.Scan(&msg.ID, &msg.UserID, &msg.Username, &msg.Text, &msgCreatedAt); err != nil {
+		var msgCreatedAt int64
+		if err := rows.Scan(&msg.ID, &msg.UserID, &msg.OwnerID, &msg.Role, &msg.Username, &msg.Text, &msgCreatedAt); err != nil {
 			return nil, fmt.Errorf("failed to get message from the database: %w", err)
 		}
-
-		if msg.CreatedAt, err = time.Parse(databaseDateTimeLayout, msgCreatedAt); err != nil {
-			return nil, fmt.Errorf("failed to parse datetime '%v' with layout '%v': %w", msgCreatedAt, databaseDateTimeLayout, err)
-		}
+		msg.CreatedAt = time.UnixMilli(msgCreatedAt)
 
 		history = append(history, msg)
 	}
@@ -398,44 +1380,109 @@ func getAllMesssages(ctx context.Context, db *sql.DB) ([]*dbMessage, error) {
 	return history, nil
 }
 
-func saveMessage(ctx context.Context, db *sql.DB, msg *dbMessage) error {
+func saveMessage(ctx context.Context, db sqlExecutor, msg *dbMessage) error {
 	const query = `
-		INSERT INTO chat_history(user_id, username, message, created_at)
-		VALUES(?, ?, ?, ?)
+		INSERT INTO chat_history(user_id, owner_id, role, username, message, created_at, prompt_tokens, completion_tokens, total_tokens, finish_reason)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
 	`
 
-	stmt, err := db.PrepareContext(ctx, query)
+	row := db.QueryRowContext(ctx, query, msg.UserID, msg.OwnerID, msg.Role, msg.Username, msg.Text, msg.CreatedAt.UnixMilli(),
+		msg.PromptTokens, msg.CompletionTokens, msg.TotalTokens, msg.FinishReason)
+	return row.Scan(&msg.ID)
+}
+
+// saveMessages saves the messages without ID and the tags of them in one transaction, so that e.g. the exchange
+// isn't saved without the reply. IDs are only set if the transaction is committed.
+func saveMessages(ctx context.Context, db *sql.DB, msgs []*dbMessage, tags []string) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	if _, err = stmt.ExecContext(ctx, msg.UserID, msg.Username, msg.Text, msg.CreatedAt); err != nil {
-		return err
+	var saved []*dbMessage
+	defer func() {
+		if err != nil {
+			for _, msg := range saved {
+				msg.ID = 0
+			}
+		}
+	}()
+	for _, msg := range msgs {
+		if msg.ID != 0 {
+			continue
+		}
+		if err := saveMessage(ctx, tx, msg); err != nil {
+			return fmt.Errorf("failed to save message to the database: %w", err)
+		}
+		saved = append(saved, msg)
+		if err := saveMessageTags(ctx, tx, msg.ID, tags); err != nil {
+			return err
+		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-func deleteOldMessages(ctx context.Context, db *sql.DB, maxMessages int) error {
-	countRow := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chat_history")
+// deleteExpiredMessages deletes the messages of the user created before the time.
+func deleteExpiredMessages(ctx context.Context, db *sql.DB, ownerID int, before time.Time) error {
+	const query = `
+		DELETE FROM chat_history
+		WHERE owner_id = ? AND created_at < ?
+	`
 
-	var count int
-	if err := countRow.Scan(&count); err != nil {
-		return fmt.Errorf("failed to get message count from database: %v", err)
+	res, err := db.ExecContext(ctx, query, ownerID, before.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired messages from database: %v", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
 	}
 
-	if count > maxMessages {
-		oldMessageRow := db.QueryRowContext(ctx, "SELECT id FROM chat_history ORDER BY created_at DESC LIMIT 1 OFFSET ?", maxMessages)
+	if deleted > 0 {
+		return deleteOrphanMessageTags(ctx, db)
+	}
+	return nil
+}
 
-		var oldMessageID int64
-		if err := oldMessageRow.Scan(&oldMessageID); err != nil {
-			return fmt.Errorf("failed to get old message ID from database: %v", err)
-		}
+func deleteAllMessages(ctx context.Context, db *sql.DB, ownerID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM chat_history WHERE owner_id = ?", ownerID); err != nil {
+		return fmt.Errorf("failed to delete messages from database: %v", err)
+	}
+	if err := deleteConversationSummaries(ctx, db, ownerID, 0); err != nil {
+		return err
+	}
+	return deleteOrphanMessageTags(ctx, db)
+}
 
-		if _, err := db.ExecContext(ctx, "DELETE FROM chat_history WHERE id <= ?", oldMessageID); err != nil {
-			return fmt.Errorf("failed to delete old messages from database: %v", err)
-		}
+// deleteOldMessages keeps only the newest maxMessages messages of the user, by creation time and then by ID.
+func deleteOldMessages(ctx context.Context, db *sql.DB, ownerID int, maxMessages int) error {
+	const query = `
+		DELETE FROM chat_history
+		WHERE owner_id = ? AND id NOT IN (
+			SELECT id FROM chat_history
+			WHERE owner_id = ?
+			ORDER BY created_at DESC, id DESC
+			LIMIT ?
+		)
+	`
+
+	res, err := db.ExecContext(ctx, query, ownerID, ownerID, maxMessages)
+	if err != nil {
+		return fmt.Errorf("failed to delete old messages from database: %v", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		return deleteOrphanMessageTags(ctx, db)
 	}
 	return nil
 }
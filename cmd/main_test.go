@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestRenderPromptTemplate(t *testing.T) {
+	rows := []promptRow{
+		{human: true, text: "Hello"},
+		{human: false, text: "Hi there"},
+		{human: true, text: "How are you?"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "all placeholders",
+			template: "{{.System}}\n{{.History}}\nHuman: {{.Input}}\nAI:",
+			want:     "Be nice.\n\nHuman: Hello\nAI: Hi there\nHuman: How are you?\nAI:",
+		},
+		{
+			name:     "placeholders in other order",
+			template: "Question: {{.Input}}\nContext:{{.History}}\nRules: {{.System}}",
+			want:     "Question: How are you?\nContext:\nHuman: Hello\nAI: Hi there\nRules: Be nice.",
+		},
+		{
+			name:     "history is left out",
+			template: "{{.System}} {{.Input}}",
+			want:     "Be nice. How are you?",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promptTemplate, err := parsePromptTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := renderPrompt(promptTemplate, "Be nice.", rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderPromptDefaultFormat(t *testing.T) {
+	got, err := renderPrompt(nil, "Be nice.", []promptRow{{human: true, text: "Hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Be nice." + gptContextExample + "Hello" + gptPromptAI; got != want {
+		t.Errorf("prompt = %q, want %q", got, want)
+	}
+}
+
+func TestParsePromptTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "valid", template: "{{.System}}{{.History}}{{.Input}}"},
+		{name: "without placeholders", template: "Answer the question."},
+		{name: "syntax error", template: "{{.System", wantErr: true},
+		{name: "unknown placeholder", template: "{{.Question}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePromptTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testHistory returns the conversation history of the user 1, each message is "human text" or "ai text".
+// Messages have IDs from 1 in the given order and are a second apart.
+func testHistory(messages ...string) []*dbMessage {
+	start := time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC)
+	history := make([]*dbMessage, 0, len(messages))
+	for i, message := range messages {
+		role, text, _ := strings.Cut(message, " ")
+		msg := &dbMessage{ID: i + 1, UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: text, CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		if role == "ai" {
+			msg.UserID, msg.Role = 0, messageRoleAssistant
+		}
+		history = append(history, msg)
+	}
+	return history
+}
+
+// defaultFormatPrompt returns the prompt in the default format with the conversation rows, each is "human text" or "ai text".
+func defaultFormatPrompt(system string, rows ...string) string {
+	prompt := system + gptContextExample
+	if strings.HasPrefix(rows[0], "ai ") {
+		prompt = system + "\n" + gptPromptAI
+	}
+	for _, row := range rows {
+		role, text, _ := strings.Cut(row, " ")
+		if role == "ai" {
+			prompt += text + gptPromptHuman
+		} else {
+			prompt += text + gptPromptAI
+		}
+	}
+	return prompt
+}
+
+func TestBuildPromptFromHistoryTrimsWholeExchanges(t *testing.T) {
+	const maxTokens = 10
+
+	tests := []struct {
+		name    string
+		history []*dbMessage
+		// want is the prompt that just fits into the context, so that the fewest exchanges have to be trimmed to get it.
+		want               string
+		wantTrimmedThrough int
+	}{
+		{
+			name:    "nothing is trimmed",
+			history: testHistory("human q1", "ai a1"),
+			want:    defaultFormatPrompt("S", "human q1", "ai a1", "human new"),
+		},
+		{
+			name:               "oldest exchange is trimmed",
+			history:            testHistory("human q1", "ai a1", "human q2", "ai a2"),
+			want:               defaultFormatPrompt("S", "human q2", "ai a2", "human new"),
+			wantTrimmedThrough: 2,
+		},
+		{
+			name:               "human messages in a row are trimmed with their reply",
+			history:            testHistory("human q1", "human q1 again", "ai a1", "human q2", "ai a2"),
+			want:               defaultFormatPrompt("S", "human q2", "ai a2", "human new"),
+			wantTrimmedThrough: 3,
+		},
+		{
+			name:               "AI messages in a row are trimmed with the question",
+			history:            testHistory("human q1", "ai a1", "ai a1 more", "human q2", "ai a2"),
+			want:               defaultFormatPrompt("S", "human q2", "ai a2", "human new"),
+			wantTrimmedThrough: 3,
+		},
+		{
+			name:    "opening AI message starts the conversation",
+			history: testHistory("ai hello", "human q1", "ai a1"),
+			want:    defaultFormatPrompt("S", "ai hello", "human q1", "ai a1", "human new"),
+		},
+		{
+			name:               "unanswered message is sent with the new one",
+			history:            testHistory("human q1", "ai a1", "human q2"),
+			want:               defaultFormatPrompt("S", "human q2"+promptRowsSeparator+"new"),
+			wantTrimmedThrough: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contextLength := countBytes(tt.want) + maxTokens
+			got, trimmedThrough, err := buildPromptFromHistory(countBytes, contextLength, maxTokens, nil, "S", tt.history, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.text != tt.want {
+				t.Errorf("prompt = %q, want %q", got.text, tt.want)
+			}
+			if trimmedThrough != tt.wantTrimmedThrough {
+				t.Errorf("trimmed through message %d, want %d", trimmedThrough, tt.wantTrimmedThrough)
+			}
+		})
+	}
+}
+
+func TestBuildPromptFromHistoryTooLong(t *testing.T) {
+	history := testHistory("human q1", "ai a1")
+	contextLength := countBytes(defaultFormatPrompt("S", "human new"))
+
+	// Whole context is taken by the prompt, nothing is left for the reply
+	_, _, err := buildPromptFromHistory(countBytes, contextLength, 1, nil, "S", history, "new")
+	if !errors.Is(err, errPromptTooLong) {
+		t.Errorf("error = %v, want %v", err, errPromptTooLong)
+	}
+}
+
+func TestStripCompletionPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "AI prefix", text: "AI: Hello!", want: "Hello!"},
+		{name: "Assistant prefix", text: "Assistant: Hello!", want: "Hello!"},
+		{name: "prefix in other case", text: "ai:Hello!", want: "Hello!"},
+		{name: "without prefix", text: "Hello!", want: "Hello!"},
+		{name: "surrounding whitespace", text: " \n AI:  Hello!\n\n", want: "Hello!"},
+		{name: "whitespace without prefix", text: "\n Hello! ", want: "Hello!"},
+		{name: "prefix in the middle", text: "Ask the AI: it knows.", want: "Ask the AI: it knows."},
+		{name: "only the first prefix", text: "AI: AI: Hello!", want: "AI: Hello!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripCompletionPrefix(tt.text); got != tt.want {
+				t.Errorf("stripCompletionPrefix(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptThatDoesNotFitIsNotSent(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		wantReply   string
+		wantRequest bool
+	}{
+		{name: "message fits", text: "hello", wantReply: "hi", wantRequest: true},
+		{name: "message alone exceeds the context", text: strings.Repeat("word ", modelContextLength(openai.GPT3Dot5Turbo)), wantReply: promptTooLongMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+
+			p.processMessage(context.Background(), privateMessage(1, tt.text))
+
+			if got := telegram.last(); got != tt.wantReply {
+				t.Errorf("reply = %q, want %q", got, tt.wantReply)
+			}
+			if got := len(completions.requests) > 0; got != tt.wantRequest {
+				t.Errorf("request is sent = %v, want %v", got, tt.wantRequest)
+			}
+		})
+	}
+}
+
+// benchmarkExchangeCounts are the lengths of the conversation history in benchmarks.
+var benchmarkExchangeCounts = []int{10, 100, 1000}
+
+// benchmarkHistory returns the conversation of the user 1 with the number of exchanges of 40-word messages.
+func benchmarkHistory(exchanges int) []*dbMessage {
+	text := strings.TrimSpace(strings.Repeat("lorem ipsum dolor sit amet ", 8))
+	start := time.Now().Add(-time.Duration(2*exchanges) * time.Second)
+	history := make([]*dbMessage, 0, 2*exchanges)
+	for i := 0; i < 2*exchanges; i++ {
+		msg := &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: text, CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		if i%2 == 1 {
+			msg.UserID, msg.Role = 0, messageRoleAssistant
+		}
+		history = append(history, msg)
+	}
+	return history
+}
+
+func BenchmarkBuildPromptFromHistory(b *testing.B) {
+	countTokens := newTokenCounter(openai.GPT3TextDavinci003)
+	contextLength := modelContextLength(openai.GPT3TextDavinci003)
+
+	for _, exchanges := range benchmarkExchangeCounts {
+		history := benchmarkHistory(exchanges)
+		for i, msg := range history {
+			msg.ID = i + 1
+		}
+		b.Run(fmt.Sprintf("%d exchanges", exchanges), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := buildPromptFromHistory(countTokens, contextLength, defaultMaxTokensToGenerate, nil, gptSystemPrompt, history, "How are you?"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkProcessMessage measures the whole path of the message from loading the history to sending the reply,
+// with the memory store and fake OpenAI and Telegram APIs.
+func BenchmarkProcessMessage(b *testing.B) {
+	for _, exchanges := range benchmarkExchangeCounts {
+		b.Run(fmt.Sprintf("%d exchanges", exchanges), func(b *testing.B) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("fine, thanks", openai.FinishReasonStop)}}
+			p := newTestProcessor(b, &fakeTelegram{}, completions)
+			// History stays the same length, each reply is saved and the oldest exchange is deleted
+			p.maxMessagesInHistory = 2 * exchanges
+			ctx := context.Background()
+			if err := p.messages.SaveAll(ctx, benchmarkHistory(exchanges), nil); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.processMessage(ctx, privateMessage(1, "How are you?"))
+			}
+			b.StopTimer()
+
+			if got := len(completions.requests); got != b.N {
+				b.Fatalf("requests = %d, want %d", got, b.N)
+			}
+		})
+	}
+}
+
+func TestGroupExchangesOfStoredHistory(t *testing.T) {
+	start := time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC)
+	message := func(role, text string, seconds int) *dbMessage {
+		msg := &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: text, CreatedAt: start.Add(time.Duration(seconds) * time.Second)}
+		if role == "ai" {
+			msg.UserID, msg.Role = 0, messageRoleAssistant
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name string
+		// saved are saved one by one in the order, so that IDs follow it rather than the creation time.
+		saved  []*dbMessage
+		change func(ctx context.Context, s messageStore, saved []*dbMessage) error
+		want   [][]string
+	}{
+		{
+			name:  "messages saved out of order",
+			saved: []*dbMessage{message("human", "q2", 2), message("ai", "a2", 3), message("human", "q1", 0), message("ai", "a1", 1)},
+			want:  [][]string{{"human q1", "ai a1"}, {"human q2", "ai a2"}, {"human new"}},
+		},
+		{
+			name:  "messages created at the same time are in the order they are saved",
+			saved: []*dbMessage{message("human", "q1", 0), message("ai", "a1", 0), message("human", "q2", 0), message("ai", "a2", 0)},
+			want:  [][]string{{"human q1", "ai a1"}, {"human q2", "ai a2"}, {"human new"}},
+		},
+		{
+			name:  "reply left without its question after old messages are deleted",
+			saved: []*dbMessage{message("human", "q1", 0), message("ai", "a1", 1), message("human", "q2", 2), message("ai", "a2", 3)},
+			change: func(ctx context.Context, s messageStore, saved []*dbMessage) error {
+				return s.DeleteOld(ctx, 1, 3)
+			},
+			want: [][]string{{"ai a1"}, {"human q2", "ai a2"}, {"human new"}},
+		},
+		{
+			name:  "question left without its reply after the reply is deleted",
+			saved: []*dbMessage{message("human", "q1", 0), message("ai", "a1", 1), message("human", "q2", 2), message("ai", "a2", 3)},
+			change: func(ctx context.Context, s messageStore, saved []*dbMessage) error {
+				return s.DeleteFrom(ctx, 1, saved[3].ID)
+			},
+			want: [][]string{{"human q1", "ai a1"}, {"human q2" + promptRowsSeparator + "new"}},
+		},
+		{
+			name:  "expired exchanges are left out",
+			saved: []*dbMessage{message("human", "q1", 0), message("ai", "a1", 1), message("human", "q2", 2), message("ai", "a2", 3), message("human", "q3", 4), message("ai", "a3", 5)},
+			change: func(ctx context.Context, s messageStore, saved []*dbMessage) error {
+				return s.DeleteExpired(ctx, 1, start.Add(4*time.Second))
+			},
+			want: [][]string{{"human q3", "ai a3"}, {"human new"}},
+		},
+		{
+			name:  "question of the failed turn is merged with the next one",
+			saved: []*dbMessage{message("human", "q1", 0), message("ai", "a1", 1), message("human", "q2", 2), message("human", "q3", 3), message("ai", "a3", 4)},
+			want:  [][]string{{"human q1", "ai a1"}, {"human q2" + promptRowsSeparator + "q3", "ai a3"}, {"human new"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			for _, msg := range tt.saved {
+				if err := store.Save(ctx, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.change != nil {
+				if err := tt.change(ctx, store, tt.saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+			history, err := store.History(ctx, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([][]string, 0)
+			for _, exchange := range groupExchanges(history, "new") {
+				rows := make([]string, 0, len(exchange))
+				for _, row := range exchange {
+					if row.human {
+						rows = append(rows, "human "+row.text)
+					} else {
+						rows = append(rows, "ai "+row.text)
+					}
+				}
+				got = append(got, rows)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("exchanges = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredMessagesAreForgotten(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		elapsed time.Duration
+		want    []string
+	}{
+		{name: "history doesn't expire by default", elapsed: 100 * time.Hour, want: []string{"q1", "a1", "q2", "a2", "new"}},
+		{name: "nothing has expired yet", ttl: 24 * time.Hour, elapsed: 24 * time.Hour, want: []string{"q1", "a1", "q2", "a2", "new"}},
+		{name: "older exchange has expired", ttl: 24 * time.Hour, elapsed: 25 * time.Hour, want: []string{"q2", "a2", "new"}},
+		{name: "whole history has expired", ttl: 24 * time.Hour, elapsed: 27 * time.Hour, want: []string{gptDefaultAIMessage, "new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.persona = "S"
+			p.historyTTL = tt.ttl
+			p.now = func() time.Time { return start.Add(tt.elapsed) }
+			history := testHistory("human q1", "ai a1", "human q2", "ai a2")
+			for i, msg := range history {
+				// Second exchange is two hours newer than the first one
+				msg.ID, msg.CreatedAt = 0, start.Add(time.Duration(i/2)*2*time.Hour)
+			}
+			if err := p.messages.SaveAll(ctx, history, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			p.processMessage(ctx, privateMessage(1, "new"))
+
+			var got []string
+			for _, msg := range completions.lastRequest().Messages[1:] {
+				got = append(got, msg.Content)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("prompt messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	maintenanceOn  = "on"
+	maintenanceOff = "off"
+
+	defaultMaintenanceMessage = "The bot is under maintenance, please try again later."
+)
+
+// maintenanceCommands are the commands that keep working in maintenance mode, mapped to whether they are
+// for administrator only. None of them writes to the database or calls OpenAI API on behalf of users.
+var maintenanceCommands = map[string]bool{
+	commandHelp:        false,
+	commandMaintenance: true,
+	commandLastError:   true,
+	commandPrompt:      true,
+}
+
+// isAllowedInMaintenance reports whether the message is processed even though the bot is in maintenance mode.
+// Everything else is answered with the maintenance notice, without touching the database or OpenAI API.
+func (p *messageProcessor) isAllowedInMaintenance(message *tgbotapi.Message) bool {
+	if !message.IsCommand() {
+		return false
+	}
+	adminOnly, ok := maintenanceCommands[message.Command()]
+	return ok && (!adminOnly || p.isAdmin(message.From.ID))
+}
+
+func (p *messageProcessor) handleMaintenanceCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	switch mode := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments())); mode {
+	case "":
+		current := maintenanceOff
+		if p.maintenance.Load() {
+			current = maintenanceOn
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Maintenance mode is %v. Use /maintenance %v|%v to change it.", current, maintenanceOn, maintenanceOff))
+	case maintenanceOn:
+		p.maintenance.Store(true)
+		log.Println("maintenance mode is on")
+		sendTextMessage(p.bot, chatID, parseMode, "Maintenance mode is on, messages are answered with the maintenance notice.")
+	case maintenanceOff:
+		p.maintenance.Store(false)
+		log.Println("maintenance mode is off")
+		sendTextMessage(p.bot, chatID, parseMode, "Maintenance mode is off.")
+	default:
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Unknown mode '%v'. Use /maintenance %v|%v.", mode, maintenanceOn, maintenanceOff))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestMaintenanceSuppressesWrites(t *testing.T) {
+	const adminID, userID = 1, 2
+
+	tests := []struct {
+		name   string
+		update func() tgbotapi.Update
+		// wantNotice is whether the message is answered with the maintenance notice rather than processed.
+		wantNotice bool
+	}{
+		{name: "message", update: func() tgbotapi.Update { return privateMessage(userID, "hello") }, wantNotice: true},
+		{name: "message of administrator", update: func() tgbotapi.Update { return privateMessage(adminID, "hello") }, wantNotice: true},
+		{name: "command that writes", update: func() tgbotapi.Update { return commandMessage(userID, "/style formal") }, wantNotice: true},
+		{name: "administrator command of user", update: func() tgbotapi.Update { return commandMessage(userID, "/maintenance off") }, wantNotice: true},
+		{name: "help", update: func() tgbotapi.Update { return commandMessage(userID, "/help") }},
+		{name: "administrator command", update: func() tgbotapi.Update { return commandMessage(adminID, "/maintenance") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+			p.adminUserID = adminID
+			p.allowedUserIDs = map[int]struct{}{adminID: {}, userID: {}}
+			p.dailyMessageLimit = 10
+			p.greeting = "Welcome!"
+			p.maintenanceMessage = defaultMaintenanceMessage
+			p.maintenance.Store(true)
+
+			p.processMessage(context.Background(), tt.update())
+
+			if got := telegram.last() == defaultMaintenanceMessage; got != tt.wantNotice {
+				t.Errorf("reply %q is the maintenance notice = %v, want %v", telegram.last(), got, tt.wantNotice)
+			}
+			if telegram.last() == "" {
+				t.Error("message is not answered")
+			}
+			if len(completions.requests) > 0 {
+				t.Errorf("%d requests are sent to OpenAI", len(completions.requests))
+			}
+			store := p.messages.(*memoryStore)
+			if len(store.messages) > 0 || len(store.chatSettings) > 0 || len(store.dailyCounts) > 0 || len(store.chatErrors) > 0 {
+				t.Errorf("store is written: %d messages, %d chat settings, %d daily counts, %d errors",
+					len(store.messages), len(store.chatSettings), len(store.dailyCounts), len(store.chatErrors))
+			}
+			if !p.maintenance.Load() {
+				t.Error("maintenance mode is turned off")
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandMaxTokens = "maxtokens"
+
+	maxTokensReset = "reset"
+)
+
+// userMaxTokensToGenerate returns the limit of tokens to generate the user has set with /maxtokens, or the configured one.
+func (p *messageProcessor) userMaxTokensToGenerate(ctx context.Context, userID int) (int, error) {
+	limit, err := p.settings.UserMaxTokens(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if limit == 0 {
+		return p.maxTokensToGenerate, nil
+	}
+	return limit, nil
+}
+
+// handleMaxTokensCommand sets the limit of tokens to generate in replies to the user, e.g. /maxtokens 1000.
+// /maxtokens without arguments shows the current limit, /maxtokens reset reverts to the configured one.
+func (p *messageProcessor) handleMaxTokensCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+	arg := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	switch arg {
+	case "":
+		current, err := p.userMaxTokensToGenerate(ctx, userID)
+		if err != nil {
+			slog.Error("failed to get user max tokens to generate", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Replies are limited to %d tokens.\nUse /maxtokens <n> to change the limit, /maxtokens reset to use the default one.", current))
+		return
+	case maxTokensReset:
+		if err := p.settings.DeleteUserMaxTokens(ctx, userID); err != nil {
+			slog.Error("failed to reset user max tokens to generate", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Limit is reset to the default one, %d tokens.", p.maxTokensToGenerate))
+		return
+	}
+
+	available, err := p.maxTokensAvailable(ctx, chatID, userID)
+	if err != nil {
+		slog.Error("failed to get tokens available for the reply", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	limit, err := strconv.Atoi(arg)
+	if err != nil || limit < 1 || limit > available {
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Limit has to be a number from 1 to %d.", available))
+		return
+	}
+	if err := p.settings.SaveUserMaxTokens(ctx, userID, limit); err != nil {
+		slog.Error("failed to save user max tokens to generate", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Replies are limited to %d tokens. Use /maxtokens reset to revert to the default limit.", limit))
+}
+
+// maxTokensAvailable returns the largest limit of tokens to generate for the user: the context window of their model
+// without the system prompt, which every prompt starts with, and the new message of at least a token.
+func (p *messageProcessor) maxTokensAvailable(ctx context.Context, chatID int64, userID int) (int, error) {
+	model, err := p.userModel(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	system, err := p.systemPrompt(ctx, chatID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return modelContextLength(model.name) - p.tokenCounterFor(model.name)(system) - chatReplyTokensOverhead - 2*chatMessageTokensOverhead - 1, nil
+}
+
+// getUserMaxTokens returns the limit of tokens to generate set by the user, or zero if there is none.
+func getUserMaxTokens(ctx context.Context, db *sql.DB, userID int) (int, error) {
+	const query = `
+		SELECT max_tokens FROM user_max_tokens WHERE user_id = ?
+	`
+
+	var limit int
+	if err := db.QueryRowContext(ctx, query, userID).Scan(&limit); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get user max tokens from the database: %w", err)
+	}
+	return limit, nil
+}
+
+func saveUserMaxTokens(ctx context.Context, db *sql.DB, userID, limit int) error {
+	const query = `
+		INSERT INTO user_max_tokens(user_id, max_tokens)
+		VALUES(?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET max_tokens = excluded.max_tokens
+	`
+
+	if _, err := db.ExecContext(ctx, query, userID, limit); err != nil {
+		return fmt.Errorf("failed to save user max tokens to the database: %w", err)
+	}
+	return nil
+}
+
+func deleteUserMaxTokens(ctx context.Context, db *sql.DB, userID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_max_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete user max tokens from database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "telegram_ai_chat_bot"
+
+	completionResultSuccess = "success"
+	completionResultFailure = "failure"
+)
+
+// botMetrics are the Prometheus metrics of the bot, nil botMetrics records nothing.
+type botMetrics struct {
+	registry *prometheus.Registry
+
+	messagesReceived  prometheus.Counter
+	updatesDropped    prometheus.Counter
+	completions       *prometheus.CounterVec
+	openAIRequestTime prometheus.Histogram
+	openAITokens      prometheus.Counter
+}
+
+func newBotMetrics() *botMetrics {
+	m := &botMetrics{
+		registry: prometheus.NewRegistry(),
+		messagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Messages accepted from allowed users.",
+		}),
+		updatesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "updates_dropped_total",
+			Help:      "Telegram updates dropped because the updates buffer is full.",
+		}),
+		completions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "completions_total",
+			Help:      "Completions requested from OpenAI by result, retries and cached completions are not counted.",
+		}, []string{"result"}),
+		openAIRequestTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "openai_request_duration_seconds",
+			Help:      "Latency of OpenAI completion requests, including failed ones.",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+		}),
+		openAITokens: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "openai_tokens_total",
+			Help:      "Tokens used by OpenAI completion requests, prompt and completion together.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.messagesReceived,
+		m.updatesDropped,
+		m.completions,
+		m.openAIRequestTime,
+		m.openAITokens,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *botMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *botMetrics) messageReceived() {
+	if m == nil {
+		return
+	}
+	m.messagesReceived.Inc()
+}
+
+func (m *botMetrics) updateDropped() {
+	if m == nil {
+		return
+	}
+	m.updatesDropped.Inc()
+}
+
+func (m *botMetrics) completionDone(err error) {
+	if m == nil {
+		return
+	}
+	result := completionResultSuccess
+	if err != nil {
+		result = completionResultFailure
+	}
+	m.completions.WithLabelValues(result).Inc()
+}
+
+func (m *botMetrics) openAIRequestDone(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.openAIRequestTime.Observe(duration.Seconds())
+}
+
+func (m *botMetrics) tokensUsed(tokens int) {
+	if m == nil {
+		return
+	}
+	m.openAITokens.Add(float64(tokens))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	commandModel = "model"
+
+	modelReset = "reset"
+
+	// defaultContextLength is the context window of models that aren't known, the smallest of GPT-3 models.
+	defaultContextLength = 4097
+	// fineTunedModelPrefix starts the names of fine-tuned models, followed by the base model.
+	fineTunedModelPrefix = "ft:"
+)
+
+// modelContextLengths are the context windows of models in tokens. Versioned model like gpt-4-0613
+// has the context window of the longest name it starts with.
+var modelContextLengths = map[string]int{
+	"gpt-3.5-turbo":      4096,
+	"gpt-3.5-turbo-16k":  16385,
+	"gpt-3.5-turbo-1106": 16385,
+	"gpt-3.5-turbo-0125": 16385,
+	"gpt-4":              8192,
+	"gpt-4-32k":          32768,
+	"gpt-4-1106-preview": 128000,
+	"gpt-4-0125-preview": 128000,
+	"gpt-4-turbo":        128000,
+	"gpt-4o":             128000,
+	"text-davinci-003":   4097,
+	"text-davinci-002":   4097,
+	"code-davinci-002":   8001,
+}
+
+// modelContextLength returns how many tokens the prompt and the reply may take together with the model.
+// Fine-tuned model, e.g. ft:gpt-3.5-turbo-0125:org::id, has the context window of its base model.
+func modelContextLength(model string) int {
+	model = strings.TrimPrefix(model, fineTunedModelPrefix)
+	longest, length := "", defaultContextLength
+	for name, l := range modelContextLengths {
+		if strings.HasPrefix(model, name) && len(name) > len(longest) {
+			longest, length = name, l
+		}
+	}
+	return length
+}
+
+// chatModel is the OpenAI model and the API it is used with.
+type chatModel struct {
+	name          string
+	completionAPI bool
+}
+
+// selectableModels are the models users can switch to with /model, in addition to the configured one.
+var selectableModels = []chatModel{
+	{name: openai.GPT3Dot5Turbo},
+	{name: openai.GPT4},
+	{name: openai.GPT3TextDavinci003, completionAPI: true},
+}
+
+// availableModels returns the models users can switch to, the configured one first.
+func (p *messageProcessor) availableModels() []chatModel {
+	models := []chatModel{p.model}
+	for _, m := range selectableModels {
+		if m.name != p.model.name {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+func (p *messageProcessor) findModel(name string) (chatModel, bool) {
+	for _, m := range p.availableModels() {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return chatModel{}, false
+}
+
+// userModel returns the model the user has chosen with /model, or the configured one.
+func (p *messageProcessor) userModel(ctx context.Context, userID int) (chatModel, error) {
+	name, err := p.settings.UserModel(ctx, userID)
+	if err != nil {
+		return chatModel{}, err
+	}
+	// Model chosen before may be no longer available if the configured model is changed
+	if m, ok := p.findModel(name); ok {
+		return m, nil
+	}
+	return p.model, nil
+}
+
+// handleModelCommand switches the model used to answer the user, e.g. /model gpt-4.
+// /model without arguments shows the current model, /model reset reverts to the configured one.
+func (p *messageProcessor) handleModelCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+	name := strings.TrimSpace(update.Message.CommandArguments())
+
+	switch strings.ToLower(name) {
+	case "":
+		current, err := p.userModel(ctx, userID)
+		if err != nil {
+			slog.Error("failed to get user model", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Current model is %v. Available models: %v.\nUse /model <name> to switch, /model reset to use the default one.",
+			current.name, strings.Join(p.availableModelNames(), ", ")))
+		return
+	case modelReset:
+		if err := p.settings.DeleteUserModel(ctx, userID); err != nil {
+			slog.Error("failed to reset user model", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Model is reset to the default one, %v.", p.model.name))
+		return
+	}
+
+	m, ok := p.findModel(name)
+	if !ok {
+		sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Unknown model '%v', available models: %v.", name, strings.Join(p.availableModelNames(), ", ")))
+		return
+	}
+	if err := p.settings.SaveUserModel(ctx, userID, m.name); err != nil {
+		slog.Error("failed to save user model", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	sendTextMessage(p.bot, chatID, "", fmt.Sprintf("Switched to %v. Use /model reset to revert to the default one.", m.name))
+}
+
+func (p *messageProcessor) availableModelNames() []string {
+	models := p.availableModels()
+	names := make([]string, 0, len(models))
+	for _, m := range models {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// getUserModel returns the name of the model chosen by the user, or empty string if there is none.
+func getUserModel(ctx context.Context, db *sql.DB, userID int) (string, error) {
+	const query = `
+		SELECT model FROM user_models WHERE user_id = ?
+	`
+
+	var model string
+	if err := db.QueryRowContext(ctx, query, userID).Scan(&model); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get user model from the database: %w", err)
+	}
+	return model, nil
+}
+
+func saveUserModel(ctx context.Context, db *sql.DB, userID int, model string) error {
+	const query = `
+		INSERT INTO user_models(user_id, model)
+		VALUES(?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET model = excluded.model
+	`
+
+	if _, err := db.ExecContext(ctx, query, userID, model); err != nil {
+		return fmt.Errorf("failed to save user model to the database: %w", err)
+	}
+	return nil
+}
+
+func deleteUserModel(ctx context.Context, db *sql.DB, userID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_models WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete user model from database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestModelContextLength(t *testing.T) {
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{model: "gpt-3.5-turbo", want: 4096},
+		{model: "gpt-4o", want: 128000},
+		// Versioned and derived models have the context window of the longest name they start with
+		{model: "gpt-3.5-turbo-0613", want: 4096},
+		{model: "gpt-3.5-turbo-16k-0613", want: 16385},
+		{model: "gpt-4-0613", want: 8192},
+		{model: "gpt-4-32k-0613", want: 32768},
+		{model: "gpt-4-turbo-2024-04-09", want: 128000},
+		{model: "gpt-4o-mini", want: 128000},
+		{model: "ft:gpt-3.5-turbo-0125:acme::8abc", want: 16385},
+		{model: "ft:davinci-002:acme::8abc", want: defaultContextLength},
+		{model: "llama-3", want: defaultContextLength},
+		{model: "", want: defaultContextLength},
+		// Known name in the middle is not the prefix
+		{model: "my-gpt-4o", want: defaultContextLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := modelContextLength(tt.model); got != tt.want {
+				t.Errorf("modelContextLength(%q) = %d, want %d", tt.model, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	flaggedMessageMessage        = "Sorry, I can't help with that, the message doesn't comply with the usage policies."
+	flaggedReplyMessage          = "Sorry, the reply doesn't comply with the usage policies, try rephrasing the question."
+	moderationUnavailableMessage = "Sorry, the message can't be checked at the moment, please try again in a minute."
+)
+
+// moderationRefusal returns the message to reply with instead of passing the text on,
+// flaggedMessage if OpenAI moderation flags the text, or empty string if the text may be passed on.
+// If moderation fails, the text is passed on unless moderation is configured to fail closed.
+func (p *messageProcessor) moderationRefusal(ctx context.Context, text, flaggedMessage string) string {
+	if !p.moderation {
+		return ""
+	}
+
+	flagged, err := p.moderate(ctx, text)
+	if err != nil {
+		slog.Error("failed to moderate text", "error", err)
+		if p.moderationFailClosed {
+			return moderationUnavailableMessage
+		}
+		return ""
+	}
+	if flagged {
+		slog.Warn("text is flagged by moderation")
+		return flaggedMessage
+	}
+	return ""
+}
+
+// moderate reports whether OpenAI moderation flags the text.
+func (p *messageProcessor) moderate(ctx context.Context, text string) (bool, error) {
+	requestCtx, cancel := p.withOpenAITimeout(ctx)
+	defer cancel()
+
+	resp, err := p.gptClient.Moderations(requestCtx, openai.ModerationRequest{Input: text})
+	if err != nil {
+		return false, err
+	}
+	for _, result := range resp.Results {
+		if result.Flagged {
+			return true, nil
+		}
+	}
+	return false, nil
+}
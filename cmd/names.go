@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingNames = "names"
+
+	namesOn  = "on"
+	namesOff = "off"
+)
+
+// getChatIncludeNames reports whether sender names have to be included into the prompt in the chat.
+func getChatIncludeNames(ctx context.Context, settings settingsStore, chatID int64) (bool, error) {
+	names, err := settings.ChatSetting(ctx, chatID, chatSettingNames)
+	if err != nil {
+		return false, err
+	}
+	return names == namesOn, nil
+}
+
+// withSenderNames returns copy of the history with human messages prefixed with sender names.
+func withSenderNames(history []*dbMessage) []*dbMessage {
+	named := make([]*dbMessage, 0, len(history))
+	for _, msg := range history {
+		if msg.isHuman() {
+			namedMsg := *msg
+			namedMsg.Text = withSenderName(msg)
+			msg = &namedMsg
+		}
+		named = append(named, msg)
+	}
+	return named
+}
+
+func withSenderName(msg *dbMessage) string {
+	if msg.Username == "" {
+		return msg.Text
+	}
+	return msg.Username + ": " + msg.Text
+}
+
+func (p *messageProcessor) handleNamesCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	names := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	if names == "" {
+		includeNames, err := getChatIncludeNames(ctx, p.settings, chatID)
+		if err != nil {
+			slog.Error("failed to get chat names setting", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		current := namesOff
+		if includeNames {
+			current = namesOn
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Sender names in prompts are %v. Use /names %v|%v to change it.", current, namesOn, namesOff))
+		return
+	}
+
+	if names != namesOn && names != namesOff {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Unknown value '%v'. Use /names %v|%v.", names, namesOn, namesOff))
+		return
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingNames, names); err != nil {
+		slog.Error("failed to save chat names setting", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Sender names in prompts are %v.", names))
+}
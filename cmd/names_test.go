@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"text/template"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestWithSenderNames(t *testing.T) {
+	history := []*dbMessage{
+		{ID: 1, Role: messageRoleUser, Username: "alice", Text: "hi"},
+		{ID: 2, Role: messageRoleAssistant, Text: "hello"},
+		{ID: 3, Role: messageRoleUser, Text: "no name"},
+	}
+	want := []string{"alice: hi", "hello", "no name"}
+
+	named := withSenderNames(history)
+	for i, msg := range named {
+		if msg.Text != want[i] {
+			t.Errorf("message %d = %q, want %q", msg.ID, msg.Text, want[i])
+		}
+	}
+	if history[0].Text != "hi" {
+		t.Errorf("history is changed: %q", history[0].Text)
+	}
+}
+
+func TestNamesInChatMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		// command is sent before the messages, if set.
+		command string
+		// want are the human messages in the prompt of the second message.
+		want []string
+	}{
+		{name: "names are off by default", want: []string{"first", "second"}},
+		{name: "names are on", command: "/names on", want: []string{"alice: first", "alice: second"}},
+		{name: "names are turned off", command: "/names off", want: []string{"first", "second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("answer", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+
+			if tt.command != "" {
+				p.processMessage(context.Background(), commandMessage(1, tt.command))
+			}
+			for _, text := range []string{"first", "second"} {
+				update := privateMessage(1, text)
+				update.Message.From.UserName = "alice"
+				p.processMessage(context.Background(), update)
+			}
+
+			var got []string
+			for _, msg := range completions.lastRequest().Messages {
+				if msg.Role == openai.ChatMessageRoleUser {
+					got = append(got, msg.Content)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("messages = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("message %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNamesInTextPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name: "default format",
+			want: defaultFormatPrompt("S", "ai "+gptDefaultAIMessage, "human alice: first", "ai hi", "human alice: second"),
+		},
+		{
+			name:     "prompt template",
+			template: "{{.System}}|{{.History}}|{{.Input}}",
+			want:     "S|" + gptPromptAI + gptDefaultAIMessage + gptPromptHuman + "alice: first" + gptPromptAI + "hi|alice: second",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p := newTestProcessor(t, &fakeTelegram{}, &fakeChatCompletions{})
+			api := &contextLengthExceeded{}
+			p.gptClient = newTestOpenAIClient(t, api.handle)
+			p.model = chatModel{name: openai.GPT3TextDavinci003, completionAPI: true}
+			p.countTokens = newTokenCounter(openai.GPT3TextDavinci003)
+			p.persona = "S"
+			if tt.template != "" {
+				p.promptTemplate = template.Must(template.New("prompt").Parse(tt.template))
+			}
+
+			p.processMessage(ctx, commandMessage(1, "/names on"))
+			for _, text := range []string{"first", "second"} {
+				update := privateMessage(1, text)
+				update.Message.From.UserName = "alice"
+				p.processMessage(ctx, update)
+			}
+
+			if len(api.prompts) != 2 {
+				t.Fatalf("prompts = %q, want 2", api.prompts)
+			}
+			if got := api.prompts[1]; got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	openAIErrorCodeInsufficientQuota     = "insufficient_quota"
+	openAIErrorCodeContextLengthExceeded = "context_length_exceeded"
+
+	// openAIAttempts is how many times the request is sent when OpenAI is overloaded or fails,
+	// the delay between attempts doubles starting from openAIRetryDelay.
+	openAIAttempts   = 3
+	openAIRetryDelay = time.Second
+
+	// defaultOpenAITimeout limits each request to OpenAI, so that a hung request doesn't block processing of messages.
+	defaultOpenAITimeout = 60 * time.Second
+
+	openAIBusyMessage    = "Sorry, OpenAI is busy at the moment, please try again in a minute."
+	openAITimeoutMessage = "Sorry, the request to OpenAI timed out, please try again."
+	noCompletionMessage  = "Sorry, I couldn't generate a response, please try again."
+
+	outOfCreditsMessage      = "Sorry, the service is out of credits at the moment. The administrator has been notified, please try again later."
+	outOfCreditsAlertMessage = "OpenAI account is out of credits, requests are being rejected with 'insufficient_quota' error. Please check the billing settings."
+)
+
+// azureHostSuffix ends the host name of Azure OpenAI endpoints, which authenticate and name models differently.
+const azureHostSuffix = ".openai.azure.com"
+
+// parseOpenAIBaseURL checks the base URL of OpenAI API, e.g. of the proxy, empty value means the default one.
+func parseOpenAIBaseURL(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("'%v' is not an absolute HTTP(S) URL", value)
+	}
+	return strings.TrimSuffix(value, "/"), nil
+}
+
+// newOpenAIConfig returns the configuration of OpenAI client for the base URL, the default endpoint if it is empty.
+// Azure OpenAI endpoints are recognized by their host name, the deployment is named after the model there.
+func newOpenAIConfig(apiKey, baseURL, orgID string) openai.ClientConfig {
+	var config openai.ClientConfig
+	switch u, _ := url.Parse(baseURL); {
+	case baseURL == "":
+		config = openai.DefaultConfig(apiKey)
+	case strings.HasSuffix(u.Hostname(), azureHostSuffix):
+		config = openai.DefaultAzureConfig(apiKey, baseURL)
+	default:
+		config = openai.DefaultConfig(apiKey)
+		config.BaseURL = baseURL
+	}
+	config.OrgID = orgID
+	return config
+}
+
+// samplingParams are the parameters of text generation.
+type samplingParams struct {
+	temperature      float32
+	topP             float32
+	frequencyPenalty float32
+	presencePenalty  float32
+}
+
+var defaultSamplingParams = samplingParams{
+	temperature:      0.9,
+	topP:             1,
+	frequencyPenalty: 0,
+	presencePenalty:  0.6,
+}
+
+func (s samplingParams) String() string {
+	return fmt.Sprintf("temperature %v, top_p %v, frequency penalty %v, presence penalty %v",
+		s.temperature, s.topP, s.frequencyPenalty, s.presencePenalty)
+}
+
+// parseSamplingParam parses the value of the sampling parameter, empty value means the default one.
+func parseSamplingParam(value string, defaultValue, min, max float32) (float32, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return 0, err
+	}
+	if !(float32(parsed) >= min && float32(parsed) <= max) {
+		return 0, fmt.Errorf("%v is out of range from %v to %v", parsed, min, max)
+	}
+	return float32(parsed), nil
+}
+
+const (
+	// stopSequencesNone disables stop sequences.
+	stopSequencesNone = "none"
+	// maxStopSequences is how many stop sequences OpenAI accepts in the request.
+	maxStopSequences = 4
+)
+
+// defaultStopSequences stop generation at speaker labels of the default "Human: ... AI: ..." prompt format.
+var defaultStopSequences = []string{" Human:", " AI:"}
+
+// parseStopSequences parses comma-separated stop sequences, spaces in them are kept as is.
+// Empty value means the default ones, "none" disables stop sequences.
+func parseStopSequences(value string) ([]string, error) {
+	switch value {
+	case "":
+		return defaultStopSequences, nil
+	case stopSequencesNone:
+		return nil, nil
+	}
+
+	var sequences []string
+	for _, s := range strings.Split(value, ",") {
+		if s != "" {
+			sequences = append(sequences, s)
+		}
+	}
+	if len(sequences) > maxStopSequences {
+		return nil, fmt.Errorf("%d stop sequences are given, at most %d are allowed", len(sequences), maxStopSequences)
+	}
+	return sequences, nil
+}
+
+// stopSequences returns the stop sequences for the request: the configured ones with the completion API,
+// none with the chat completions API, where replies are separate messages and don't continue with speaker labels.
+func (p *messageProcessor) stopSequences(completionAPI bool) []string {
+	if !completionAPI {
+		return nil
+	}
+	return p.stopSequencesCompletion
+}
+
+var errNoCompletionChoices = errors.New("OpenAI returned no completion choices")
+
+// completion is the model reply with the details used to tune generation length.
+type completion struct {
+	Text         string
+	FinishReason string
+	// Alternatives are the texts of the other choices when more than one is requested.
+	Alternatives []string
+	// Tokens is the number of generated tokens.
+	Tokens       int
+	PromptTokens int
+	TotalTokens  int
+	Cached       bool
+}
+
+// complete requests completion of the prompt from the model, or takes it from the cache.
+func (p *messageProcessor) complete(ctx context.Context, text string) (string, error) {
+	c, err := p.completeWithMaxTokens(ctx, p.textPrompt(text), p.maxTokensToGenerate)
+	return c.Text, err
+}
+
+// completeWithMaxTokens is the same as complete, but generates at most maxTokens tokens.
+// Prompt with chat messages is sent to the chat completions API, prompt text to the completion API.
+func (p *messageProcessor) completeWithMaxTokens(ctx context.Context, prompt modelPrompt, maxTokens int) (completion, error) {
+	return p.completeWithChoices(ctx, prompt, maxTokens, 1)
+}
+
+// completeWithChoices is the same as completeWithMaxTokens, but generates n choices, see completion.Alternatives.
+// Completions with different numbers of choices are cached separately.
+func (p *messageProcessor) completeWithChoices(ctx context.Context, prompt modelPrompt, maxTokens, n int) (completion, error) {
+	key := completionCacheKey(prompt, maxTokens, n)
+	sampling := p.sampling
+	if prompt.sampling != nil {
+		sampling = *prompt.sampling
+	}
+	if c, ok := p.completionCache.get(key); ok {
+		log.Println("using cached completion")
+		// Cached completion costs nothing, so no tokens are accounted for it
+		return completion{Text: c.Text, FinishReason: c.FinishReason, Alternatives: c.Alternatives, Cached: true}, nil
+	}
+
+	var (
+		c   completion
+		err error
+	)
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		var retryAfter time.Duration
+		requestCtx, cancel := p.withOpenAITimeout(withRetryAfter(ctx, &retryAfter))
+		if prompt.messages != nil {
+			c, err = p.completeChat(requestCtx, prompt.model, prompt.messages, sampling, maxTokens, n)
+		} else {
+			c, err = p.completeText(requestCtx, prompt.model, prompt.text, sampling, maxTokens, n)
+		}
+		cancel()
+		p.metrics.openAIRequestDone(time.Since(start))
+		if err == nil || attempt == openAIAttempts || !isTransientOpenAIError(err) {
+			break
+		}
+
+		delay := retryDelay(attempt)
+		if retryAfter > 0 {
+			delay = min(retryAfter, p.openAIRetryMaxWait)
+		}
+		slog.Warn("OpenAI request failed, retrying", "delay", delay, "attempt", attempt, "attempts", openAIAttempts, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			p.metrics.completionDone(err)
+			return completion{}, err
+		}
+	}
+	p.metrics.completionDone(err)
+	if err != nil {
+		return completion{}, err
+	}
+
+	p.completionCache.put(key, c)
+	return c, nil
+}
+
+// completionCacheKey returns the cache key of the n completions of the prompt. Replies to the same prompt are cached
+// separately for different models, sampling parameters and limits of tokens to generate, so that e.g. the reply
+// cut off at the old limit isn't reused after the limit is changed with /maxtokens. Replies in the conversation
+// are cached per owner, the same prompt of another user doesn't get them.
+func completionCacheKey(prompt modelPrompt, maxTokens, n int) string {
+	key := fmt.Sprintf("owner %d\nchoices %d\n%s\nmax tokens %d\n", prompt.ownerID, n, prompt.model, maxTokens)
+	if prompt.sampling != nil {
+		key = prompt.sampling.String() + "\n" + key
+	}
+	return key + prompt.String()
+}
+
+func (p *messageProcessor) completeChat(ctx context.Context, model string, messages []openai.ChatCompletionMessage, sampling samplingParams, maxTokens, n int) (completion, error) {
+	req := openai.ChatCompletionRequest{
+		Model:            model,
+		Messages:         messages,
+		Temperature:      sampling.temperature,
+		MaxTokens:        maxTokens,
+		TopP:             sampling.topP,
+		FrequencyPenalty: sampling.frequencyPenalty,
+		PresencePenalty:  sampling.presencePenalty,
+		Stop:             p.stopSequences(false),
+		N:                n,
+	}
+	resp, err := p.gptClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return completion{}, err
+	}
+	p.metrics.tokensUsed(resp.Usage.TotalTokens)
+	if len(resp.Choices) == 0 {
+		slog.Error("OpenAI returned no completion choices", "response", resp)
+		return completion{}, errNoCompletionChoices
+	}
+
+	var alternatives []string
+	for _, choice := range resp.Choices[1:] {
+		alternatives = append(alternatives, choice.Message.Content)
+	}
+	return completion{
+		Text:         resp.Choices[0].Message.Content,
+		FinishReason: string(resp.Choices[0].FinishReason),
+		Alternatives: alternatives,
+		Tokens:       resp.Usage.CompletionTokens,
+		PromptTokens: resp.Usage.PromptTokens,
+		TotalTokens:  resp.Usage.TotalTokens,
+	}, nil
+}
+
+func (p *messageProcessor) completeText(ctx context.Context, model, prompt string, sampling samplingParams, maxTokens, n int) (completion, error) {
+	req := openai.CompletionRequest{
+		Model:            model,
+		Prompt:           prompt,
+		Temperature:      sampling.temperature,
+		MaxTokens:        maxTokens,
+		TopP:             sampling.topP,
+		FrequencyPenalty: sampling.frequencyPenalty,
+		PresencePenalty:  sampling.presencePenalty,
+		Stop:             p.stopSequences(true),
+		N:                n,
+	}
+	resp, err := p.gptClient.CreateCompletion(ctx, req)
+	if err != nil {
+		return completion{}, err
+	}
+	// Unlike the chat completion response, usage may be missing from the completion one
+	var usage openai.Usage
+	if resp.Usage != nil {
+		usage = *resp.Usage
+	}
+	p.metrics.tokensUsed(usage.TotalTokens)
+	if len(resp.Choices) == 0 {
+		slog.Error("OpenAI returned no completion choices", "response", resp)
+		return completion{}, errNoCompletionChoices
+	}
+
+	var alternatives []string
+	for _, choice := range resp.Choices[1:] {
+		alternatives = append(alternatives, stripCompletionPrefix(choice.Text))
+	}
+	return completion{
+		Text:         stripCompletionPrefix(resp.Choices[0].Text),
+		FinishReason: resp.Choices[0].FinishReason,
+		Alternatives: alternatives,
+		Tokens:       usage.CompletionTokens,
+		PromptTokens: usage.PromptTokens,
+		TotalTokens:  usage.TotalTokens,
+	}, nil
+}
+
+// withOpenAITimeout returns the context of a single request to OpenAI.
+func (p *messageProcessor) withOpenAITimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, p.openAITimeout)
+}
+
+// isOpenAITimeoutError reports whether the request to OpenAI failed because it took longer than the timeout,
+// rather than because ctx it was sent with is done.
+func isOpenAITimeoutError(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
+// retryDelay returns the delay before the next attempt: exponential backoff with jitter,
+// so that requests failed at the same time are not retried at the same time.
+func retryDelay(attempt int) time.Duration {
+	delay := openAIRetryDelay << (attempt - 1)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// isTransientOpenAIError reports whether the request failed because of rate limit or OpenAI server error,
+// so that it may succeed if sent again. Rate limit because of exhausted quota is not transient,
+// response without choices is, since it comes with partial outages.
+func isTransientOpenAIError(err error) bool {
+	if isInsufficientQuotaError(err) {
+		return false
+	}
+	if errors.Is(err, errNoCompletionChoices) {
+		return true
+	}
+
+	var statusCode int
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		statusCode = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		statusCode = reqErr.HTTPStatusCode
+	default:
+		return false
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// isContextLengthExceededError reports whether OpenAI rejected the request because the prompt doesn't fit into the model context.
+func isContextLengthExceededError(err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code, _ := apiErr.Code.(string)
+	return code == openAIErrorCodeContextLengthExceeded
+}
+
+// isInsufficientQuotaError reports whether OpenAI rejected the request because the account has no credits left.
+func isInsufficientQuotaError(err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code, _ := apiErr.Code.(string)
+	return apiErr.Type == openAIErrorCodeInsufficientQuota || code == openAIErrorCodeInsufficientQuota
+}
+
+// alertAdminOutOfCredits notifies the administrator that OpenAI account is out of credits.
+// The alert is sent once until the next successful completion.
+func (p *messageProcessor) alertAdminOutOfCredits() {
+	if p.adminUserID == 0 {
+		slog.Warn("there is no administrator to notify")
+		return
+	}
+	// Workers may run out of credits at the same time, only the first one alerts
+	if !p.outOfCreditsAlertSent.CompareAndSwap(false, true) {
+		return
+	}
+
+	// Private chat with the user has the same ID as the user
+	sendTextMessage(p.bot, int64(p.adminUserID), "", outOfCreditsAlertMessage)
+}
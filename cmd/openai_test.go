@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeOpenAI answers both chat completion and completion requests with the reply text.
+func fakeOpenAI(reply string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			json.NewEncoder(w).Encode(openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{chatChoice(reply, openai.FinishReasonStop)}})
+			return
+		}
+		json.NewEncoder(w).Encode(openai.CompletionResponse{Choices: []openai.CompletionChoice{{Text: reply, FinishReason: "stop"}}, Usage: &openai.Usage{}})
+	}
+}
+
+func TestCompletionPrefixIsStrippedOnCompletionPathOnly(t *testing.T) {
+	tests := []struct {
+		name          string
+		completionAPI bool
+		reply         string
+		want          string
+	}{
+		{name: "completion with prefix", completionAPI: true, reply: " AI: Hello!", want: "Hello!"},
+		{name: "completion without prefix", completionAPI: true, reply: " Hello!", want: "Hello!"},
+		{name: "chat reply with prefix", reply: "Assistant: is what I'm called.", want: "Assistant: is what I'm called."},
+		{name: "chat reply without prefix", reply: "Hello!", want: "Hello!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &messageProcessor{
+				gptClient:     newTestOpenAIClient(t, fakeOpenAI(tt.reply)),
+				model:         chatModel{name: openai.GPT3Dot5Turbo},
+				openAITimeout: time.Minute,
+			}
+			if tt.completionAPI {
+				p.model = chatModel{name: openai.GPT3TextDavinci003, completionAPI: true}
+			}
+			got, err := p.complete(context.Background(), "Hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyChoicesAreAnError(t *testing.T) {
+	ctx := context.Background()
+	// Completion response comes without usage too
+	p := &messageProcessor{gptClient: newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			json.NewEncoder(w).Encode(openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{}})
+			return
+		}
+		json.NewEncoder(w).Encode(openai.CompletionResponse{Choices: []openai.CompletionChoice{}})
+	})}
+
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello"}}
+	if _, err := p.completeChat(ctx, openai.GPT3Dot5Turbo, messages, defaultSamplingParams, 10, 1); err != errNoCompletionChoices {
+		t.Errorf("chat completion error = %v, want %v", err, errNoCompletionChoices)
+	}
+	if _, err := p.completeText(ctx, openai.GPT3TextDavinci003, "hello", defaultSamplingParams, 10, 1); err != errNoCompletionChoices {
+		t.Errorf("completion error = %v, want %v", err, errNoCompletionChoices)
+	}
+}
+
+func TestEmptyChoicesAreNotAnswered(t *testing.T) {
+	ctx := context.Background()
+	telegram := &fakeTelegram{}
+	p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+	var requests atomic.Int32
+	p.gptClient = newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{}})
+	})
+
+	p.processMessage(ctx, privateMessage(1, "hello"))
+
+	if got := telegram.last(); got != noCompletionMessage {
+		t.Errorf("reply = %q, want %q", got, noCompletionMessage)
+	}
+	// Empty choices may be due to the outage, so the request is retried
+	if got := requests.Load(); got != openAIAttempts {
+		t.Errorf("requests = %d, want %d", got, openAIAttempts)
+	}
+	// Message is left unanswered, so that the reply can be requested again with /retry
+	history, err := p.messages.History(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var human []string
+	for _, msg := range history {
+		if msg.isHuman() {
+			human = append(human, msg.Text)
+		}
+	}
+	if !equalStrings(human, []string{"hello"}) {
+		t.Errorf("human messages in the history = %q, want the unanswered one", human)
+	}
+}
+
+func TestParseStopSequences(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: defaultStopSequences},
+		{value: stopSequencesNone, want: nil},
+		{value: "\nUser:,\nBot:", want: []string{"\nUser:", "\nBot:"}},
+		// Spaces are part of the sequence, empty ones are skipped
+		{value: " Q:,, A:", want: []string{" Q:", " A:"}},
+		{value: "1,2,3,4,5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseStopSequences(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("stop sequences = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopSequencesOfModels(t *testing.T) {
+	tests := []struct {
+		name          string
+		stopSequences []string
+		model         string
+		want          []string
+	}{
+		{name: "chat model", stopSequences: defaultStopSequences, model: openai.GPT3Dot5Turbo},
+		{name: "completion model", stopSequences: defaultStopSequences, model: openai.GPT3TextDavinci003, want: defaultStopSequences},
+		{name: "configured for completion model", stopSequences: []string{"\nUser:"}, model: openai.GPT3TextDavinci003, want: []string{"\nUser:"}},
+		{name: "disabled for completion model", model: openai.GPT3TextDavinci003},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+			p.stopSequencesCompletion = tt.stopSequences
+			var (
+				mu   sync.Mutex
+				stop []string
+			)
+			p.gptClient = newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				// Both requests have the stop sequences in the same field
+				var req struct {
+					Stop []string `json:"stop"`
+				}
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &req)
+				mu.Lock()
+				stop = req.Stop
+				mu.Unlock()
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				fakeOpenAI("hi")(w, r)
+			})
+
+			// Model is switched the way the user does it, the configured one is a chat model
+			p.processMessage(ctx, commandMessage(1, "/model "+tt.model))
+			p.processMessage(ctx, privateMessage(1, "hello"))
+
+			if got := telegram.last(); got != "hi" {
+				t.Fatalf("reply = %q, want it answered", got)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !equalStrings(stop, tt.want) {
+				t.Errorf("stop sequences = %q, want %q", stop, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// writeRetryQueueSize is the number of exchanges waiting to be saved again, newer ones are lost when it is full.
+	writeRetryQueueSize = 100
+	writeRetryAttempts  = 5
+)
+
+// writeRetryDelay is the wait before each attempt to save the exchange again, tests shorten it.
+var writeRetryDelay = 10 * time.Second
+
+// The exchange is saved after the reply is generated, the human message together with the reply in one transaction,
+// so that the history doesn't end up with the half of it. If the database fails, the reply is sent anyway and
+// the exchange is saved again in the background, see retryWrites.
+
+// pendingWrite is the exchange that failed to be saved to the database.
+type pendingWrite struct {
+	messages []*dbMessage
+	tags     []string
+}
+
+// saveExchange saves the human message and the reply to it, returns false if the exchange is queued to be saved later.
+// The human message from the history, e.g. the one answered with /retry, is saved already and is left as is.
+func (p *messageProcessor) saveExchange(ctx context.Context, update tgbotapi.Update, humanMsg, aiMsg *dbMessage, tags []string) bool {
+	newHumanMsg := humanMsg.ID == 0
+	if err := p.messages.SaveAll(ctx, []*dbMessage{humanMsg, aiMsg}, tags); err != nil {
+		slog.Error("failed to save the exchange to the database, saving it later", "error", err)
+		p.queueWriteRetry(pendingWrite{messages: []*dbMessage{humanMsg, aiMsg}, tags: tags})
+		return false
+	}
+	if newHumanMsg {
+		p.rememberEditableMessage(humanMsg.OwnerID, update.Message.MessageID, humanMsg.ID)
+	}
+	return true
+}
+
+// saveUnansweredMessage saves the human message the reply to which failed, so that it can be requested again with /retry.
+func (p *messageProcessor) saveUnansweredMessage(ctx context.Context, update tgbotapi.Update, humanMsg *dbMessage, tags []string) {
+	if humanMsg.ID != 0 {
+		return
+	}
+	if err := p.messages.SaveAll(ctx, []*dbMessage{humanMsg}, tags); err != nil {
+		slog.Error("failed to save incoming message to the database", "error", err)
+		return
+	}
+	p.rememberEditableMessage(humanMsg.OwnerID, update.Message.MessageID, humanMsg.ID)
+}
+
+// queueWriteRetry queues the exchange to be saved again, the exchange is lost if the queue is full.
+func (p *messageProcessor) queueWriteRetry(write pendingWrite) {
+	select {
+	case p.writeRetries <- write:
+	default:
+		slog.Error("write retry queue is full, exchange is lost", "messages", len(write.messages))
+	}
+}
+
+// retryWrites saves the queued exchanges until ctx is cancelled, each one is given up after writeRetryAttempts.
+func (p *messageProcessor) retryWrites(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if n := len(p.writeRetries); n > 0 {
+				slog.Error("exchanges are not saved to the database on shutdown", "exchanges", n)
+			}
+			return
+		case write := <-p.writeRetries:
+			p.retryWrite(ctx, write)
+		}
+	}
+}
+
+func (p *messageProcessor) retryWrite(ctx context.Context, write pendingWrite) {
+	for attempt := 1; attempt <= writeRetryAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			slog.Error("exchange is not saved to the database on shutdown")
+			return
+		case <-time.After(writeRetryDelay):
+		}
+
+		err := p.messages.SaveAll(ctx, write.messages, write.tags)
+		if err == nil {
+			log.Printf("exchange is saved to the database on attempt %d\n", attempt)
+			return
+		}
+		slog.Warn("failed to save the exchange to the database", "attempt", attempt, "attempts", writeRetryAttempts, "error", err)
+	}
+	slog.Error("exchange is lost, failed to save it to the database")
+}
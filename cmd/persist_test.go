@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// failingMessageStore fails to save messages as many times as set, then saves them in memory.
+type failingMessageStore struct {
+	*memoryStore
+	failures int
+}
+
+func (s *failingMessageStore) SaveAll(ctx context.Context, msgs []*dbMessage, tags []string) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("database is locked")
+	}
+	return s.memoryStore.SaveAll(ctx, msgs, tags)
+}
+
+func TestExchangeIsSavedLaterWhenStoreFails(t *testing.T) {
+	delay := writeRetryDelay
+	writeRetryDelay = time.Millisecond
+	t.Cleanup(func() { writeRetryDelay = delay })
+
+	tests := []struct {
+		name      string
+		failures  int
+		queueSize int
+		// retry is whether the queued exchange is saved again.
+		retry       bool
+		wantQueued  int
+		wantHistory string
+	}{
+		{name: "saved at once", queueSize: 1, wantHistory: "hi,hello,the answer"},
+		{name: "queued when the store fails", failures: 1, queueSize: 1, wantQueued: 1, wantHistory: "hi"},
+		{name: "saved on retry", failures: 2, queueSize: 1, retry: true, wantQueued: 1, wantHistory: "hi,hello,the answer"},
+		{name: "lost after the attempts", failures: writeRetryAttempts + 1, queueSize: 1, retry: true, wantQueued: 1, wantHistory: "hi"},
+		{name: "lost when the queue is full", failures: 1, wantHistory: "hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("the answer", openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+			store := &failingMessageStore{memoryStore: newMemoryStore(), failures: tt.failures}
+			p.messages = store
+			// The conversation is started already, so that the opening message isn't saved with it
+			opening := &dbMessage{OwnerID: 1, Role: messageRoleAssistant, Text: "hi", CreatedAt: time.Now().Add(-time.Minute)}
+			if err := store.memoryStore.Save(context.Background(), opening); err != nil {
+				t.Fatal(err)
+			}
+			p.writeRetries = make(chan pendingWrite, tt.queueSize)
+
+			p.processMessage(context.Background(), privateMessage(1, "hello"))
+
+			if !strings.HasPrefix(telegram.last(), "the answer") {
+				t.Errorf("reply = %q, want it sent whether the exchange is saved or not", telegram.last())
+			}
+			if got := len(p.writeRetries); got != tt.wantQueued {
+				t.Errorf("queued exchanges = %d, want %d", got, tt.wantQueued)
+			}
+			if tt.retry {
+				p.retryWrite(context.Background(), <-p.writeRetries)
+			}
+			if got := historyTexts(t, store, 1, ""); got != tt.wantHistory {
+				t.Errorf("history = %q, want %q", got, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestSaveMessagesRollsBackHalfWrittenExchange(t *testing.T) {
+	tests := []struct {
+		name string
+		// trigger fails the insert, if it is set.
+		trigger     string
+		humanSaved  bool
+		wantErr     bool
+		wantHistory string
+	}{
+		{name: "exchange is saved", wantHistory: "hello,reply"},
+		{
+			name:    "human message is rolled back when reply fails",
+			trigger: `CREATE TRIGGER fail_reply BEFORE INSERT ON chat_history WHEN NEW.message = 'reply' BEGIN SELECT RAISE(ABORT, 'disk is full'); END`,
+			wantErr: true,
+		},
+		{
+			name:    "messages are rolled back when tag fails",
+			trigger: `CREATE TRIGGER fail_tag BEFORE INSERT ON message_tags BEGIN SELECT RAISE(ABORT, 'disk is full'); END`,
+			wantErr: true,
+		},
+		{
+			name:        "human message saved before is kept when reply fails",
+			trigger:     `CREATE TRIGGER fail_reply BEFORE INSERT ON chat_history WHEN NEW.message = 'reply' BEGIN SELECT RAISE(ABORT, 'disk is full'); END`,
+			humanSaved:  true,
+			wantErr:     true,
+			wantHistory: "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDB(t)
+			store := newSQLStore(db)
+			start := time.Now().Add(-time.Minute)
+			humanMsg := &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "hello", CreatedAt: start}
+			aiMsg := &dbMessage{OwnerID: 1, Role: messageRoleAssistant, Text: "reply", CreatedAt: start.Add(time.Second)}
+			if tt.humanSaved {
+				if err := store.Save(ctx, humanMsg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			humanID := humanMsg.ID
+			if tt.trigger != "" {
+				if _, err := db.ExecContext(ctx, tt.trigger); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := store.SaveAll(ctx, []*dbMessage{humanMsg, aiMsg}, []string{"work"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := historyTexts(t, store, 1, ""); got != tt.wantHistory {
+				t.Errorf("history = %q, want %q", got, tt.wantHistory)
+			}
+			if tt.wantErr && (humanMsg.ID != humanID || aiMsg.ID != 0) {
+				t.Errorf("IDs are %d and %d after rollback, want %d and 0", humanMsg.ID, aiMsg.ID, humanID)
+			}
+		})
+	}
+}
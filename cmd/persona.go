@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	personaReset = "reset"
+
+	personaLengthMax = 2000
+)
+
+// loadPersona returns the default persona of the assistant: the contents of the file if its path is given,
+// otherwise the text, otherwise the built-in one.
+func loadPersona(text, filePath string) (string, error) {
+	if filePath != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		text = string(data)
+		if strings.TrimSpace(text) == "" {
+			return "", fmt.Errorf("file '%v' is empty", filePath)
+		}
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return gptSystemPrompt, nil
+	}
+	return text, nil
+}
+
+// userPersona returns the persona the user has set with /persona, or the default one.
+func (p *messageProcessor) userPersona(ctx context.Context, userID int) (string, error) {
+	persona, err := p.settings.UserPersona(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if persona == "" {
+		return p.persona, nil
+	}
+	return persona, nil
+}
+
+// handlePersonaCommand sets the persona of the assistant for the user, e.g. /persona You are a pirate.
+// /persona reset reverts to the default persona, /persona on|off turns the persona section on or off in the chat.
+func (p *messageProcessor) handlePersonaCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+	text := strings.TrimSpace(update.Message.CommandArguments())
+
+	switch strings.ToLower(text) {
+	case "", promptSectionOn, promptSectionOff:
+		p.handlePromptSectionCommand(ctx, update, parseMode, promptSectionPersona)
+		return
+	case personaReset:
+		if err := p.settings.DeleteUserPersona(ctx, userID); err != nil {
+			slog.Error("failed to reset user persona", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, parseMode, "Persona is reset to the default one.")
+		return
+	}
+
+	if len([]rune(text)) > personaLengthMax {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Persona is too long, at most %d characters are allowed.", personaLengthMax))
+		return
+	}
+
+	if err := p.settings.SaveUserPersona(ctx, userID, text, time.Now()); err != nil {
+		slog.Error("failed to save user persona", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+	sendTextMessage(p.bot, chatID, parseMode, "Persona is set. Use /persona reset to revert to the default one.")
+}
+
+// getUserPersona returns the persona set by the user, or empty string if there is none.
+func getUserPersona(ctx context.Context, db *sql.DB, userID int) (string, error) {
+	const query = `
+		SELECT prompt FROM user_personas WHERE user_id = ?
+	`
+
+	var persona string
+	if err := db.QueryRowContext(ctx, query, userID).Scan(&persona); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get user persona from the database: %w", err)
+	}
+	return persona, nil
+}
+
+func saveUserPersona(ctx context.Context, db *sql.DB, userID int, persona string, createdAt time.Time) error {
+	const query = `
+		INSERT INTO user_personas(user_id, prompt, created_at)
+		VALUES(?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET prompt = excluded.prompt, created_at = excluded.created_at
+	`
+
+	if _, err := db.ExecContext(ctx, query, userID, persona, createdAt.UnixMilli()); err != nil {
+		return fmt.Errorf("failed to save user persona to the database: %w", err)
+	}
+	return nil
+}
+
+func deleteUserPersona(ctx context.Context, db *sql.DB, userID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_personas WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete user persona from database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// postgresMigrationsDirName is the directory with PostgreSQL migrations inside the SQLite migrations directory,
+// PostgreSQL schema starts from the current SQLite schema instead of repeating its history.
+const postgresMigrationsDirName = "postgres"
+
+// postgresConnector opens PostgreSQL connections that accept queries with ? placeholders,
+// so that the same queries are used with SQLite and PostgreSQL.
+type postgresConnector struct {
+	connector *pq.Connector
+}
+
+func newPostgresConnector(dsn string) (*postgresConnector, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresConnector{connector: connector}, nil
+}
+
+func (c *postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresConn{conn: conn}, nil
+}
+
+func (c *postgresConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// postgresConn rewrites placeholders of the queries, pq connection implements all optional interfaces used here.
+type postgresConn struct {
+	conn driver.Conn
+}
+
+func (c *postgresConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(rebindPlaceholders(query))
+}
+
+func (c *postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, rebindPlaceholders(query))
+}
+
+func (c *postgresConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *postgresConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *postgresConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *postgresConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.conn.(driver.ExecerContext).ExecContext(ctx, rebindPlaceholders(query), args)
+}
+
+func (c *postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.conn.(driver.QueryerContext).QueryContext(ctx, rebindPlaceholders(query), args)
+}
+
+// rebindPlaceholders replaces ? placeholders outside of string literals with numbered $1, $2, ... ones.
+func rebindPlaceholders(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var (
+		b        strings.Builder
+		n        int
+		inString bool
+	)
+	b.Grow(len(query) + 8)
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
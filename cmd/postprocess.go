@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// responseProcessor rewrites the model reply before it is sent to the user.
+type responseProcessor func(text string) string
+
+// responseProcessorOptions configure built-in response processors.
+type responseProcessorOptions struct {
+	disclaimer     string
+	profanityWords []string
+}
+
+// responseProcessors are built-in response processors, they are enabled via RESPONSE_PROCESSORS
+// as a comma-separated list and applied in the listed order.
+var responseProcessors = map[string]func(opts responseProcessorOptions) (responseProcessor, error){
+	"links":      newLinksProcessor,
+	"profanity":  newProfanityProcessor,
+	"disclaimer": newDisclaimerProcessor,
+}
+
+// responseProcessorChain applies response processors one after another. Empty chain leaves the reply as is.
+type responseProcessorChain []responseProcessor
+
+func newResponseProcessorChain(names string, opts responseProcessorOptions) (responseProcessorChain, error) {
+	var chain responseProcessorChain
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		newProcessor, ok := responseProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response processor '%v'", name)
+		}
+		processor, err := newProcessor(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create response processor '%v': %w", name, err)
+		}
+		chain = append(chain, processor)
+	}
+	return chain, nil
+}
+
+func (c responseProcessorChain) process(text string) string {
+	for _, processor := range c {
+		text = processor(text)
+	}
+	return text
+}
+
+var (
+	linkRegexp = regexp.MustCompile(`https?://\S+`)
+
+	// trackingQueryParams are removed from links, along with any utm_* parameter.
+	trackingQueryParams = map[string]bool{"fbclid": true, "gclid": true, "yclid": true, "mc_eid": true}
+)
+
+// newLinksProcessor removes tracking parameters from links in the reply.
+func newLinksProcessor(responseProcessorOptions) (responseProcessor, error) {
+	return func(text string) string {
+		return linkRegexp.ReplaceAllStringFunc(text, func(link string) string {
+			// Punctuation right after the link most likely belongs to the sentence
+			trimmed := strings.TrimRight(link, ".,;:!?)]'\"")
+			u, err := url.Parse(trimmed)
+			if err != nil || u.RawQuery == "" {
+				return link
+			}
+
+			query := u.Query()
+			removed := false
+			for param := range query {
+				if strings.HasPrefix(param, "utm_") || trackingQueryParams[param] {
+					query.Del(param)
+					removed = true
+				}
+			}
+			if !removed {
+				return link
+			}
+
+			u.RawQuery = query.Encode()
+			return u.String() + link[len(trimmed):]
+		})
+	}, nil
+}
+
+// newProfanityProcessor masks the configured words with asterisks, words are matched as a whole ignoring case.
+func newProfanityProcessor(opts responseProcessorOptions) (responseProcessor, error) {
+	words := make([]string, 0, len(opts.profanityWords))
+	for _, word := range opts.profanityWords {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) == 0 {
+		return nil, errors.New("no words to mask are configured")
+	}
+
+	// \b matches only ASCII word boundaries, so boundaries are checked by isWordBoundary
+	wordsRegexp, err := regexp.Compile(`(?i)(` + strings.Join(words, "|") + `)`)
+	if err != nil {
+		return nil, err
+	}
+	return func(text string) string {
+		var masked strings.Builder
+		last := 0
+		for _, match := range wordsRegexp.FindAllStringIndex(text, -1) {
+			start, end := match[0], match[1]
+			if !isWordBoundary(text, start) || !isWordBoundary(text, end) {
+				continue
+			}
+			masked.WriteString(text[last:start])
+			masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[start:end])))
+			last = end
+		}
+		masked.WriteString(text[last:])
+		return masked.String()
+	}, nil
+}
+
+// isWordBoundary reports whether the text is split between words at the byte offset.
+func isWordBoundary(text string, offset int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:offset])
+	after, _ := utf8.DecodeRuneInString(text[offset:])
+	return isWordRune(before) != isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// newDisclaimerProcessor appends the configured disclaimer to the reply.
+func newDisclaimerProcessor(opts responseProcessorOptions) (responseProcessor, error) {
+	disclaimer := strings.TrimSpace(opts.disclaimer)
+	if disclaimer == "" {
+		return nil, errors.New("disclaimer text is not configured")
+	}
+	return func(text string) string {
+		return text + "\n\n" + disclaimer
+	}, nil
+}
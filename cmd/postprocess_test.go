@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestResponseProcessorChainOrder(t *testing.T) {
+	opts := responseProcessorOptions{disclaimer: "Don't trust darn robots.", profanityWords: []string{"darn"}}
+
+	tests := []struct {
+		names string
+		want  string
+	}{
+		{names: "", want: "It's a darn good question."},
+		// The disclaimer is appended after masking, so its words are kept
+		{names: "profanity,disclaimer", want: "It's a **** good question.\n\nDon't trust darn robots."},
+		{names: " disclaimer , profanity ", want: "It's a **** good question.\n\nDon't trust **** robots."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.names, func(t *testing.T) {
+			chain, err := newResponseProcessorChain(tt.names, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chain.process("It's a darn good question."); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResponseProcessorChainErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		names string
+	}{
+		{name: "unknown processor", names: "links,emoji"},
+		{name: "disclaimer without text", names: "disclaimer"},
+		{name: "profanity without words", names: "profanity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newResponseProcessorChain(tt.names, responseProcessorOptions{profanityWords: []string{" "}}); err == nil {
+				t.Error("error is nil")
+			}
+		})
+	}
+}
+
+func TestLinksProcessor(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "tracking parameters are removed",
+			text: "See https://example.com/a?utm_source=x&id=1&fbclid=2 for details",
+			want: "See https://example.com/a?id=1 for details",
+		},
+		{
+			name: "punctuation after the link is kept",
+			text: "Read it (https://example.com/?gclid=1).",
+			want: "Read it (https://example.com/).",
+		},
+		{
+			name: "link without tracking parameters is kept as is",
+			text: "Go to https://example.com/?b=2&a=1!",
+			want: "Go to https://example.com/?b=2&a=1!",
+		},
+		{name: "text without links", text: "utm_source=x", want: "utm_source=x"},
+	}
+	process, err := newLinksProcessor(responseProcessorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := process(tt.text); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfanityProcessor(t *testing.T) {
+	process, err := newProfanityProcessor(responseProcessorOptions{profanityWords: []string{"heck", "чёрт", "a.b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "What the HECK", want: "What the ****"},
+		{text: "Чёрт возьми", want: "**** возьми"},
+		// Only whole words are masked and words are not patterns
+		{text: "Checking heckle and axb", want: "Checking heckle and axb"},
+		{text: "a.b and heck.", want: "*** and ****."},
+		{text: "heck_heck heck heck", want: "heck_heck **** ****"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := process(tt.text); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
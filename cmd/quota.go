@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const dailyMessageCountDayLayout = "2006-01-02"
+
+// remainingDailyMessages returns how many messages the user can still send today.
+// Daily quota is reset at midnight UTC.
+func (p *messageProcessor) remainingDailyMessages(ctx context.Context, userID int) (int, error) {
+	count, err := p.activity.DailyMessageCount(ctx, userID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return p.dailyMessageLimit - count, nil
+}
+
+func dailyLimitReachedMessage(limit int) string {
+	return fmt.Sprintf("You have reached the daily limit of %d messages. The limit is reset at midnight UTC.", limit)
+}
+
+func getDailyMessageCount(ctx context.Context, db *sql.DB, userID int, now time.Time) (int, error) {
+	const query = `
+		SELECT count FROM daily_message_counts WHERE user_id = ? AND day = ?
+	`
+
+	var count int
+	if err := db.QueryRowContext(ctx, query, userID, now.UTC().Format(dailyMessageCountDayLayout)).Scan(&count); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get daily message count from the database: %w", err)
+	}
+	return count, nil
+}
+
+func incrementDailyMessageCount(ctx context.Context, db *sql.DB, userID int, now time.Time) error {
+	const query = `
+		INSERT INTO daily_message_counts(user_id, day, count)
+		VALUES(?, ?, 1)
+		ON CONFLICT(user_id, day) DO UPDATE SET count = daily_message_counts.count + 1
+	`
+
+	if _, err := db.ExecContext(ctx, query, userID, now.UTC().Format(dailyMessageCountDayLayout)); err != nil {
+		return fmt.Errorf("failed to update daily message count in the database: %w", err)
+	}
+	return nil
+}
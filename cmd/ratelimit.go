@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitWindow = time.Minute
+
+	rateLimitedMessage = "You're sending messages too quickly, please wait a minute and try again."
+)
+
+// rateLimiter limits how many messages each user may send within a sliding window.
+// The state is kept in memory, since there is a single process answering messages.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	sent   map[int][]time.Time
+	// nextSweep is when the users with empty windows are forgotten next, see sweep.
+	nextSweep time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		sent:   make(map[int][]time.Time),
+	}
+}
+
+// allow reports whether the user may send another message now and counts it if so.
+// Nil limiter allows everything.
+func (l *rateLimiter) allow(userID int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	sent := l.inWindow(l.sent[userID], now)
+	if len(sent) >= l.limit {
+		l.sent[userID] = sent
+		return false
+	}
+	l.sent[userID] = append(sent, now)
+	return true
+}
+
+// sweep forgets the users whose windows are empty, once per window, so that the users who stopped
+// sending messages aren't kept in memory forever.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = now.Add(l.window)
+	for userID, sent := range l.sent {
+		if len(l.inWindow(sent, now)) == 0 {
+			delete(l.sent, userID)
+		}
+	}
+}
+
+// inWindow returns the times of the messages within the window that ends now.
+// Times are in order, so the ones outside of the window are in the beginning.
+func (l *rateLimiter) inWindow(sent []time.Time, now time.Time) []time.Time {
+	start := 0
+	for start < len(sent) && !sent[start].After(now.Add(-l.window)) {
+		start++
+	}
+	return sent[start:]
+}
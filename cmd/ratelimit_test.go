@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	type message struct {
+		userID int
+		after  time.Duration
+	}
+	tests := []struct {
+		name     string
+		messages []message
+		want     []bool
+		// wantUsers is the number of users remembered after the messages.
+		wantUsers int
+	}{
+		{
+			name:      "messages within the limit",
+			messages:  []message{{1, 0}, {1, time.Second}},
+			want:      []bool{true, true},
+			wantUsers: 1,
+		},
+		{
+			name:      "message over the limit",
+			messages:  []message{{1, 0}, {1, time.Second}, {1, 2 * time.Second}},
+			want:      []bool{true, true, false},
+			wantUsers: 1,
+		},
+		{
+			name:      "limit is per user",
+			messages:  []message{{1, 0}, {1, time.Second}, {2, 2 * time.Second}},
+			want:      []bool{true, true, true},
+			wantUsers: 2,
+		},
+		{
+			name:      "window slides",
+			messages:  []message{{1, 0}, {1, time.Second}, {1, time.Minute + time.Second/2}},
+			want:      []bool{true, true, true},
+			wantUsers: 1,
+		},
+		{
+			name:      "user with empty window is forgotten",
+			messages:  []message{{1, 0}, {2, 2 * time.Minute}},
+			want:      []bool{true, true},
+			wantUsers: 1,
+		},
+		{
+			name:      "only users with empty windows are forgotten",
+			messages:  []message{{1, 0}, {1, 0}, {1, 0}, {2, time.Minute / 2}, {3, time.Minute + time.Second}},
+			want:      []bool{true, true, false, true, true},
+			wantUsers: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(2, time.Minute)
+			for i, msg := range tt.messages {
+				if got := l.allow(msg.userID, start.Add(msg.after)); got != tt.want[i] {
+					t.Errorf("message %d of user %d is allowed = %v, want %v", i+1, msg.userID, got, tt.want[i])
+				}
+			}
+			if got := len(l.sent); got != tt.wantUsers {
+				t.Errorf("remembered users = %d, want %d", got, tt.wantUsers)
+			}
+		})
+	}
+}
+
+func TestNilRateLimiterAllowsEverything(t *testing.T) {
+	var l *rateLimiter
+	for i := 0; i < 3; i++ {
+		if !l.allow(1, time.Now()) {
+			t.Fatal("message is not allowed")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	ratingUp   = "up"
+	ratingDown = "down"
+
+	// ratingCallbackPrefix starts the callback data of rating buttons, followed by the message ID and the rating.
+	ratingCallbackPrefix = "rate:"
+
+	ratingSavedMessage    = "Thank you for your feedback!"
+	ratingNotFoundMessage = "This reply is no longer in the conversation history."
+)
+
+// ratingKeyboard returns the buttons to rate the reply saved with the message ID.
+func ratingKeyboard(messageID int) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("👍", ratingCallbackData(messageID, ratingUp)),
+		tgbotapi.NewInlineKeyboardButtonData("👎", ratingCallbackData(messageID, ratingDown)),
+	))
+}
+
+func ratingCallbackData(messageID int, rating string) string {
+	return ratingCallbackPrefix + strconv.Itoa(messageID) + ":" + rating
+}
+
+// parseRatingCallbackData returns the message ID and the rating of the rating button, false if it is not one.
+func parseRatingCallbackData(data string) (int, string, bool) {
+	if !strings.HasPrefix(data, ratingCallbackPrefix) {
+		return 0, "", false
+	}
+	id, rating, ok := strings.Cut(strings.TrimPrefix(data, ratingCallbackPrefix), ":")
+	if !ok || (rating != ratingUp && rating != ratingDown) {
+		return 0, "", false
+	}
+	messageID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, "", false
+	}
+	return messageID, rating, true
+}
+
+// handleCallbackQuery handles the press of an inline keyboard button, the spinner on the button is cleared either way.
+func (p *messageProcessor) handleCallbackQuery(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	messageID, rating, ok := parseRatingCallbackData(query.Data)
+	if !ok {
+		p.answerCallbackQuery(query, "")
+		return
+	}
+
+	// Reply is rated in the conversation it belongs to, the same as the one the button is pressed in
+	ownerID := query.From.ID
+	if query.Message != nil && isGroupChat(query.Message.Chat) {
+		ownerID = int(query.Message.Chat.ID)
+	}
+	found, err := p.messages.Rate(ctx, ownerID, messageID, rating)
+	if err != nil {
+		slog.Error("failed to save reply rating", "error", err)
+		p.answerCallbackQuery(query, "")
+		return
+	}
+	if !found {
+		p.answerCallbackQuery(query, ratingNotFoundMessage)
+		return
+	}
+	p.answerCallbackQuery(query, ratingSavedMessage)
+}
+
+func (p *messageProcessor) answerCallbackQuery(query *tgbotapi.CallbackQuery, text string) {
+	if _, err := p.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		slog.Error("failed to answer callback query", "error", err)
+	}
+}
+
+// saveMessageRating rates the reply of the conversation, returns false if there is no such reply.
+// The rating of the reply rated before is replaced.
+func saveMessageRating(ctx context.Context, db *sql.DB, ownerID, messageID int, rating string) (bool, error) {
+	const query = `
+		UPDATE chat_history SET rating = ? WHERE id = ? AND owner_id = ? AND role = ?
+	`
+
+	res, err := db.ExecContext(ctx, query, rating, messageID, ownerID, messageRoleAssistant)
+	if err != nil {
+		return false, fmt.Errorf("failed to save message rating to the database: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to save message rating to the database: %w", err)
+	}
+	return n > 0, nil
+}
+
+// getRatingStats returns the numbers of replies rated up and down, see approvalRate.
+func getRatingStats(ctx context.Context, db *sql.DB) (up, down int, err error) {
+	const query = `
+		SELECT
+			COALESCE(SUM(CASE WHEN rating = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN rating = ? THEN 1 ELSE 0 END), 0)
+		FROM chat_history
+		WHERE rating IS NOT NULL
+	`
+
+	if err := db.QueryRowContext(ctx, query, ratingUp, ratingDown).Scan(&up, &down); err != nil {
+		return 0, 0, fmt.Errorf("failed to get rating statistics from the database: %w", err)
+	}
+	return up, down, nil
+}
+
+// approvalRate returns the percentage of good ratings, zero if there are none.
+func approvalRate(good, bad int) float64 {
+	if good+bad == 0 {
+		return 0
+	}
+	return 100 * float64(good) / float64(good+bad)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const nothingToRetryMessage = "There is nothing to retry, my last message is already a reply."
+
+// handleRetryCommand regenerates the reply to the last human message if it was left unanswered, e.g. due to an error.
+func (p *messageProcessor) handleRetryCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+
+	focus, err := p.settings.ChatSetting(ctx, chatID, chatSettingFocus)
+	if err != nil {
+		slog.Error("failed to get chat focus", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	history, err := p.messages.History(ctx, conversationOwnerID(update.Message), focus)
+	if err != nil {
+		slog.Error("failed to get conversation history from the database", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	if len(history) == 0 || !history[len(history)-1].isHuman() {
+		sendTextMessage(p.bot, chatID, parseMode, nothingToRetryMessage)
+		return
+	}
+	humanMsg := history[len(history)-1]
+
+	log.Println("retrying reply to message", humanMsg.ID)
+
+	// The /code command is not saved, only the request worded as asking for code is answered in code mode again
+	if _, ok := codeQuestion(humanMsg.Text); ok {
+		ctx = withCodeMode(ctx)
+	}
+
+	prompt, err := p.buildPromptWithHistory(ctx, chatID, focus, history[:len(history)-1], humanMsg)
+	if errors.Is(err, errPromptTooLong) {
+		slog.Warn("prompt doesn't fit into the model context")
+		sendTextMessage(p.bot, chatID, parseMode, promptTooLongMessage)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to build prompt", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	p.reply(ctx, update, parseMode, humanMsg, prompt, appendTag(parseTags(humanMsg.Text), focus))
+}
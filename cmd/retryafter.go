@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// defaultOpenAIRetryMaxWait caps the wait before the retry that OpenAI asks for, the reply is late already.
+const defaultOpenAIRetryMaxWait = 30 * time.Second
+
+// OpenAI tells how long to wait before the failed request may succeed in the response headers, which are not
+// passed on with the error. The HTTP client of the OpenAI client records the wait for the request sent with
+// withRetryAfter, so that the retry is sent when OpenAI is ready for it instead of after the backoff.
+
+type retryAfterKey struct{}
+
+// withRetryAfter returns the context of the request to OpenAI, wait is set to the wait OpenAI asks for if it fails.
+func withRetryAfter(ctx context.Context, wait *time.Duration) context.Context {
+	return context.WithValue(ctx, retryAfterKey{}, wait)
+}
+
+// retryAfterRecorder is the HTTP client that records the wait before retrying the failed request, see withRetryAfter.
+type retryAfterRecorder struct {
+	client openai.HTTPDoer
+}
+
+func (r retryAfterRecorder) Do(req *http.Request) (*http.Response, error) {
+	resp, err := r.client.Do(req)
+	if err != nil || resp.StatusCode < http.StatusBadRequest {
+		return resp, err
+	}
+	if wait, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*wait = parseRetryAfter(resp.Header, time.Now())
+	}
+	return resp, err
+}
+
+// parseRetryAfter returns the wait the response headers ask for, zero if there is none. Retry-After is given
+// in seconds or as the date, rate limit reset headers of OpenAI as durations, e.g. "6m0s", the longest one is waited.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.Atoi(header.Get("Retry-After-Ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil && date.After(now) {
+			return date.Sub(now)
+		}
+	}
+
+	var wait time.Duration
+	for _, name := range []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens"} {
+		if d, err := time.ParseDuration(header.Get(name)); err == nil {
+			wait = max(wait, d)
+		}
+	}
+	return wait
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeTransport answers the requests of the OpenAI client with the responses in order, the last one repeated.
+type fakeTransport struct {
+	responses []fakeResponse
+	requests  int
+}
+
+type fakeResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func (f *fakeTransport) Do(req *http.Request) (*http.Response, error) {
+	resp := f.responses[min(f.requests, len(f.responses)-1)]
+	f.requests++
+	header := http.Header{"Content-Type": {"application/json"}}
+	for name, values := range resp.header {
+		header[name] = values
+	}
+	return &http.Response{
+		StatusCode: resp.status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(resp.body)),
+		Request:    req,
+	}, nil
+}
+
+const rateLimitedBody = `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`
+
+func chatReplyBody(t *testing.T, reply string) string {
+	t.Helper()
+
+	body, err := json.Marshal(openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{chatChoice(reply, openai.FinishReasonStop)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "seconds", header: http.Header{"Retry-After": {"7"}}, want: 7 * time.Second},
+		{name: "date", header: http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}, want: 90 * time.Second},
+		{name: "date in the past", header: http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}},
+		{name: "milliseconds win over seconds", header: http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"7"}}, want: 250 * time.Millisecond},
+		{name: "longest rate limit reset", header: http.Header{"X-Ratelimit-Reset-Requests": {"1s"}, "X-Ratelimit-Reset-Tokens": {"6m0s"}}, want: 6 * time.Minute},
+		{name: "invalid", header: http.Header{"Retry-After": {"soon"}}},
+		{name: "none", header: http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("parseRetryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterRecorder(t *testing.T) {
+	tests := []struct {
+		name     string
+		response fakeResponse
+		want     time.Duration
+	}{
+		{name: "rate limited", response: fakeResponse{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"2"}}}, want: 2 * time.Second},
+		{name: "server error", response: fakeResponse{status: http.StatusServiceUnavailable, header: http.Header{"Retry-After-Ms": {"300"}}}, want: 300 * time.Millisecond},
+		// Wait of the successful response is nothing to retry after
+		{name: "succeeded", response: fakeResponse{status: http.StatusOK, header: http.Header{"Retry-After": {"2"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := retryAfterRecorder{client: &fakeTransport{responses: []fakeResponse{tt.response}}}
+			var wait time.Duration
+			req, err := http.NewRequestWithContext(withRetryAfter(context.Background(), &wait), http.MethodPost, "http://openai.test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := recorder.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if wait != tt.want {
+				t.Errorf("recorded wait = %v, want %v", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryIsSentAfterRequestedWait(t *testing.T) {
+	const requestedWait = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		maxWait time.Duration
+		want    time.Duration
+	}{
+		{name: "wait asked for", header: http.Header{"Retry-After-Ms": {"50"}}, maxWait: time.Minute, want: requestedWait},
+		{name: "long wait is capped", header: http.Header{"Retry-After": {"60"}}, maxWait: requestedWait, want: requestedWait},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &fakeTransport{responses: []fakeResponse{
+				{status: http.StatusTooManyRequests, header: tt.header, body: rateLimitedBody},
+				{status: http.StatusOK, body: chatReplyBody(t, "hi")},
+			}}
+			cfg := openai.DefaultConfig("key")
+			cfg.HTTPClient = retryAfterRecorder{client: transport}
+			p := newTestProcessor(t, &fakeTelegram{}, &fakeChatCompletions{})
+			p.gptClient = openai.NewClientWithConfig(cfg)
+			p.openAIRetryMaxWait = tt.maxWait
+
+			start := time.Now()
+			got, err := p.complete(context.Background(), "hello")
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "hi" || transport.requests != 2 {
+				t.Errorf("completion = %q after %d requests, want %q after the retry", got, transport.requests, "hi")
+			}
+			// Backoff without the wait is at least half of openAIRetryDelay
+			if elapsed < tt.want || elapsed >= openAIRetryDelay/2 {
+				t.Errorf("retried after %v, want after %v", elapsed, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeSender fails the sends with the errors in order, then sends the messages.
+type fakeSender struct {
+	errs  []error
+	calls int
+	sent  []string
+	// parseModes are the parse modes of all sends, the failed ones too.
+	parseModes []string
+}
+
+func (s *fakeSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s.calls++
+	s.parseModes = append(s.parseModes, c.(tgbotapi.MessageConfig).ParseMode)
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return tgbotapi.Message{}, err
+	}
+	s.sent = append(s.sent, c.(tgbotapi.MessageConfig).Text)
+	return tgbotapi.Message{}, nil
+}
+
+// tooManyRequests is the error of Telegram rate limiting the bot for the seconds.
+func tooManyRequests(seconds int) error {
+	return tgbotapi.Error{
+		Message:            "Too Many Requests: retry after " + time.Duration(seconds*int(time.Second)).String(),
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: seconds},
+	}
+}
+
+func TestSendMessageRetriesAfterRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		errs    []error
+		timeout time.Duration
+		// wantCalls is the number of sends, wantSent is whether the message is delivered in the end.
+		wantCalls int
+		wantSent  bool
+		wantWait  time.Duration
+	}{
+		{name: "sent at once", wantCalls: 1, wantSent: true},
+		{name: "sent after the wait", errs: []error{tooManyRequests(1)}, wantCalls: 2, wantSent: true, wantWait: time.Second},
+		{
+			name:      "given up after the retries",
+			errs:      []error{tooManyRequests(1), tooManyRequests(1), tooManyRequests(1)},
+			wantCalls: telegramSendRetries + 1,
+			wantWait:  telegramSendRetries * time.Second,
+		},
+		{name: "wait longer than allowed is not waited", errs: []error{tooManyRequests(int(telegramRetryAfterMax/time.Second) + 1)}, wantCalls: 1},
+		{name: "wait is cancelled with the context", errs: []error{tooManyRequests(30)}, timeout: 50 * time.Millisecond, wantCalls: 1},
+		{name: "other error is not retried", errs: []error{errors.New("chat not found")}, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			sender := &fakeSender{errs: tt.errs}
+
+			start := time.Now()
+			sendMessage(ctx, sender, tgbotapi.NewMessage(1, "hello"))
+			elapsed := time.Since(start)
+
+			if sender.calls != tt.wantCalls {
+				t.Errorf("sends = %d, want %d", sender.calls, tt.wantCalls)
+			}
+			if sent := len(sender.sent) == 1; sent != tt.wantSent {
+				t.Errorf("message is sent = %v, want %v", sent, tt.wantSent)
+			}
+			if elapsed < tt.wantWait || elapsed > tt.wantWait+time.Second {
+				t.Errorf("sending took %v, want about %v", elapsed, tt.wantWait)
+			}
+		})
+	}
+}
+
+// cantParseEntities is the error of Telegram rejecting the message with malformed formatting.
+var cantParseEntities = tgbotapi.Error{Message: "Bad Request: can't parse entities: can't find end of the entity starting at byte offset 5"}
+
+func TestSendMessageFallsBackToSimplerParseMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		parseMode string
+		errs      []error
+		// wantParseModes are the parse modes the message is sent with, wantSent is whether it is delivered in the end.
+		wantParseModes []string
+		wantSent       bool
+	}{
+		{name: "parsed", parseMode: tgbotapi.ModeMarkdown, wantParseModes: []string{tgbotapi.ModeMarkdown}, wantSent: true},
+		{
+			name:           "Markdown falls back to plain text",
+			parseMode:      tgbotapi.ModeMarkdown,
+			errs:           []error{cantParseEntities},
+			wantParseModes: []string{tgbotapi.ModeMarkdown, ""},
+			wantSent:       true,
+		},
+		{
+			name:           "MarkdownV2 falls back to Markdown",
+			parseMode:      telegramParseModeMarkdownV2,
+			errs:           []error{cantParseEntities},
+			wantParseModes: []string{telegramParseModeMarkdownV2, tgbotapi.ModeMarkdown},
+			wantSent:       true,
+		},
+		{
+			name:           "MarkdownV2 falls back down to plain text",
+			parseMode:      telegramParseModeMarkdownV2,
+			errs:           []error{cantParseEntities, cantParseEntities},
+			wantParseModes: []string{telegramParseModeMarkdownV2, tgbotapi.ModeMarkdown, ""},
+			wantSent:       true,
+		},
+		{name: "HTML falls back to plain text", parseMode: tgbotapi.ModeHTML, errs: []error{cantParseEntities}, wantParseModes: []string{tgbotapi.ModeHTML, ""}, wantSent: true},
+		{name: "plain text is not sent again", errs: []error{cantParseEntities}, wantParseModes: []string{""}},
+		{name: "other error is not sent again", parseMode: tgbotapi.ModeMarkdown, errs: []error{tgbotapi.Error{Message: "Bad Request: chat not found"}}, wantParseModes: []string{tgbotapi.ModeMarkdown}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{errs: tt.errs}
+			msg := tgbotapi.NewMessage(1, "*bold")
+			msg.ParseMode = tt.parseMode
+
+			sendMessage(context.Background(), sender, msg)
+
+			if !equalStrings(sender.parseModes, tt.wantParseModes) {
+				t.Errorf("parse modes = %q, want %q", sender.parseModes, tt.wantParseModes)
+			}
+			if sent := len(sender.sent) == 1 && sender.sent[0] == "*bold"; sent != tt.wantSent {
+				t.Errorf("message is sent = %v, want %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTelegramRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantWait time.Duration
+		wantOk   bool
+	}{
+		{name: "rate limit", err: tooManyRequests(5), wantWait: 5 * time.Second, wantOk: true},
+		{name: "wrapped rate limit", err: errors.Join(errors.New("send"), tooManyRequests(2)), wantWait: 2 * time.Second, wantOk: true},
+		{name: "too long wait", err: tooManyRequests(3600), wantWait: time.Hour, wantOk: false},
+		{name: "other Telegram error", err: tgbotapi.Error{Message: "Bad Request"}, wantOk: false},
+		{name: "other error", err: errors.New("network is down"), wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, ok := telegramRetryAfter(tt.err)
+			if wait != tt.wantWait || ok != tt.wantOk {
+				t.Errorf("telegramRetryAfter() = %v, %v, want %v, %v", wait, ok, tt.wantWait, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const httpReadHeaderTimeout = 2 * time.Second
+
+// parsePort returns the address to serve HTTP on.
+func parsePort(port string) (string, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	if n < 1 || n > 65535 {
+		return "", fmt.Errorf("port %d is out of range", n)
+	}
+	return net.JoinHostPort("", port), nil
+}
+
+// httpEndpoints groups HTTP handlers by the address they are served on,
+// so that endpoints configured with the same port share one server.
+type httpEndpoints map[string]*http.ServeMux
+
+func (e httpEndpoints) handle(addr, pattern string, handler http.Handler) {
+	mux, ok := e[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		e[addr] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// serve starts a server for each address, servers are shut down when ctxRun is cancelled.
+func (e httpEndpoints) serve(ctxRun context.Context, shutdownTimeout time.Duration) {
+	for addr, mux := range e {
+		go serveHTTP(ctxRun, addr, mux, shutdownTimeout)
+	}
+}
+
+func serveHTTP(ctxRun context.Context, addr string, handler http.Handler, shutdownTimeout time.Duration) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	go func() {
+		<-ctxRun.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("failed to shut down HTTP server", "addr", addr, "error", err)
+		}
+	}()
+
+	log.Println("serving HTTP at", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "addr", addr, "error", err)
+	}
+}
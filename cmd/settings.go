@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingFormat = "format"
+
+	formatMarkdown = "markdown"
+	formatPlain    = "plain"
+)
+
+// getChatSetting returns the value of the named setting for the chat, or empty string if it is not set.
+func getChatSetting(ctx context.Context, db *sql.DB, chatID int64, name string) (string, error) {
+	const query = `
+		SELECT value FROM chat_settings WHERE chat_id = ? AND name = ?
+	`
+
+	var value string
+	if err := db.QueryRowContext(ctx, query, chatID, name).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get chat setting '%v' from the database: %w", name, err)
+	}
+	return value, nil
+}
+
+// setChatSetting stores the value of the named setting for the chat, replacing the previous one.
+func setChatSetting(ctx context.Context, db *sql.DB, chatID int64, name, value string) error {
+	const query = `
+		INSERT INTO chat_settings(chat_id, name, value)
+		VALUES(?, ?, ?)
+		ON CONFLICT(chat_id, name) DO UPDATE SET value = excluded.value
+	`
+
+	if _, err := db.ExecContext(ctx, query, chatID, name, value); err != nil {
+		return fmt.Errorf("failed to save chat setting '%v' to the database: %w", name, err)
+	}
+	return nil
+}
+
+// getChatParseMode returns Telegram parse mode to be used for replies in the chat.
+func getChatParseMode(ctx context.Context, settings settingsStore, chatID int64) (string, error) {
+	format, err := settings.ChatSetting(ctx, chatID, chatSettingFormat)
+	if err != nil {
+		return tgbotapi.ModeMarkdown, err
+	}
+	return parseModeForFormat(format), nil
+}
+
+func parseModeForFormat(format string) string {
+	if format == formatPlain {
+		return ""
+	}
+	return tgbotapi.ModeMarkdown
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSendLongTextMessageSplitsLongReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		sentence string
+	}{
+		{name: "ASCII", sentence: "The quick brown fox jumps over the lazy dog. "},
+		// Limit is in characters, Cyrillic takes two bytes per character
+		{name: "Cyrillic", sentence: "Съешь же ещё этих мягких французских булок. "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var text strings.Builder
+			for i := 0; utf8.RuneCountInString(text.String()) < 10000; i++ {
+				text.WriteString(tt.sentence)
+				if i%10 == 9 {
+					text.WriteString("\n\n")
+				}
+			}
+			sender := &fakeSender{}
+
+			sendLongTextMessage(context.Background(), sender, 1, "", text.String())
+
+			if len(sender.sent) != 3 {
+				t.Fatalf("sent %d messages, want 3", len(sender.sent))
+			}
+			for i, chunk := range sender.sent {
+				if n := utf8.RuneCountInString(chunk); n > telegramMessageLengthMax {
+					t.Errorf("message %d is %d characters long, want at most %d", i, n, telegramMessageLengthMax)
+				}
+				if i < len(sender.sent)-1 && !strings.HasSuffix(strings.TrimSpace(chunk), ".") {
+					t.Errorf("message %d ends with %q, want the end of a sentence", i, chunk[len(chunk)-20:])
+				}
+			}
+			if got := strings.Join(sender.sent, ""); got != text.String() {
+				t.Error("messages joined differ from the reply")
+			}
+		})
+	}
+}
+
+func TestSendLongTextMessageSplitsLongCodeBlock(t *testing.T) {
+	var code strings.Builder
+	for i := 0; code.Len() < 10000; i++ {
+		code.WriteString("    print(\"the long line of the long code block\")\n")
+	}
+	text := "```python\ndef main():\n" + code.String() + "```"
+	sender := &fakeSender{}
+
+	sendLongTextMessage(context.Background(), sender, 1, "", text)
+
+	if len(sender.sent) != 3 {
+		t.Fatalf("sent %d messages, want 3", len(sender.sent))
+	}
+	var gotCode strings.Builder
+	for i, chunk := range sender.sent {
+		if n := utf8.RuneCountInString(chunk); n > telegramMessageLengthMax {
+			t.Errorf("message %d is %d characters long, want at most %d", i, n, telegramMessageLengthMax)
+		}
+		if !strings.HasPrefix(chunk, "```python\n") || !strings.HasSuffix(chunk, "\n```") {
+			t.Errorf("message %d is not a whole code block: %q...%q", i, chunk[:20], chunk[len(chunk)-20:])
+		}
+		gotCode.WriteString(strings.TrimSuffix(strings.TrimPrefix(chunk, "```python\n"), "```"))
+	}
+	if want := "def main():\n" + code.String(); gotCode.String() != want {
+		t.Error("code joined from messages differs from the code block")
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxLength int
+		want      []string
+	}{
+		{name: "short text", text: "Hello.", maxLength: 10, want: []string{"Hello."}},
+		{name: "between sentences", text: "One two three. Four five six.", maxLength: 20, want: []string{"One two three. ", "Four five six."}},
+		{name: "between words", text: "one two three", maxLength: 10, want: []string{"one two ", "three"}},
+		{name: "word longer than the chunk", text: "abcdefghijkl", maxLength: 5, want: []string{"abcde", "fghij", "kl"}},
+		{name: "characters rather than bytes", text: "привет мир", maxLength: 7, want: []string{"привет ", "мир"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitText(tt.text, tt.maxLength); !equalStrings(got, tt.want) {
+				t.Errorf("splitText(%q, %d) = %q, want %q", tt.text, tt.maxLength, got, tt.want)
+			}
+		})
+	}
+}
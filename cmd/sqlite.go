@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	sqlite "github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultDiskIOErrorRetries = 2
+
+	// sqliteConcurrencyParams make concurrent writers wait for each other instead of failing with "database is locked",
+	// transactions take the write lock when they begin, so that they don't fail to upgrade the lock later.
+	sqliteConcurrencyParams = "?_busy_timeout=5000&_txlock=immediate"
+)
+
+// errDatabaseCorrupt is returned when the database fails the integrity check after a disk I/O error,
+// so that a broken database file is reported instead of being retried forever.
+var errDatabaseCorrupt = errors.New("SQLite database is corrupt")
+
+// ioRetryConnector opens SQLite connections that recover from intermittent "disk I/O error":
+// the connection is reopened and the failed statement is executed again, up to the configured number of times.
+type ioRetryConnector struct {
+	dsn     string
+	retries int
+	driver  *sqlite.SQLiteDriver
+}
+
+func newIORetryConnector(dsn string, retries int) *ioRetryConnector {
+	return &ioRetryConnector{
+		dsn:     dsn,
+		retries: retries,
+		driver:  &sqlite.SQLiteDriver{},
+	}
+}
+
+func (c *ioRetryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	return &ioRetryConn{connector: c, conn: conn}, nil
+}
+
+func (c *ioRetryConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (c *ioRetryConnector) open() (*sqlite.SQLiteConn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*sqlite.SQLiteConn), nil
+}
+
+// ioRetryConn wraps SQLite connection, only statements executed directly on the connection outside of
+// a transaction are retried, since reopening the connection would silently roll the transaction back.
+type ioRetryConn struct {
+	connector *ioRetryConnector
+	conn      *sqlite.SQLiteConn
+}
+
+func (c *ioRetryConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+func (c *ioRetryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.PrepareContext(ctx, query)
+}
+
+func (c *ioRetryConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *ioRetryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.BeginTx(ctx, opts)
+}
+
+func (c *ioRetryConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ioRetryConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c *ioRetryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	err := c.retryOnDiskIOError(ctx, func() (err error) {
+		res, err = c.conn.ExecContext(ctx, query, args)
+		return err
+	})
+	return res, err
+}
+
+func (c *ioRetryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := c.retryOnDiskIOError(ctx, func() (err error) {
+		rows, err = c.conn.QueryContext(ctx, query, args)
+		return err
+	})
+	return rows, err
+}
+
+func (c *ioRetryConn) retryOnDiskIOError(ctx context.Context, op func() error) error {
+	inTransaction := !c.conn.AutoCommit()
+
+	err := op()
+	for attempt := 1; attempt <= c.connector.retries && !inTransaction && isDiskIOError(err); attempt++ {
+		slog.Warn("SQLite disk I/O error, reopening the database", "attempt", attempt, "attempts", c.connector.retries, "error", err)
+
+		if reopenErr := c.reopen(ctx); reopenErr != nil {
+			if errors.Is(reopenErr, errDatabaseCorrupt) {
+				return reopenErr
+			}
+			slog.Error("failed to reopen SQLite database", "error", reopenErr)
+			continue
+		}
+
+		err = op()
+	}
+	return err
+}
+
+// reopen replaces the connection with a new one, which is checked for integrity before it is used.
+func (c *ioRetryConn) reopen(ctx context.Context) error {
+	conn, err := c.connector.open()
+	if err != nil {
+		return err
+	}
+
+	if err := quickCheck(ctx, conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn.Close()
+	c.conn = conn
+	return nil
+}
+
+func quickCheck(ctx context.Context, conn *sqlite.SQLiteConn) error {
+	rows, err := conn.QueryContext(ctx, "PRAGMA quick_check", nil)
+	if err != nil {
+		if isDatabaseCorruptError(err) {
+			return fmt.Errorf("%w: %v", errDatabaseCorrupt, err)
+		}
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		return fmt.Errorf("failed to check SQLite database integrity: %w", err)
+	}
+	if result, _ := values[0].(string); result != "ok" {
+		return fmt.Errorf("%w: %v", errDatabaseCorrupt, values[0])
+	}
+	return nil
+}
+
+// isDiskIOError reports whether the error is SQLite "disk I/O error" of any kind (SQLITE_IOERR_*).
+func isDiskIOError(err error) bool {
+	var sqliteErr sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite.ErrIoErr
+}
+
+func isDatabaseCorruptError(err error) bool {
+	var sqliteErr sqlite.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite.ErrCorrupt || sqliteErr.Code == sqlite.ErrNotADB)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingStarDigestSentAt = "star_digest_sent_at"
+
+	starDigestCheckInterval = time.Hour
+	starDigestWeekday       = time.Monday
+	starDigestHour          = 9
+	starDigestPeriod        = 7 * 24 * time.Hour
+)
+
+type dbStarredMessage struct {
+	ChatID    int64
+	UserID    int
+	MessageID int
+	Text      string
+	CreatedAt time.Time
+}
+
+func (p *messageProcessor) handleStarCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	reply := update.Message.ReplyToMessage
+
+	if reply == nil || reply.From == nil || reply.From.ID != p.bot.Self.ID || reply.Text == "" {
+		sendTextMessage(p.bot, chatID, parseMode, "Reply with /star to one of my messages to save it.")
+		return
+	}
+
+	if err := p.activity.SaveStar(ctx, &dbStarredMessage{
+		ChatID:    chatID,
+		UserID:    update.Message.From.ID,
+		MessageID: reply.MessageID,
+		Text:      reply.Text,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		slog.Error("failed to save starred message", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, "Starred. You will get it in the weekly digest.")
+}
+
+// runStarDigest periodically sends the digest of messages starred during the last week.
+// The digest is sent on Monday morning in the configured time zone.
+func (p *messageProcessor) runStarDigest(ctx context.Context) {
+	ticker := time.NewTicker(starDigestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Digest is sent on the next check after maintenance is over
+		if !p.maintenance.Load() {
+			if err := p.sendStarDigests(ctx, time.Now()); err != nil {
+				slog.Error("failed to send starred messages digest", "error", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *messageProcessor) sendStarDigests(ctx context.Context, now time.Time) error {
+	digestTime := lastStarDigestTime(now, p.starDigestLocation)
+	since := digestTime.Add(-starDigestPeriod)
+
+	chatIDs, err := p.activity.StarredChats(ctx, since, digestTime)
+	if err != nil {
+		return err
+	}
+
+	for _, chatID := range chatIDs {
+		sentAt, err := p.settings.ChatSetting(ctx, chatID, chatSettingStarDigestSentAt)
+		if err != nil {
+			return err
+		}
+		if sentAt != "" {
+			if t, err := time.Parse(time.RFC3339, sentAt); err == nil && !t.Before(digestTime) {
+				continue
+			}
+		}
+
+		stars, err := p.activity.StarredMessages(ctx, chatID, since, digestTime)
+		if err != nil {
+			return err
+		}
+
+		// Digest is marked as sent before sending, so that it is not repeated if sending fails
+		if err := p.settings.SetChatSetting(ctx, chatID, chatSettingStarDigestSentAt, digestTime.UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+		if len(stars) == 0 {
+			continue
+		}
+
+		parseMode, err := getChatParseMode(ctx, p.settings, chatID)
+		if err != nil {
+			slog.Error("failed to get chat parse mode from the database", "error", err)
+		}
+		sendLongTextMessage(ctx, p.bot, chatID, parseMode, formatStarDigest(stars))
+	}
+	return nil
+}
+
+// lastStarDigestTime returns the most recent digest time not later than now.
+func lastStarDigestTime(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	daysSinceDigestDay := (int(local.Weekday()) - int(starDigestWeekday) + 7) % 7
+
+	year, month, day := local.Date()
+	digestTime := time.Date(year, month, day-daysSinceDigestDay, starDigestHour, 0, 0, 0, loc)
+	if digestTime.After(now) {
+		digestTime = digestTime.AddDate(0, 0, -7)
+	}
+	return digestTime
+}
+
+func formatStarDigest(stars []*dbStarredMessage) string {
+	buf := new(strings.Builder)
+	buf.WriteString("Your starred replies from the past week:")
+	for i, star := range stars {
+		fmt.Fprintf(buf, "\n\n%d. %s", i+1, star.Text)
+	}
+	return buf.String()
+}
+
+func saveStarredMessage(ctx context.Context, db *sql.DB, star *dbStarredMessage) error {
+	const query = `
+		INSERT INTO starred_messages(chat_id, user_id, message_id, message, created_at)
+		VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(chat_id, message_id) DO NOTHING
+	`
+
+	if _, err := db.ExecContext(ctx, query, star.ChatID, star.UserID, star.MessageID, star.Text, star.CreatedAt.UnixMilli()); err != nil {
+		return fmt.Errorf("failed to save starred message to the database: %w", err)
+	}
+	return nil
+}
+
+func getStarredChats(ctx context.Context, db *sql.DB, since, until time.Time) ([]int64, error) {
+	const query = `
+		SELECT DISTINCT chat_id FROM starred_messages WHERE created_at >= ? AND created_at < ?
+	`
+
+	rows, err := db.QueryContext(ctx, query, since.UnixMilli(), until.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for starred chats from the database: %w", err)
+	}
+	defer rows.Close()
+
+	chatIDs := make([]int64, 0)
+	for rows.Next() {
+		var chatID int64
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, fmt.Errorf("failed to get starred chat from the database: %w", err)
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get starred chats from the database: %w", err)
+	}
+	return chatIDs, nil
+}
+
+func getStarredMessages(ctx context.Context, db *sql.DB, chatID int64, since, until time.Time) ([]*dbStarredMessage, error) {
+	const query = `
+		SELECT chat_id, user_id, message_id, message FROM starred_messages
+		WHERE chat_id = ? AND created_at >= ? AND created_at < ?
+		ORDER BY created_at ASC
+	`
+
+	rows, err := db.QueryContext(ctx, query, chatID, since.UnixMilli(), until.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for starred messages from the database: %w", err)
+	}
+	defer rows.Close()
+
+	stars := make([]*dbStarredMessage, 0)
+	for rows.Next() {
+		star := new(dbStarredMessage)
+		if err := rows.Scan(&star.ChatID, &star.UserID, &star.MessageID, &star.Text); err != nil {
+			return nil, fmt.Errorf("failed to get starred message from the database: %w", err)
+		}
+		stars = append(stars, star)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get starred messages from the database: %w", err)
+	}
+	return stars, nil
+}
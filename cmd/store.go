@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// messageStore persists conversation history.
+type messageStore interface {
+	// History returns conversation history of the user, only messages with the tag if it is not empty.
+	History(ctx context.Context, ownerID int, tag string) ([]*dbMessage, error)
+	// Save saves the message and sets its ID.
+	Save(ctx context.Context, msg *dbMessage) error
+	// SaveAll saves the messages that aren't saved yet with the tags and sets their IDs, all or nothing.
+	SaveAll(ctx context.Context, msgs []*dbMessage, tags []string) error
+	// DeleteOld keeps only the newest maxMessages messages of the user.
+	DeleteOld(ctx context.Context, ownerID int, maxMessages int) error
+	// DeleteExpired deletes the messages of the user created before the time.
+	DeleteExpired(ctx context.Context, ownerID int, before time.Time) error
+	// DeleteFrom deletes the message with the ID and all later messages of the user.
+	DeleteFrom(ctx context.Context, ownerID, messageID int) error
+	// DeleteAll deletes the conversation history of the user.
+	DeleteAll(ctx context.Context, ownerID int) error
+	// ReplaceAll replaces the conversation history of the user with the messages and sets their IDs, all or nothing.
+	ReplaceAll(ctx context.Context, ownerID int, history []*dbMessage) error
+	// IsEmpty reports whether the user has no conversation history.
+	IsEmpty(ctx context.Context, ownerID int) (bool, error)
+	// LastReplyTruncated reports whether the last message of the conversation is the reply that is cut off.
+	LastReplyTruncated(ctx context.Context, ownerID int) (bool, error)
+	// Rate rates the reply of the conversation, returns false if there is no such reply.
+	Rate(ctx context.Context, ownerID, messageID int, rating string) (bool, error)
+	// RatingStats returns the numbers of replies rated up and down.
+	RatingStats(ctx context.Context) (up, down int, err error)
+	// TokenUsage returns the number of tokens used by replies to the user since the time.
+	TokenUsage(ctx context.Context, ownerID int, since time.Time) (tokenUsage, error)
+	// Summary returns the summary of the conversation scoped to the tag, empty one if there is none.
+	Summary(ctx context.Context, ownerID int, tag string) (conversationSummary, error)
+	// SaveSummary replaces the summary of the conversation scoped to the tag.
+	SaveSummary(ctx context.Context, ownerID int, tag string, summary conversationSummary) error
+}
+
+// settingsStore persists settings of chats and users, empty values mean the setting is not set.
+type settingsStore interface {
+	ChatSetting(ctx context.Context, chatID int64, name string) (string, error)
+	SetChatSetting(ctx context.Context, chatID int64, name, value string) error
+
+	UserModel(ctx context.Context, userID int) (string, error)
+	SaveUserModel(ctx context.Context, userID int, model string) error
+	DeleteUserModel(ctx context.Context, userID int) error
+
+	UserPersona(ctx context.Context, userID int) (string, error)
+	SaveUserPersona(ctx context.Context, userID int, persona string, createdAt time.Time) error
+	DeleteUserPersona(ctx context.Context, userID int) error
+
+	UserMaxTokens(ctx context.Context, userID int) (int, error)
+	SaveUserMaxTokens(ctx context.Context, userID, limit int) error
+	DeleteUserMaxTokens(ctx context.Context, userID int) error
+}
+
+// activityStore persists what happens in chats apart from the conversations: processed updates, message counts,
+// errors, feedback and starred messages.
+type activityStore interface {
+	// LastUpdateID returns the ID of the last processed update of the conversation, or zero if there is none.
+	LastUpdateID(ctx context.Context, ownerID int) (int, error)
+	SaveLastUpdateID(ctx context.Context, ownerID, updateID int) error
+
+	// DailyMessageCount returns the number of messages the user sent on the UTC day of now.
+	DailyMessageCount(ctx context.Context, userID int, now time.Time) (int, error)
+	IncrementDailyMessageCount(ctx context.Context, userID int, now time.Time) error
+
+	// ChatError returns the last error in the chat, or nil if there is none.
+	ChatError(ctx context.Context, chatID int64) (*dbChatError, error)
+	SaveChatError(ctx context.Context, chatErr *dbChatError) error
+	DeleteChatError(ctx context.Context, chatID int64) error
+
+	SaveFeedback(ctx context.Context, feedback *dbFeedback) error
+	// FeedbackStats returns the numbers of good and bad feedback.
+	FeedbackStats(ctx context.Context) (good, bad int, err error)
+
+	// SaveStar saves the starred message, the message starred before is left as is.
+	SaveStar(ctx context.Context, star *dbStarredMessage) error
+	// StarredChats returns the chats with messages starred in [since, until).
+	StarredChats(ctx context.Context, since, until time.Time) ([]int64, error)
+	// StarredMessages returns the messages of the chat starred in [since, until), oldest first.
+	StarredMessages(ctx context.Context, chatID int64, since, until time.Time) ([]*dbStarredMessage, error)
+}
+
+// sqlExecutor runs queries in the database or in the transaction.
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlStore keeps everything in the SQL database, the queries are the same for SQLite and PostgreSQL.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func newSQLStore(db *sql.DB) *sqlStore {
+	return &sqlStore{db: db}
+}
+
+func (s *sqlStore) History(ctx context.Context, ownerID int, tag string) ([]*dbMessage, error) {
+	return getAllMesssages(ctx, s.db, ownerID, tag)
+}
+
+func (s *sqlStore) Save(ctx context.Context, msg *dbMessage) error {
+	return saveMessage(ctx, s.db, msg)
+}
+
+func (s *sqlStore) SaveAll(ctx context.Context, msgs []*dbMessage, tags []string) error {
+	return saveMessages(ctx, s.db, msgs, tags)
+}
+
+func (s *sqlStore) DeleteOld(ctx context.Context, ownerID int, maxMessages int) error {
+	return deleteOldMessages(ctx, s.db, ownerID, maxMessages)
+}
+
+func (s *sqlStore) DeleteExpired(ctx context.Context, ownerID int, before time.Time) error {
+	return deleteExpiredMessages(ctx, s.db, ownerID, before)
+}
+
+func (s *sqlStore) DeleteFrom(ctx context.Context, ownerID, messageID int) error {
+	return deleteMessagesFrom(ctx, s.db, ownerID, messageID)
+}
+
+func (s *sqlStore) DeleteAll(ctx context.Context, ownerID int) error {
+	return deleteAllMessages(ctx, s.db, ownerID)
+}
+
+func (s *sqlStore) ReplaceAll(ctx context.Context, ownerID int, history []*dbMessage) error {
+	return replaceAllMessages(ctx, s.db, ownerID, history)
+}
+
+func (s *sqlStore) IsEmpty(ctx context.Context, ownerID int) (bool, error) {
+	return isHistoryEmpty(ctx, s.db, ownerID)
+}
+
+func (s *sqlStore) LastReplyTruncated(ctx context.Context, ownerID int) (bool, error) {
+	return isLastReplyTruncated(ctx, s.db, ownerID)
+}
+
+func (s *sqlStore) Rate(ctx context.Context, ownerID, messageID int, rating string) (bool, error) {
+	return saveMessageRating(ctx, s.db, ownerID, messageID, rating)
+}
+
+func (s *sqlStore) RatingStats(ctx context.Context) (up, down int, err error) {
+	return getRatingStats(ctx, s.db)
+}
+
+func (s *sqlStore) TokenUsage(ctx context.Context, ownerID int, since time.Time) (tokenUsage, error) {
+	return getTokenUsage(ctx, s.db, ownerID, since)
+}
+
+func (s *sqlStore) Summary(ctx context.Context, ownerID int, tag string) (conversationSummary, error) {
+	return getConversationSummary(ctx, s.db, ownerID, tag)
+}
+
+func (s *sqlStore) SaveSummary(ctx context.Context, ownerID int, tag string, summary conversationSummary) error {
+	return saveConversationSummary(ctx, s.db, ownerID, tag, summary)
+}
+
+func (s *sqlStore) ChatSetting(ctx context.Context, chatID int64, name string) (string, error) {
+	return getChatSetting(ctx, s.db, chatID, name)
+}
+
+func (s *sqlStore) SetChatSetting(ctx context.Context, chatID int64, name, value string) error {
+	return setChatSetting(ctx, s.db, chatID, name, value)
+}
+
+func (s *sqlStore) UserModel(ctx context.Context, userID int) (string, error) {
+	return getUserModel(ctx, s.db, userID)
+}
+
+func (s *sqlStore) SaveUserModel(ctx context.Context, userID int, model string) error {
+	return saveUserModel(ctx, s.db, userID, model)
+}
+
+func (s *sqlStore) DeleteUserModel(ctx context.Context, userID int) error {
+	return deleteUserModel(ctx, s.db, userID)
+}
+
+func (s *sqlStore) UserPersona(ctx context.Context, userID int) (string, error) {
+	return getUserPersona(ctx, s.db, userID)
+}
+
+func (s *sqlStore) SaveUserPersona(ctx context.Context, userID int, persona string, createdAt time.Time) error {
+	return saveUserPersona(ctx, s.db, userID, persona, createdAt)
+}
+
+func (s *sqlStore) DeleteUserPersona(ctx context.Context, userID int) error {
+	return deleteUserPersona(ctx, s.db, userID)
+}
+
+func (s *sqlStore) UserMaxTokens(ctx context.Context, userID int) (int, error) {
+	return getUserMaxTokens(ctx, s.db, userID)
+}
+
+func (s *sqlStore) SaveUserMaxTokens(ctx context.Context, userID, limit int) error {
+	return saveUserMaxTokens(ctx, s.db, userID, limit)
+}
+
+func (s *sqlStore) DeleteUserMaxTokens(ctx context.Context, userID int) error {
+	return deleteUserMaxTokens(ctx, s.db, userID)
+}
+
+func (s *sqlStore) LastUpdateID(ctx context.Context, ownerID int) (int, error) {
+	return getLastUpdateID(ctx, s.db, ownerID)
+}
+
+func (s *sqlStore) SaveLastUpdateID(ctx context.Context, ownerID, updateID int) error {
+	return saveLastUpdateID(ctx, s.db, ownerID, updateID)
+}
+
+func (s *sqlStore) DailyMessageCount(ctx context.Context, userID int, now time.Time) (int, error) {
+	return getDailyMessageCount(ctx, s.db, userID, now)
+}
+
+func (s *sqlStore) IncrementDailyMessageCount(ctx context.Context, userID int, now time.Time) error {
+	return incrementDailyMessageCount(ctx, s.db, userID, now)
+}
+
+func (s *sqlStore) ChatError(ctx context.Context, chatID int64) (*dbChatError, error) {
+	return getChatError(ctx, s.db, chatID)
+}
+
+func (s *sqlStore) SaveChatError(ctx context.Context, chatErr *dbChatError) error {
+	return saveChatError(ctx, s.db, chatErr)
+}
+
+func (s *sqlStore) DeleteChatError(ctx context.Context, chatID int64) error {
+	return deleteChatError(ctx, s.db, chatID)
+}
+
+func (s *sqlStore) SaveFeedback(ctx context.Context, feedback *dbFeedback) error {
+	return saveFeedback(ctx, s.db, feedback)
+}
+
+func (s *sqlStore) FeedbackStats(ctx context.Context) (good, bad int, err error) {
+	return getFeedbackStats(ctx, s.db)
+}
+
+func (s *sqlStore) SaveStar(ctx context.Context, star *dbStarredMessage) error {
+	return saveStarredMessage(ctx, s.db, star)
+}
+
+func (s *sqlStore) StarredChats(ctx context.Context, since, until time.Time) ([]int64, error) {
+	return getStarredChats(ctx, s.db, since, until)
+}
+
+func (s *sqlStore) StarredMessages(ctx context.Context, chatID int64, since, until time.Time) ([]*dbStarredMessage, error) {
+	return getStarredMessages(ctx, s.db, chatID, since, until)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in memory the same way sqlStore keeps it in the database,
+// so that the conversation logic is tested without one.
+type memoryStore struct {
+	mu sync.Mutex
+
+	lastMessageID int
+	messages      []*dbMessage
+	tags          map[int][]string
+	ratings       map[int]string
+	summaries     map[memorySummaryKey]conversationSummary
+
+	chatSettings  map[memoryChatSettingKey]string
+	userModels    map[int]string
+	userPersonas  map[int]string
+	userMaxTokens map[int]int
+
+	lastUpdateIDs map[int]int
+	dailyCounts   map[memoryDailyCountKey]int
+	chatErrors    map[int64]dbChatError
+	feedback      []dbFeedback
+	stars         []dbStarredMessage
+}
+
+type memorySummaryKey struct {
+	ownerID int
+	tag     string
+}
+
+type memoryChatSettingKey struct {
+	chatID int64
+	name   string
+}
+
+type memoryDailyCountKey struct {
+	userID int
+	day    string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tags:          make(map[int][]string),
+		ratings:       make(map[int]string),
+		summaries:     make(map[memorySummaryKey]conversationSummary),
+		chatSettings:  make(map[memoryChatSettingKey]string),
+		userModels:    make(map[int]string),
+		userPersonas:  make(map[int]string),
+		userMaxTokens: make(map[int]int),
+		lastUpdateIDs: make(map[int]int),
+		dailyCounts:   make(map[memoryDailyCountKey]int),
+		chatErrors:    make(map[int64]dbChatError),
+	}
+}
+
+func (s *memoryStore) History(ctx context.Context, ownerID int, tag string) ([]*dbMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := make([]*dbMessage, 0)
+	for _, msg := range s.ownerMessages(ownerID) {
+		if tag == "" || s.hasTag(msg.ID, tag) {
+			stored := *msg
+			history = append(history, &stored)
+		}
+	}
+	return history, nil
+}
+
+func (s *memoryStore) Save(ctx context.Context, msg *dbMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.save(msg)
+	return nil
+}
+
+func (s *memoryStore) SaveAll(ctx context.Context, msgs []*dbMessage, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range msgs {
+		if msg.ID != 0 {
+			continue
+		}
+		s.save(msg)
+		s.tags[msg.ID] = append([]string(nil), tags...)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteOld(ctx context.Context, ownerID int, maxMessages int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.ownerMessages(ownerID)
+	if len(history) <= maxMessages {
+		return nil
+	}
+	old := make(map[int]bool)
+	for _, msg := range history[:len(history)-maxMessages] {
+		old[msg.ID] = true
+	}
+	s.deleteMessages(func(msg *dbMessage) bool { return old[msg.ID] })
+	return nil
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context, ownerID int, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteMessages(func(msg *dbMessage) bool {
+		return msg.OwnerID == ownerID && msg.CreatedAt.UnixMilli() < before.UnixMilli()
+	})
+	return nil
+}
+
+func (s *memoryStore) DeleteFrom(ctx context.Context, ownerID, messageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteMessages(func(msg *dbMessage) bool { return msg.OwnerID == ownerID && msg.ID >= messageID })
+	s.deleteSummaries(ownerID, messageID)
+	return nil
+}
+
+func (s *memoryStore) DeleteAll(ctx context.Context, ownerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteMessages(func(msg *dbMessage) bool { return msg.OwnerID == ownerID })
+	s.deleteSummaries(ownerID, 0)
+	return nil
+}
+
+func (s *memoryStore) ReplaceAll(ctx context.Context, ownerID int, history []*dbMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteMessages(func(msg *dbMessage) bool { return msg.OwnerID == ownerID })
+	for _, msg := range history {
+		s.save(&dbMessage{UserID: msg.UserID, OwnerID: ownerID, Role: msg.Role, Username: msg.Username, Text: msg.Text, CreatedAt: msg.CreatedAt})
+		msg.ID = s.lastMessageID
+	}
+	s.deleteSummaries(ownerID, 0)
+	return nil
+}
+
+func (s *memoryStore) IsEmpty(ctx context.Context, ownerID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.ownerMessages(ownerID)) == 0, nil
+}
+
+func (s *memoryStore) LastReplyTruncated(ctx context.Context, ownerID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.ownerMessages(ownerID)
+	if len(history) == 0 {
+		return false, nil
+	}
+	last := history[len(history)-1]
+	return last.Role == messageRoleAssistant && last.FinishReason == finishReasonLength, nil
+}
+
+func (s *memoryStore) Rate(ctx context.Context, ownerID, messageID int, rating string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.messages {
+		if msg.ID == messageID && msg.OwnerID == ownerID && msg.Role == messageRoleAssistant {
+			s.ratings[messageID] = rating
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) RatingStats(ctx context.Context) (up, down int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rating := range s.ratings {
+		switch rating {
+		case ratingUp:
+			up++
+		case ratingDown:
+			down++
+		}
+	}
+	return up, down, nil
+}
+
+func (s *memoryStore) TokenUsage(ctx context.Context, ownerID int, since time.Time) (tokenUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usage tokenUsage
+	for _, msg := range s.ownerMessages(ownerID) {
+		if msg.CreatedAt.UnixMilli() >= since.UnixMilli() {
+			usage.prompt += int64(msg.PromptTokens)
+			usage.completion += int64(msg.CompletionTokens)
+			usage.total += int64(msg.TotalTokens)
+		}
+	}
+	return usage, nil
+}
+
+func (s *memoryStore) Summary(ctx context.Context, ownerID int, tag string) (conversationSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.summaries[memorySummaryKey{ownerID, tag}], nil
+}
+
+func (s *memoryStore) SaveSummary(ctx context.Context, ownerID int, tag string, summary conversationSummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.summaries[memorySummaryKey{ownerID, tag}] = summary
+	return nil
+}
+
+// save stores the copy of the message and sets its ID, the caller holds the lock.
+func (s *memoryStore) save(msg *dbMessage) {
+	s.lastMessageID++
+	msg.ID = s.lastMessageID
+	stored := *msg
+	s.messages = append(s.messages, &stored)
+}
+
+// ownerMessages returns the stored messages of the user ordered by creation time and then by ID, the caller holds the lock.
+func (s *memoryStore) ownerMessages(ownerID int) []*dbMessage {
+	var history []*dbMessage
+	for _, msg := range s.messages {
+		if msg.OwnerID == ownerID {
+			history = append(history, msg)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		if !history[i].CreatedAt.Equal(history[j].CreatedAt) {
+			return history[i].CreatedAt.Before(history[j].CreatedAt)
+		}
+		return history[i].ID < history[j].ID
+	})
+	return history
+}
+
+func (s *memoryStore) hasTag(messageID int, tag string) bool {
+	for _, t := range s.tags[messageID] {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteMessages deletes the messages matching the condition with their tags and ratings, the caller holds the lock.
+func (s *memoryStore) deleteMessages(matches func(msg *dbMessage) bool) {
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if matches(msg) {
+			delete(s.tags, msg.ID)
+			delete(s.ratings, msg.ID)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	s.messages = kept
+}
+
+// deleteSummaries deletes summaries of the conversation that cover the message with the ID or later ones, the caller holds the lock.
+func (s *memoryStore) deleteSummaries(ownerID, messageID int) {
+	for key, summary := range s.summaries {
+		if key.ownerID == ownerID && summary.throughID >= messageID {
+			delete(s.summaries, key)
+		}
+	}
+}
+
+func (s *memoryStore) ChatSetting(ctx context.Context, chatID int64, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.chatSettings[memoryChatSettingKey{chatID, name}], nil
+}
+
+func (s *memoryStore) SetChatSetting(ctx context.Context, chatID int64, name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chatSettings[memoryChatSettingKey{chatID, name}] = value
+	return nil
+}
+
+func (s *memoryStore) UserModel(ctx context.Context, userID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.userModels[userID], nil
+}
+
+func (s *memoryStore) SaveUserModel(ctx context.Context, userID int, model string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userModels[userID] = model
+	return nil
+}
+
+func (s *memoryStore) DeleteUserModel(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.userModels, userID)
+	return nil
+}
+
+func (s *memoryStore) UserPersona(ctx context.Context, userID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.userPersonas[userID], nil
+}
+
+func (s *memoryStore) SaveUserPersona(ctx context.Context, userID int, persona string, createdAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userPersonas[userID] = persona
+	return nil
+}
+
+func (s *memoryStore) DeleteUserPersona(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.userPersonas, userID)
+	return nil
+}
+
+func (s *memoryStore) UserMaxTokens(ctx context.Context, userID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.userMaxTokens[userID], nil
+}
+
+func (s *memoryStore) SaveUserMaxTokens(ctx context.Context, userID, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userMaxTokens[userID] = limit
+	return nil
+}
+
+func (s *memoryStore) DeleteUserMaxTokens(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.userMaxTokens, userID)
+	return nil
+}
+
+func (s *memoryStore) LastUpdateID(ctx context.Context, ownerID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastUpdateIDs[ownerID], nil
+}
+
+func (s *memoryStore) SaveLastUpdateID(ctx context.Context, ownerID, updateID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastUpdateIDs[ownerID] = updateID
+	return nil
+}
+
+func (s *memoryStore) DailyMessageCount(ctx context.Context, userID int, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dailyCounts[memoryDailyCountKey{userID, now.UTC().Format(dailyMessageCountDayLayout)}], nil
+}
+
+func (s *memoryStore) IncrementDailyMessageCount(ctx context.Context, userID int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dailyCounts[memoryDailyCountKey{userID, now.UTC().Format(dailyMessageCountDayLayout)}]++
+	return nil
+}
+
+func (s *memoryStore) ChatError(ctx context.Context, chatID int64) (*dbChatError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chatErr, ok := s.chatErrors[chatID]
+	if !ok {
+		return nil, nil
+	}
+	return &chatErr, nil
+}
+
+func (s *memoryStore) SaveChatError(ctx context.Context, chatErr *dbChatError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chatErrors[chatErr.ChatID] = *chatErr
+	return nil
+}
+
+func (s *memoryStore) DeleteChatError(ctx context.Context, chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chatErrors, chatID)
+	return nil
+}
+
+func (s *memoryStore) SaveFeedback(ctx context.Context, feedback *dbFeedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feedback = append(s.feedback, *feedback)
+	return nil
+}
+
+func (s *memoryStore) FeedbackStats(ctx context.Context) (good, bad int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, feedback := range s.feedback {
+		switch feedback.Rating {
+		case feedbackGood:
+			good++
+		case feedbackBad:
+			bad++
+		}
+	}
+	return good, bad, nil
+}
+
+func (s *memoryStore) SaveStar(ctx context.Context, star *dbStarredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, saved := range s.stars {
+		if saved.ChatID == star.ChatID && saved.MessageID == star.MessageID {
+			return nil
+		}
+	}
+	s.stars = append(s.stars, *star)
+	return nil
+}
+
+func (s *memoryStore) StarredChats(ctx context.Context, since, until time.Time) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chatIDs := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for _, star := range s.stars {
+		if inPeriod(star.CreatedAt, since, until) && !seen[star.ChatID] {
+			seen[star.ChatID] = true
+			chatIDs = append(chatIDs, star.ChatID)
+		}
+	}
+	return chatIDs, nil
+}
+
+func (s *memoryStore) StarredMessages(ctx context.Context, chatID int64, since, until time.Time) ([]*dbStarredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stars := make([]*dbStarredMessage, 0)
+	for _, star := range s.stars {
+		if star.ChatID == chatID && inPeriod(star.CreatedAt, since, until) {
+			star := star
+			stars = append(stars, &star)
+		}
+	}
+	sort.SliceStable(stars, func(i, j int) bool { return stars[i].CreatedAt.Before(stars[j].CreatedAt) })
+	return stars, nil
+}
+
+// inPeriod reports whether the time is in [since, until).
+func inPeriod(t, since, until time.Time) bool {
+	return !t.Before(since) && t.Before(until)
+}
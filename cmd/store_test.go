@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore is what both stores implement.
+type testStore interface {
+	messageStore
+	settingsStore
+	activityStore
+}
+
+// forEachStore runs the test against the empty SQL store and the empty memory store,
+// so that the memory store used by the tests behaves the same as the real one.
+func forEachStore(t *testing.T, test func(t *testing.T, s testStore)) {
+	stores := []struct {
+		name string
+		new  func(t *testing.T) testStore
+	}{
+		{name: "sql", new: func(t *testing.T) testStore { return newSQLStore(newTestDB(t)) }},
+		{name: "memory", new: func(t *testing.T) testStore { return newMemoryStore() }},
+	}
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			test(t, store.new(t))
+		})
+	}
+}
+
+// saveTestConversation saves two exchanges of the user 1, the second one tagged with "work",
+// and the message of the user 2, returns the messages of the user 1.
+func saveTestConversation(t *testing.T, s messageStore, start time.Time) []*dbMessage {
+	t.Helper()
+
+	msgs := []*dbMessage{
+		{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "q1", CreatedAt: start},
+		{OwnerID: 1, Role: messageRoleAssistant, Text: "a1", CreatedAt: start.Add(time.Second), TotalTokens: 10},
+		{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "q2", CreatedAt: start.Add(2 * time.Second)},
+		{OwnerID: 1, Role: messageRoleAssistant, Text: "a2", CreatedAt: start.Add(3 * time.Second), TotalTokens: 20},
+	}
+	ctx := context.Background()
+	if err := s.SaveAll(ctx, msgs[:2], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAll(ctx, msgs[2:], []string{"work"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, &dbMessage{UserID: 2, OwnerID: 2, Role: messageRoleUser, Text: "other", CreatedAt: start}); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func historyTexts(t *testing.T, s messageStore, ownerID int, tag string) string {
+	t.Helper()
+
+	history, err := s.History(context.Background(), ownerID, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := make([]string, 0, len(history))
+	for _, msg := range history {
+		texts = append(texts, msg.Text)
+	}
+	return strings.Join(texts, ",")
+}
+
+func TestMessageStoreHistory(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name   string
+		change func(ctx context.Context, s messageStore, msgs []*dbMessage) error
+		tag    string
+		want   string
+	}{
+		{name: "whole history in order", want: "q1,a1,q2,a2"},
+		{name: "history with the tag", tag: "work", want: "q2,a2"},
+		{name: "history with unknown tag", tag: "home", want: ""},
+		{
+			name: "old messages deleted",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				return s.DeleteOld(ctx, 1, 3)
+			},
+			want: "a1,q2,a2",
+		},
+		{
+			name: "expired messages deleted",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				return s.DeleteExpired(ctx, 1, start.Add(2*time.Second))
+			},
+			want: "q2,a2",
+		},
+		{
+			name: "messages deleted from the edited one",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				return s.DeleteFrom(ctx, 1, msgs[2].ID)
+			},
+			want: "q1,a1",
+		},
+		{
+			name: "tags of deleted messages are not reused",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				if err := s.DeleteFrom(ctx, 1, msgs[2].ID); err != nil {
+					return err
+				}
+				return s.SaveAll(ctx, []*dbMessage{{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "q3", CreatedAt: start.Add(4 * time.Second)}}, nil)
+			},
+			tag:  "work",
+			want: "",
+		},
+		{
+			name: "all messages deleted",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				return s.DeleteAll(ctx, 1)
+			},
+			want: "",
+		},
+		{
+			name: "history replaced",
+			change: func(ctx context.Context, s messageStore, msgs []*dbMessage) error {
+				return s.ReplaceAll(ctx, 1, []*dbMessage{
+					{UserID: 1, Role: messageRoleUser, Text: "imported", CreatedAt: start},
+					{Role: messageRoleAssistant, Text: "reply", CreatedAt: start.Add(time.Second)},
+				})
+			},
+			want: "imported,reply",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s testStore) {
+				msgs := saveTestConversation(t, s, start)
+				if tt.change != nil {
+					if err := tt.change(context.Background(), s, msgs); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if got := historyTexts(t, s, 1, tt.tag); got != tt.want {
+					t.Errorf("history = %q, want %q", got, tt.want)
+				}
+				if got := historyTexts(t, s, 2, ""); got != "other" {
+					t.Errorf("history of the other user = %q, want it left as is", got)
+				}
+			})
+		})
+	}
+}
+
+func TestMessageStoreDeleteOldKeepsNewestMessages(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	forEachStore(t, func(t *testing.T, s testStore) {
+		ctx := context.Background()
+		// IDs don't follow the creation time, "m3" and "m4" are created at the same time
+		for _, msg := range []struct {
+			text    string
+			seconds int
+		}{{"m5", 5}, {"m1", 1}, {"m3", 3}, {"m4", 3}, {"m2", 2}, {"m6", 6}} {
+			if err := s.Save(ctx, &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: msg.text, CreatedAt: start.Add(time.Duration(msg.seconds) * time.Second)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.DeleteOld(ctx, 1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if got := historyTexts(t, s, 1, ""); got != "m4,m5,m6" {
+			t.Errorf("history = %q, want the newest 3 messages", got)
+		}
+	})
+}
+
+func TestMessageStoreSaveAllSkipsSavedMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s testStore) {
+		ctx := context.Background()
+		humanMsg := &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "q", CreatedAt: time.Now()}
+		if err := s.SaveAll(ctx, []*dbMessage{humanMsg}, nil); err != nil {
+			t.Fatal(err)
+		}
+		id := humanMsg.ID
+
+		// The message answered again with /retry is saved already
+		aiMsg := &dbMessage{OwnerID: 1, Role: messageRoleAssistant, Text: "a", CreatedAt: time.Now().Add(time.Second)}
+		if err := s.SaveAll(ctx, []*dbMessage{humanMsg, aiMsg}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if humanMsg.ID != id || aiMsg.ID == 0 {
+			t.Errorf("IDs are %d and %d, want %d and the new one", humanMsg.ID, aiMsg.ID, id)
+		}
+		if got := historyTexts(t, s, 1, ""); got != "q,a" {
+			t.Errorf("history = %q, want %q", got, "q,a")
+		}
+	})
+}
+
+func TestMessageStoreConversationState(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name         string
+		lastReason   string
+		wantEmpty    bool
+		wantTruncate bool
+	}{
+		{name: "no conversation", wantEmpty: true},
+		{name: "complete reply", lastReason: "stop"},
+		{name: "truncated reply", lastReason: finishReasonLength, wantTruncate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s testStore) {
+				ctx := context.Background()
+				if !tt.wantEmpty {
+					msgs := []*dbMessage{
+						{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "q", CreatedAt: start},
+						{OwnerID: 1, Role: messageRoleAssistant, Text: "a", CreatedAt: start.Add(time.Second), FinishReason: tt.lastReason},
+					}
+					if err := s.SaveAll(ctx, msgs, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				empty, err := s.IsEmpty(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				truncated, err := s.LastReplyTruncated(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if empty != tt.wantEmpty || truncated != tt.wantTruncate {
+					t.Errorf("empty = %v, truncated = %v, want %v, %v", empty, truncated, tt.wantEmpty, tt.wantTruncate)
+				}
+			})
+		})
+	}
+}
+
+func TestMessageStoreRatingsAndUsage(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name      string
+		ownerID   int
+		message   int // index of the rated message of the user 1
+		wantFound bool
+	}{
+		{name: "reply is rated", ownerID: 1, message: 1, wantFound: true},
+		{name: "human message is not rated", ownerID: 1, message: 0},
+		{name: "reply of the other conversation is not rated", ownerID: 2, message: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s testStore) {
+				ctx := context.Background()
+				msgs := saveTestConversation(t, s, start)
+
+				found, err := s.Rate(ctx, tt.ownerID, msgs[tt.message].ID, ratingUp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found != tt.wantFound {
+					t.Errorf("reply is found = %v, want %v", found, tt.wantFound)
+				}
+				up, down, err := s.RatingStats(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wantUp := map[bool]int{true: 1}[tt.wantFound]; up != wantUp || down != 0 {
+					t.Errorf("ratings = %d up, %d down, want %d up", up, down, wantUp)
+				}
+
+				usage, err := s.TokenUsage(ctx, 1, start.Add(2*time.Second))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if usage.total != 20 {
+					t.Errorf("tokens used = %d, want 20", usage.total)
+				}
+			})
+		})
+	}
+}
+
+func TestMessageStoreSummaries(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name        string
+		deleteFrom  int // index of the message of the user 1 the history is deleted from, -1 if it is not
+		wantSummary bool
+	}{
+		{name: "summary is kept", deleteFrom: -1, wantSummary: true},
+		{name: "summary of earlier messages is kept", deleteFrom: 2, wantSummary: true},
+		{name: "summary of deleted messages is deleted", deleteFrom: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s testStore) {
+				ctx := context.Background()
+				msgs := saveTestConversation(t, s, start)
+				if err := s.SaveSummary(ctx, 1, "", conversationSummary{text: "greeting", throughID: msgs[1].ID}); err != nil {
+					t.Fatal(err)
+				}
+				if tt.deleteFrom >= 0 {
+					if err := s.DeleteFrom(ctx, 1, msgs[tt.deleteFrom].ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				summary, err := s.Summary(ctx, 1, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := summary.text != ""; got != tt.wantSummary {
+					t.Errorf("summary is there = %v, want %v", got, tt.wantSummary)
+				}
+			})
+		})
+	}
+}
+
+func TestSettingsAndActivityStores(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		name string
+		// run changes the store and returns what is read back.
+		run  func(ctx context.Context, s testStore) (any, error)
+		want string
+	}{
+		{
+			name: "chat setting",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SetChatSetting(ctx, 1, chatSettingFormat, formatPlain); err != nil {
+					return nil, err
+				}
+				if err := s.SetChatSetting(ctx, 2, chatSettingFormat, formatMarkdown); err != nil {
+					return nil, err
+				}
+				return s.ChatSetting(ctx, 1, chatSettingFormat)
+			},
+			want: formatPlain,
+		},
+		{
+			name: "unset chat setting",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				return s.ChatSetting(ctx, 1, chatSettingFocus)
+			},
+			want: "",
+		},
+		{
+			name: "user model replaced",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SaveUserModel(ctx, 1, "gpt-4"); err != nil {
+					return nil, err
+				}
+				if err := s.SaveUserModel(ctx, 1, "gpt-3.5-turbo"); err != nil {
+					return nil, err
+				}
+				return s.UserModel(ctx, 1)
+			},
+			want: "gpt-3.5-turbo",
+		},
+		{
+			name: "user persona deleted",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SaveUserPersona(ctx, 1, "pirate", now); err != nil {
+					return nil, err
+				}
+				if err := s.DeleteUserPersona(ctx, 1); err != nil {
+					return nil, err
+				}
+				return s.UserPersona(ctx, 1)
+			},
+			want: "",
+		},
+		{
+			name: "user max tokens",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SaveUserMaxTokens(ctx, 1, 200); err != nil {
+					return nil, err
+				}
+				return s.UserMaxTokens(ctx, 1)
+			},
+			want: "200",
+		},
+		{
+			name: "last processed update",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				for _, id := range []int{5, 6} {
+					if err := s.SaveLastUpdateID(ctx, 1, id); err != nil {
+						return nil, err
+					}
+				}
+				return s.LastUpdateID(ctx, 1)
+			},
+			want: "6",
+		},
+		{
+			name: "daily message count of today only",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				for _, day := range []time.Time{now.AddDate(0, 0, -1), now, now} {
+					if err := s.IncrementDailyMessageCount(ctx, 1, day); err != nil {
+						return nil, err
+					}
+				}
+				return s.DailyMessageCount(ctx, 1, now)
+			},
+			want: "2",
+		},
+		{
+			name: "chat error cleared",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SaveChatError(ctx, &dbChatError{ChatID: 1, Text: "timeout", CreatedAt: now}); err != nil {
+					return nil, err
+				}
+				if err := s.DeleteChatError(ctx, 1); err != nil {
+					return nil, err
+				}
+				chatErr, err := s.ChatError(ctx, 1)
+				return chatErr == nil, err
+			},
+			want: "true",
+		},
+		{
+			name: "last chat error",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				for _, text := range []string{"timeout", "rate limit"} {
+					if err := s.SaveChatError(ctx, &dbChatError{ChatID: 1, Text: text, CreatedAt: now}); err != nil {
+						return nil, err
+					}
+				}
+				chatErr, err := s.ChatError(ctx, 1)
+				if err != nil {
+					return nil, err
+				}
+				return chatErr.Text, nil
+			},
+			want: "rate limit",
+		},
+		{
+			name: "feedback statistics",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				for _, rating := range []string{feedbackGood, feedbackGood, feedbackBad} {
+					if err := s.SaveFeedback(ctx, &dbFeedback{ChatID: 1, UserID: 1, Rating: rating, CreatedAt: now}); err != nil {
+						return nil, err
+					}
+				}
+				good, bad, err := s.FeedbackStats(ctx)
+				return fmt.Sprint(good, bad), err
+			},
+			want: "2 1",
+		},
+		{
+			name: "message starred twice",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				for i := 0; i < 2; i++ {
+					if err := s.SaveStar(ctx, &dbStarredMessage{ChatID: 1, UserID: 1, MessageID: 10, Text: "star", CreatedAt: now}); err != nil {
+						return nil, err
+					}
+				}
+				chats, err := s.StarredChats(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+				if err != nil {
+					return nil, err
+				}
+				stars, err := s.StarredMessages(ctx, 1, now.Add(-time.Hour), now.Add(time.Hour))
+				return fmt.Sprint(chats, len(stars)), err
+			},
+			want: "[1] 1",
+		},
+		{
+			name: "star out of the period",
+			run: func(ctx context.Context, s testStore) (any, error) {
+				if err := s.SaveStar(ctx, &dbStarredMessage{ChatID: 1, UserID: 1, MessageID: 10, Text: "star", CreatedAt: now}); err != nil {
+					return nil, err
+				}
+				return s.StarredChats(ctx, now.Add(time.Second), now.Add(time.Hour))
+			},
+			want: "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s testStore) {
+				got, err := tt.run(context.Background(), s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(got) != tt.want {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		})
+	}
+}
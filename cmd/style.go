@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingStyle = "style"
+
+	styleDefault = "default"
+)
+
+// responseStyles maps style names to instructions prepended to the system prompt.
+var responseStyles = map[string]string{
+	"formal":    "Answer in a formal and polite tone.",
+	"casual":    "Answer in a casual, conversational tone.",
+	"technical": "Answer with precise technical details and terminology.",
+	"eli5":      "Explain everything in simple words, as if to a five-year-old.",
+}
+
+func applyStyle(system string, style string) string {
+	instruction, ok := responseStyles[style]
+	if !ok {
+		return system
+	}
+	return instruction + " " + system
+}
+
+func styleNames() []string {
+	names := make([]string, 0, len(responseStyles))
+	for name := range responseStyles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *messageProcessor) handleStyleCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	style := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+	available := strings.Join(append(styleNames(), styleDefault), ", ")
+
+	if style == "" {
+		current, err := p.settings.ChatSetting(ctx, chatID, chatSettingStyle)
+		if err != nil {
+			slog.Error("failed to get chat style", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		if current == "" {
+			current = styleDefault
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Current style is %v. Available styles: %v.", current, available))
+		return
+	}
+
+	if _, ok := responseStyles[style]; !ok && style != styleDefault {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Unknown style '%v'. Available styles: %v.", style, available))
+		return
+	}
+
+	value := style
+	if style == styleDefault {
+		value = ""
+	}
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingStyle, value); err != nil {
+		slog.Error("failed to save chat style", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Style is set to %v.", style))
+}
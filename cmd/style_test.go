@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestApplyStyle(t *testing.T) {
+	tests := []struct {
+		style string
+		want  string
+	}{
+		{style: "formal", want: responseStyles["formal"] + " Be nice."},
+		{style: "eli5", want: responseStyles["eli5"] + " Be nice."},
+		{style: "", want: "Be nice."},
+		{style: "unknown", want: "Be nice."},
+	}
+	for _, tt := range tests {
+		if got := applyStyle("Be nice.", tt.style); got != tt.want {
+			t.Errorf("applyStyle(%q) = %q, want %q", tt.style, got, tt.want)
+		}
+	}
+}
+
+func TestStyleAppearsInPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		// commands are sent before the message, the style they set is checked in its prompt.
+		commands []string
+		want     string
+	}{
+		{name: "no style", want: ""},
+		{name: "formal", commands: []string{"/style formal"}, want: responseStyles["formal"]},
+		{name: "style is changed", commands: []string{"/style formal", "/style technical"}, want: responseStyles["technical"]},
+		{name: "style is reset", commands: []string{"/style casual", "/style default"}, want: ""},
+		{name: "unknown style is not set", commands: []string{"/style pirate"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("hi", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.persona = gptSystemPrompt
+
+			for _, command := range tt.commands {
+				p.processMessage(context.Background(), commandMessage(1, command))
+			}
+			p.processMessage(context.Background(), privateMessage(1, "hello"))
+
+			system := completions.lastRequest().Messages[0]
+			if system.Role != openai.ChatMessageRoleSystem {
+				t.Fatalf("first message is %v, want the system prompt", system.Role)
+			}
+			if want := strings.TrimSpace(tt.want + " " + gptSystemPrompt); system.Content != want {
+				t.Errorf("system prompt = %q, want %q", system.Content, want)
+			}
+		})
+	}
+}
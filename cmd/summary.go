@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// summaryModel is the model conversations are summarized with, the cheapest one is good enough for it.
+	summaryModel     = openai.GPT3Dot5Turbo
+	summaryMaxTokens = 256
+
+	summaryPrompt = "Summarize the following conversation between a human and an AI assistant in a few sentences. " +
+		"Keep facts, names and decisions that may matter later in the conversation.\n" +
+		"%s" +
+		"\nConversation:\n%s\n" +
+		"\nSummary:"
+	summaryPreviousPrompt = "\nSummary of the conversation before it:\n%s\n"
+
+	summarySystemPrompt = "\n\nSummary of the earlier conversation: "
+)
+
+// conversationSummary is the summary of the conversation messages up to the one with throughID.
+type conversationSummary struct {
+	text      string
+	throughID int
+}
+
+// buildPromptWithSummary builds the prompt with the build function, the summary of the earlier conversation
+// is added to the system prompt. If older messages still have to be trimmed to fit the prompt into the model context,
+// they are summarized together with the older half of the history, so that the summary isn't updated every turn.
+func (p *messageProcessor) buildPromptWithSummary(
+	ctx context.Context,
+	ownerID int,
+	focus string,
+	system string,
+	history []*dbMessage,
+	build func(system string, history []*dbMessage) (modelPrompt, int, error),
+) (modelPrompt, error) {
+	summary, err := p.messages.Summary(ctx, ownerID, focus)
+	if err != nil {
+		return modelPrompt{}, err
+	}
+	history = messagesAfter(history, summary.throughID)
+
+	prompt, trimmedThroughID, err := build(withSummary(system, summary.text), history)
+	if err != nil || trimmedThroughID == 0 {
+		return prompt, err
+	}
+
+	throughID := max(trimmedThroughID, olderHalfThroughID(history))
+	text, err := p.summarize(ctx, summary.text, messagesThrough(history, throughID))
+	if err != nil {
+		// Conversation is answered without the trimmed messages, the same as with summarization disabled
+		slog.Error("failed to summarize conversation", "error", err)
+		return prompt, nil
+	}
+	summary = conversationSummary{text: text, throughID: throughID}
+	if err := p.messages.SaveSummary(ctx, ownerID, focus, summary); err != nil {
+		slog.Error("failed to save conversation summary", "error", err)
+	}
+	log.Println("summarized conversation through message", throughID)
+
+	prompt, _, err = build(withSummary(system, summary.text), messagesAfter(history, summary.throughID))
+	return prompt, err
+}
+
+// summarize returns the summary of the previous summary followed by the messages.
+// Messages that don't fit into one request are summarized in parts, each part with the summary of the previous ones.
+func (p *messageProcessor) summarize(ctx context.Context, previous string, messages []*dbMessage) (string, error) {
+	lines := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		if msg.isHuman() {
+			lines = append(lines, "Human: "+msg.Text)
+		} else {
+			lines = append(lines, "AI: "+msg.Text)
+		}
+	}
+
+	// Summary is never longer than summaryMaxTokens, so the space for it is reserved in advance
+	chunkTokens := modelContextLength(summaryModel) - 2*summaryMaxTokens - chatReplyTokensOverhead - chatMessageTokensOverhead -
+		p.tokenCounterFor(summaryModel)(fmt.Sprintf(summaryPrompt, fmt.Sprintf(summaryPreviousPrompt, ""), ""))
+	summary := previous
+	for _, chunk := range splitDocument(p.tokenCounterFor(summaryModel), strings.Join(lines, "\n\n"), chunkTokens) {
+		previousPrompt := ""
+		if summary != "" {
+			previousPrompt = fmt.Sprintf(summaryPreviousPrompt, summary)
+		}
+		prompt := modelPrompt{model: summaryModel, messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf(summaryPrompt, previousPrompt, chunk)},
+		}}
+		c, err := p.completeWithMaxTokens(ctx, prompt, summaryMaxTokens)
+		if err != nil {
+			return "", err
+		}
+		summary = strings.TrimSpace(c.Text)
+	}
+	return summary, nil
+}
+
+func withSummary(system, summary string) string {
+	if summary == "" {
+		return system
+	}
+	return system + summarySystemPrompt + summary
+}
+
+// olderHalfThroughID returns the ID of the last message of the older half of the history,
+// the half ends before a human message so that it has whole exchanges only.
+func olderHalfThroughID(history []*dbMessage) int {
+	i := len(history) / 2
+	for i < len(history) && !history[i].isHuman() {
+		i++
+	}
+	if i == 0 {
+		return 0
+	}
+	return history[i-1].ID
+}
+
+func messagesAfter(history []*dbMessage, id int) []*dbMessage {
+	for i, msg := range history {
+		if msg.ID > id {
+			return history[i:]
+		}
+	}
+	return nil
+}
+
+func messagesThrough(history []*dbMessage, id int) []*dbMessage {
+	for i, msg := range history {
+		if msg.ID > id {
+			return history[:i]
+		}
+	}
+	return history
+}
+
+// getConversationSummary returns the summary of the conversation scoped to the tag, empty one if there is none.
+func getConversationSummary(ctx context.Context, db *sql.DB, ownerID int, tag string) (conversationSummary, error) {
+	const query = `
+		SELECT summary, through_message_id FROM conversation_summaries WHERE owner_id = ? AND tag = ?
+	`
+
+	var summary conversationSummary
+	if err := db.QueryRowContext(ctx, query, ownerID, tag).Scan(&summary.text, &summary.throughID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return conversationSummary{}, nil
+		}
+		return conversationSummary{}, fmt.Errorf("failed to get conversation summary from the database: %w", err)
+	}
+	return summary, nil
+}
+
+func saveConversationSummary(ctx context.Context, db *sql.DB, ownerID int, tag string, summary conversationSummary) error {
+	const query = `
+		INSERT INTO conversation_summaries(owner_id, tag, summary, through_message_id)
+		VALUES(?, ?, ?, ?)
+		ON CONFLICT(owner_id, tag) DO UPDATE SET summary = excluded.summary, through_message_id = excluded.through_message_id
+	`
+
+	if _, err := db.ExecContext(ctx, query, ownerID, tag, summary.text, summary.throughID); err != nil {
+		return fmt.Errorf("failed to save conversation summary to the database: %w", err)
+	}
+	return nil
+}
+
+// deleteConversationSummaries deletes summaries of the conversation that cover the message with the ID or later ones,
+// all summaries of the conversation if the ID is zero.
+func deleteConversationSummaries(ctx context.Context, db *sql.DB, ownerID, messageID int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM conversation_summaries WHERE owner_id = ? AND through_message_id >= ?", ownerID, messageID); err != nil {
+		return fmt.Errorf("failed to delete conversation summaries from database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeSummarizer answers summary requests with "the summary" and other requests with "the reply",
+// summary requests fail if failSummary is set.
+type fakeSummarizer struct {
+	mu          sync.Mutex
+	failSummary bool
+	summaries   []openai.ChatCompletionRequest
+	replies     []openai.ChatCompletionRequest
+}
+
+func (f *fakeSummarizer) handle(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := "the reply"
+	if strings.HasPrefix(req.Messages[0].Content, "Summarize the following conversation") {
+		if f.failSummary {
+			http.Error(w, `{"error":{"message":"invalid request","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			return
+		}
+		f.summaries = append(f.summaries, req)
+		reply = "the summary"
+	} else {
+		f.replies = append(f.replies, req)
+	}
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{chatChoice(reply, openai.FinishReasonStop)}})
+}
+
+// longHistory returns the exchanges of about 300 tokens per message, exchanges come as "q1", "a1" and so on.
+func longHistory(exchanges int) []*dbMessage {
+	var messages []string
+	for i := 1; i <= exchanges; i++ {
+		words := strings.Repeat(" word", 300)
+		messages = append(messages, fmt.Sprintf("human q%d%s", i, words), fmt.Sprintf("ai a%d%s", i, words))
+	}
+	history := testHistory(messages...)
+	for _, msg := range history {
+		msg.ID = 0
+	}
+	return history
+}
+
+func TestSummaryIsInjectedIntoPrompt(t *testing.T) {
+	tests := []struct {
+		name        string
+		exchanges   int
+		failSummary bool
+		// wantSummarized is the last exchange that is summarized, zero if there is no summary.
+		wantSummarized int
+	}{
+		{name: "history fits", exchanges: 2},
+		{name: "trimmed history is summarized", exchanges: 10, wantSummarized: 5},
+		{name: "prompt without summary if summarization fails", exchanges: 10, failSummary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			api := &fakeSummarizer{failSummary: tt.failSummary}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+			p.gptClient = newTestOpenAIClient(t, api.handle)
+			p.summarization = true
+			if err := p.messages.SaveAll(ctx, longHistory(tt.exchanges), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			p.processMessage(ctx, privateMessage(1, "new"))
+
+			if got := telegram.last(); got != "the reply" {
+				t.Fatalf("reply = %q, want it answered", got)
+			}
+			system := api.replies[0].Messages[0].Content
+			if got := strings.Contains(system, summarySystemPrompt+"the summary"); got != (tt.wantSummarized > 0) {
+				t.Errorf("system prompt = %q, want summary %v", system, tt.wantSummarized > 0)
+			}
+			if tt.wantSummarized == 0 {
+				if len(api.summaries) > 0 {
+					t.Errorf("summary requests = %d, want none", len(api.summaries))
+				}
+				return
+			}
+
+			// Older half of the history is summarized, so that is what the prompt is left without
+			if len(api.summaries) != 1 {
+				t.Fatalf("summary requests = %d, want 1", len(api.summaries))
+			}
+			summarized := api.summaries[0].Messages[0].Content
+			last, next := fmt.Sprintf("\nAI: a%d ", tt.wantSummarized), fmt.Sprintf("Human: q%d ", tt.wantSummarized+1)
+			if !strings.Contains(summarized, "Human: q1 ") || !strings.Contains(summarized, last) || strings.Contains(summarized, next) {
+				t.Errorf("summarized conversation doesn't end with exchange %d", tt.wantSummarized)
+			}
+			for _, msg := range api.replies[0].Messages[1:] {
+				if strings.HasPrefix(msg.Content, fmt.Sprintf("a%d ", tt.wantSummarized)) {
+					t.Errorf("summarized message %q is in the prompt too", msg.Content[:10])
+				}
+			}
+
+			// Summary is saved and used for the next message without summarizing again
+			summary, err := p.messages.Summary(ctx, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.text != "the summary" || summary.throughID == 0 {
+				t.Errorf("saved summary = %+v, want the summary", summary)
+			}
+			p.processMessage(ctx, privateMessage(1, "next"))
+			if len(api.summaries) != 1 {
+				t.Errorf("summary requests = %d, want the saved summary reused", len(api.summaries))
+			}
+			if system := api.replies[1].Messages[0].Content; !strings.HasSuffix(system, summarySystemPrompt+"the summary") {
+				t.Errorf("system prompt of the next message = %q, want the saved summary", system)
+			}
+		})
+	}
+}
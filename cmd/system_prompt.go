@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	promptSectionPersona    = "persona"
+	promptSectionRules      = "rules"
+	promptSectionFormatting = "formatting"
+
+	chatSettingPromptSectionPrefix = "prompt_section_"
+
+	promptSectionOn  = "on"
+	promptSectionOff = "off"
+)
+
+// promptSection is a part of the system prompt that can be turned off per chat.
+type promptSection struct {
+	name string
+	text string
+}
+
+// promptSections returns the configured sections of the system prompt in the order they are assembled.
+// Sections without text are not configured and are always left out.
+func (p *messageProcessor) promptSections(persona string) []promptSection {
+	return []promptSection{
+		{name: promptSectionPersona, text: withDisplayName(persona, p.botDisplayName)},
+		{name: promptSectionRules, text: p.systemPromptRules},
+		{name: promptSectionFormatting, text: p.systemPromptFormatting},
+	}
+}
+
+// systemPrompt returns the system prompt for the user in the chat: the sections enabled in the chat
+// with the user's persona and the chat's response style applied.
+func (p *messageProcessor) systemPrompt(ctx context.Context, chatID int64, userID int) (string, error) {
+	style, err := p.settings.ChatSetting(ctx, chatID, chatSettingStyle)
+	if err != nil {
+		return "", err
+	}
+	persona, err := p.userPersona(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	sections := p.promptSections(persona)
+	parts := make([]string, 0, len(sections))
+	for _, section := range sections {
+		if section.text == "" {
+			continue
+		}
+		enabled, err := getChatPromptSectionEnabled(ctx, p.settings, chatID, section.name)
+		if err != nil {
+			return "", err
+		}
+		if enabled {
+			parts = append(parts, section.text)
+		}
+	}
+
+	return applyStyle(strings.Join(parts, " "), style), nil
+}
+
+func withDisplayName(system string, displayName string) string {
+	if displayName == "" {
+		return system
+	}
+	return system + fmt.Sprintf(" The assistant's name is %v.", displayName)
+}
+
+// getChatPromptSectionEnabled reports whether the section of the system prompt is used in the chat, sections are on by default.
+func getChatPromptSectionEnabled(ctx context.Context, settings settingsStore, chatID int64, name string) (bool, error) {
+	value, err := settings.ChatSetting(ctx, chatID, chatSettingPromptSectionPrefix+name)
+	if err != nil {
+		return false, err
+	}
+	return value != promptSectionOff, nil
+}
+
+// handlePromptSectionCommand turns the section of the system prompt on or off in the chat, e.g. /rules off.
+func (p *messageProcessor) handlePromptSectionCommand(ctx context.Context, update tgbotapi.Update, parseMode string, name string) {
+	chatID := update.Message.Chat.ID
+	mode := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	var text string
+	for _, section := range p.promptSections(p.persona) {
+		if section.name == name {
+			text = section.text
+		}
+	}
+	if text == "" {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("The %v section of the system prompt is not configured.", name))
+		return
+	}
+
+	if mode == "" {
+		enabled, err := getChatPromptSectionEnabled(ctx, p.settings, chatID, name)
+		if err != nil {
+			slog.Error("failed to get chat prompt section", "section", name, "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		current := promptSectionOff
+		if enabled {
+			current = promptSectionOn
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("The %v section of the system prompt is %v. Use /%v %v|%v to change it.", name, current, name, promptSectionOn, promptSectionOff))
+		return
+	}
+
+	if mode != promptSectionOn && mode != promptSectionOff {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Unknown mode '%v'. Use /%v %v|%v.", mode, name, promptSectionOn, promptSectionOff))
+		return
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingPromptSectionPrefix+name, mode); err != nil {
+		slog.Error("failed to save chat prompt section", "section", name, "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("The %v section of the system prompt is %v.", name, mode))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestDisplayNameInSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name        string
+		displayName string
+		want        string
+	}{
+		{name: "name is set", displayName: "Max", want: gptSystemPrompt + " The assistant's name is Max."},
+		{name: "name is not set", want: gptSystemPrompt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("I'm Max", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.persona = gptSystemPrompt
+			p.botDisplayName = tt.displayName
+
+			p.processMessage(context.Background(), privateMessage(1, "what's your name?"))
+
+			system := completions.lastRequest().Messages[0]
+			if system.Role != openai.ChatMessageRoleSystem || system.Content != tt.want {
+				t.Errorf("system prompt = %q, want %q", system.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptSectionCommandsChangeSystemPrompt(t *testing.T) {
+	const persona, rules, formatting = "You are a pirate.", "Never lie.", "Use short paragraphs."
+
+	tests := []struct {
+		name     string
+		commands []string
+		want     string
+	}{
+		{name: "all sections are on by default", want: persona + " " + rules + " " + formatting},
+		{name: "rules are turned off", commands: []string{"/rules off"}, want: persona + " " + formatting},
+		{name: "rules are turned on again", commands: []string{"/rules off", "/rules on"}, want: persona + " " + rules + " " + formatting},
+		{name: "persona is turned off", commands: []string{"/persona off"}, want: rules + " " + formatting},
+		{name: "formatting is turned off", commands: []string{"/formatting OFF"}, want: persona + " " + rules},
+		{name: "unknown mode changes nothing", commands: []string{"/rules maybe"}, want: persona + " " + rules + " " + formatting},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("arr", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			p.persona, p.systemPromptRules, p.systemPromptFormatting = persona, rules, formatting
+
+			for _, command := range tt.commands {
+				p.processMessage(context.Background(), commandMessage(1, command))
+			}
+			p.processMessage(context.Background(), privateMessage(1, "hello"))
+
+			if got := completions.lastRequest().Messages[0].Content; got != tt.want {
+				t.Errorf("system prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptSectionCommandOfUnconfiguredSection(t *testing.T) {
+	telegram := &fakeTelegram{}
+	p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+	p.persona = gptSystemPrompt
+
+	p.processMessage(context.Background(), commandMessage(1, "/rules off"))
+
+	if want := "The rules section of the system prompt is not configured."; telegram.last() != want {
+		t.Errorf("reply = %q, want %q", telegram.last(), want)
+	}
+	if value, _ := p.settings.ChatSetting(context.Background(), 1, chatSettingPromptSectionPrefix+promptSectionRules); value != "" {
+		t.Errorf("section setting is saved: %q", value)
+	}
+}
+
+func TestSystemPromptOfSectionToggles(t *testing.T) {
+	const persona, rules, formatting = "You are a pirate.", "Never lie.", "Use short paragraphs."
+
+	tests := []struct {
+		persona, rules, formatting string
+		want                       string
+	}{
+		{persona: promptSectionOn, rules: promptSectionOn, formatting: promptSectionOn, want: "You are a pirate. The assistant's name is Max. Never lie. Use short paragraphs."},
+		{persona: promptSectionOn, rules: promptSectionOn, formatting: promptSectionOff, want: "You are a pirate. The assistant's name is Max. Never lie."},
+		{persona: promptSectionOn, rules: promptSectionOff, formatting: promptSectionOn, want: "You are a pirate. The assistant's name is Max. Use short paragraphs."},
+		{persona: promptSectionOn, rules: promptSectionOff, formatting: promptSectionOff, want: "You are a pirate. The assistant's name is Max."},
+		// Display name is a part of the persona
+		{persona: promptSectionOff, rules: promptSectionOn, formatting: promptSectionOn, want: "Never lie. Use short paragraphs."},
+		{persona: promptSectionOff, rules: promptSectionOn, formatting: promptSectionOff, want: "Never lie."},
+		{persona: promptSectionOff, rules: promptSectionOff, formatting: promptSectionOn, want: "Use short paragraphs."},
+		{persona: promptSectionOff, rules: promptSectionOff, formatting: promptSectionOff, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.persona+" "+tt.rules+" "+tt.formatting, func(t *testing.T) {
+			ctx := context.Background()
+			p := newTestProcessor(t, &fakeTelegram{}, &fakeChatCompletions{})
+			p.persona, p.systemPromptRules, p.systemPromptFormatting = persona, rules, formatting
+			p.botDisplayName = "Max"
+			sections := map[string]string{promptSectionPersona: tt.persona, promptSectionRules: tt.rules, promptSectionFormatting: tt.formatting}
+			for name, mode := range sections {
+				if err := p.settings.SetChatSetting(ctx, 1, chatSettingPromptSectionPrefix+name, mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := p.systemPrompt(ctx, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("system prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
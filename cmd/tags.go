@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	chatSettingFocus = "focus"
+
+	focusOff = "off"
+)
+
+var tagRegexp = regexp.MustCompile(`(?:^|\s)#(\w+)`)
+
+// parseTags returns unique lowercase tags like "#worktag" found in the message text.
+func parseTags(text string) []string {
+	matches := tagRegexp.FindAllStringSubmatch(text, -1)
+
+	tags := make([]string, 0, len(matches))
+	for _, match := range matches {
+		tags = appendTag(tags, match[1])
+	}
+	return tags
+}
+
+func appendTag(tags []string, tag string) []string {
+	tag = normalizeTag(tag)
+	if tag == "" {
+		return tags
+	}
+	for _, t := range tags {
+		if t == tag {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+func saveMessageTags(ctx context.Context, db sqlExecutor, messageID int, tags []string) error {
+	const query = `
+		INSERT INTO message_tags(message_id, tag)
+		VALUES(?, ?)
+		ON CONFLICT(message_id, tag) DO NOTHING
+	`
+
+	for _, tag := range tags {
+		if _, err := db.ExecContext(ctx, query, messageID, tag); err != nil {
+			return fmt.Errorf("failed to save message tag '%v' to the database: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func deleteOrphanMessageTags(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM message_tags WHERE message_id NOT IN (SELECT id FROM chat_history)"); err != nil {
+		return fmt.Errorf("failed to delete orphan message tags from database: %v", err)
+	}
+	return nil
+}
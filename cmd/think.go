@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultThinkModel       = openai.GPT4
+	defaultThinkTemperature = 0.2
+	defaultThinkMaxTokens   = 1024
+
+	thinkFooter = "\n\n(Answered by %s, thinking mode)"
+)
+
+// thinkCommandRegexp matches /think command at the start of the message, to strip it from the question.
+var thinkCommandRegexp = regexp.MustCompile(`^/` + commandThink + `(@\w+)?(\s|$)`)
+
+// thinkConfig is the configuration the /think question is answered with instead of the configured or chosen one,
+// for that single question. The conversation history is used the same way as for the regular message.
+type thinkConfig struct {
+	model     chatModel
+	sampling  samplingParams
+	maxTokens int
+}
+
+// newThinkConfig returns the thinking configuration with the model, the sampling parameters other than temperature
+// are the configured ones.
+func newThinkConfig(model string, sampling samplingParams, temperature float32, maxTokens int) thinkConfig {
+	sampling.temperature = temperature
+	return thinkConfig{model: knownModel(model), sampling: sampling, maxTokens: maxTokens}
+}
+
+// knownModel returns the selectable model with the name, the model used with chat completions API if it is unknown.
+func knownModel(name string) chatModel {
+	for _, m := range selectableModels {
+		if m.name == name {
+			return m
+		}
+	}
+	return chatModel{name: name}
+}
+
+// thinkQuestion returns the question asked with /think, false if the message is not the /think command.
+func thinkQuestion(text string) (string, bool) {
+	loc := thinkCommandRegexp.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+	return strings.TrimSpace(text[loc[1]:]), true
+}
+
+type thinkKey struct{}
+
+// withThinking returns the context of the message that is answered with the thinking configuration.
+func withThinking(ctx context.Context, think thinkConfig) context.Context {
+	return context.WithValue(ctx, thinkKey{}, think)
+}
+
+// thinking returns the thinking configuration the message is answered with, false if it is the regular message.
+func thinking(ctx context.Context) (thinkConfig, bool) {
+	think, ok := ctx.Value(thinkKey{}).(thinkConfig)
+	return think, ok
+}
+
+// withThinkFooter tells which model the reply is generated by, the footer is not saved to the history.
+func withThinkFooter(text string, model string) string {
+	return text + fmt.Sprintf(thinkFooter, model)
+}
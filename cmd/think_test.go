@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestThinkQuestion(t *testing.T) {
+	tests := []struct {
+		text   string
+		want   string
+		wantOk bool
+	}{
+		{text: "/think why is the sky blue", want: "why is the sky blue", wantOk: true},
+		{text: "/think@some_bot  why? ", want: "why?", wantOk: true},
+		{text: "/think", want: "", wantOk: true},
+		{text: "/thinking about it", wantOk: false},
+		{text: "think why", wantOk: false},
+	}
+	for _, tt := range tests {
+		got, ok := thinkQuestion(tt.text)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("thinkQuestion(%q) = %q, %v, want %q, %v", tt.text, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestThinkingDoesNotLeakIntoLaterTurns(t *testing.T) {
+	store := newMemoryStore()
+	p := &messageProcessor{
+		maxTokensToGenerate: 100,
+		messages:            store,
+		settings:            store,
+		activity:            store,
+		model:               chatModel{name: openai.GPT3Dot5Turbo},
+		sampling:            defaultSamplingParams,
+		countTokens:         newTokenCounter(openai.GPT3Dot5Turbo),
+		think:               newThinkConfig(openai.GPT4, defaultSamplingParams, 0.2, 1024),
+	}
+	humanMsg := &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "why is the sky blue", CreatedAt: time.Now()}
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		wantModel     string
+		wantSampling  samplingParams
+		wantMaxTokens int
+	}{
+		{
+			name:          "think question",
+			ctx:           withThinking(context.Background(), p.think),
+			wantModel:     openai.GPT4,
+			wantSampling:  p.think.sampling,
+			wantMaxTokens: 1024,
+		},
+		{
+			name:          "next regular message",
+			ctx:           context.Background(),
+			wantModel:     openai.GPT3Dot5Turbo,
+			wantSampling:  defaultSamplingParams,
+			wantMaxTokens: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := p.buildPromptWithHistory(tt.ctx, 1, "", nil, humanMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prompt.model != tt.wantModel {
+				t.Errorf("model = %q, want %q", prompt.model, tt.wantModel)
+			}
+			sampling := p.sampling
+			if prompt.sampling != nil {
+				sampling = *prompt.sampling
+			}
+			if sampling != tt.wantSampling {
+				t.Errorf("sampling = %v, want %v", sampling, tt.wantSampling)
+			}
+			if maxTokens, _ := p.chatMaxTokensToGenerate(tt.ctx, 1, 1, prompt); maxTokens != tt.wantMaxTokens {
+				t.Errorf("max tokens = %d, want %d", maxTokens, tt.wantMaxTokens)
+			}
+		})
+	}
+	if p.think.sampling.temperature != 0.2 || p.sampling.temperature != defaultSamplingParams.temperature {
+		t.Errorf("thinking temperature %v and configured temperature %v are mixed up", p.think.sampling.temperature, p.sampling.temperature)
+	}
+}
+
+func TestThinkTurnThenRegularTurn(t *testing.T) {
+	completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("the answer", openai.FinishReasonStop)}}
+	telegram := &fakeTelegram{}
+	p := newTestProcessor(t, telegram, completions)
+	p.think = newThinkConfig(openai.GPT4, p.sampling, 0.2, 1024)
+
+	tests := []struct {
+		name            string
+		text            string
+		wantModel       string
+		wantTemperature float32
+		wantMaxTokens   int
+		wantFooter      bool
+	}{
+		{name: "think", text: "/think why is the sky blue", wantModel: openai.GPT4, wantTemperature: 0.2, wantMaxTokens: 1024, wantFooter: true},
+		{name: "regular", text: "why is the sky blue", wantModel: openai.GPT3Dot5Turbo, wantTemperature: p.sampling.temperature, wantMaxTokens: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.processMessage(context.Background(), privateMessage(1, tt.text))
+
+			req := completions.lastRequest()
+			if req.Model != tt.wantModel || req.Temperature != tt.wantTemperature || req.MaxTokens != tt.wantMaxTokens {
+				t.Errorf("request model %q, temperature %v, max tokens %d, want %q, %v, %d",
+					req.Model, req.Temperature, req.MaxTokens, tt.wantModel, tt.wantTemperature, tt.wantMaxTokens)
+			}
+			if got := req.Messages[len(req.Messages)-1].Content; got != "why is the sky blue" {
+				t.Errorf("question = %q, want the command stripped", got)
+			}
+			footer := fmt.Sprintf(thinkFooter, openai.GPT4)
+			if got := strings.HasSuffix(telegram.last(), footer); got != tt.wantFooter {
+				t.Errorf("reply %q has the footer = %v, want %v", telegram.last(), got, tt.wantFooter)
+			}
+		})
+	}
+}
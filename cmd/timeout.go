@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	chatSettingTimeout = "timeout"
+	timeoutOff         = "off"
+
+	responseTimeoutMin = time.Second
+	responseTimeoutMax = 10 * time.Minute
+
+	responseTimeoutMessage = "That took too long, try rephrasing or use /retry."
+)
+
+// getChatResponseTimeout returns how long the chat waits for the model reply, zero means there is no limit.
+func getChatResponseTimeout(ctx context.Context, settings settingsStore, chatID int64) (time.Duration, error) {
+	value, err := settings.ChatSetting(ctx, chatID, chatSettingTimeout)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return time.ParseDuration(value)
+}
+
+func (p *messageProcessor) handleTimeoutCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	chatID := update.Message.Chat.ID
+	arg := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	if arg == "" {
+		current, err := getChatResponseTimeout(ctx, p.settings, chatID)
+		if err != nil {
+			slog.Error("failed to get chat response timeout", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		if current == 0 {
+			sendTextMessage(p.bot, chatID, parseMode, "There is no response timeout. Use /timeout <duration>, e.g. /timeout 30s, to set it.")
+			return
+		}
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Response timeout is %v. Use /timeout off to clear it.", current))
+		return
+	}
+
+	if arg == timeoutOff {
+		if err := p.settings.SetChatSetting(ctx, chatID, chatSettingTimeout, ""); err != nil {
+			slog.Error("failed to clear chat response timeout", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		sendTextMessage(p.bot, chatID, parseMode, "Response timeout is cleared.")
+		return
+	}
+
+	timeout, err := time.ParseDuration(arg)
+	if err != nil || timeout < responseTimeoutMin || timeout > responseTimeoutMax {
+		sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Invalid timeout '%v'. Use a duration from %v to %v, e.g. /timeout 30s.", arg, responseTimeoutMin, responseTimeoutMax))
+		return
+	}
+
+	if err := p.settings.SetChatSetting(ctx, chatID, chatSettingTimeout, timeout.String()); err != nil {
+		slog.Error("failed to save chat response timeout", "error", err)
+		p.sendErrorMessage(ctx, update, parseMode, err)
+		return
+	}
+
+	sendTextMessage(p.bot, chatID, parseMode, fmt.Sprintf("Response timeout is set to %v.", timeout))
+}
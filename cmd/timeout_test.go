@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestTimeoutCommand(t *testing.T) {
+	tests := []struct {
+		command   string
+		want      string
+		wantReply string
+	}{
+		{command: "/timeout 30s", want: "30s", wantReply: "Response timeout is set to 30s."},
+		{command: "/timeout 2M", want: "2m0s", wantReply: "Response timeout is set to 2m0s."},
+		{command: "/timeout 500ms", wantReply: "Invalid timeout"},
+		{command: "/timeout 11m", wantReply: "Invalid timeout"},
+		{command: "/timeout soon", wantReply: "Invalid timeout"},
+		{command: "/timeout off", wantReply: "Response timeout is cleared."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, &fakeChatCompletions{})
+
+			p.processMessage(context.Background(), commandMessage(1, tt.command))
+
+			if !strings.HasPrefix(telegram.last(), tt.wantReply) {
+				t.Errorf("reply = %q, want %q", telegram.last(), tt.wantReply)
+			}
+			if got, _ := p.settings.ChatSetting(context.Background(), 1, chatSettingTimeout); got != tt.want {
+				t.Errorf("timeout = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlowReplyTimesOut(t *testing.T) {
+	const replyTime = time.Second
+
+	tests := []struct {
+		name string
+		// timeout is the response timeout of the chat, it is set without the command to be shorter than it allows.
+		timeout string
+		// openAITimeout is OPENAI_TIMEOUT, the limit of each request to OpenAI.
+		openAITimeout time.Duration
+		wantReply     string
+	}{
+		{name: "reply within the timeout", timeout: "5s", openAITimeout: time.Minute, wantReply: "the answer"},
+		{name: "reply after the timeout", timeout: "50ms", openAITimeout: time.Minute, wantReply: responseTimeoutMessage},
+		{name: "reply after OPENAI_TIMEOUT", openAITimeout: 50 * time.Millisecond, wantReply: openAITimeoutMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("the answer", openai.FinishReasonStop)}}
+			telegram := &fakeTelegram{}
+			p := newTestProcessor(t, telegram, completions)
+			p.openAITimeout = tt.openAITimeout
+			cancelled := make(chan struct{}, 1)
+			p.gptClient = newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				// Server notices that the client is gone only once the request body is read
+				body, _ := io.ReadAll(r.Body)
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				select {
+				case <-time.After(replyTime):
+					completions.handle(w, r)
+				case <-r.Context().Done():
+					cancelled <- struct{}{}
+				}
+			})
+			ctx := context.Background()
+			if tt.timeout != "" {
+				if err := p.settings.SetChatSetting(ctx, 1, chatSettingTimeout, tt.timeout); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			start := time.Now()
+			p.processMessage(ctx, privateMessage(1, "hello"))
+
+			if got := telegram.last(); got != tt.wantReply {
+				t.Errorf("reply = %q, want %q", got, tt.wantReply)
+			}
+			if tt.wantReply == "the answer" {
+				return
+			}
+			if elapsed := time.Since(start); elapsed >= replyTime {
+				t.Errorf("reply is waited for %v after the timeout", elapsed)
+			}
+			// Request is cancelled rather than left running after the timeout
+			select {
+			case <-cancelled:
+			case <-time.After(replyTime):
+				t.Error("request is not cancelled")
+			}
+			if got := len(completions.requests); got != 0 {
+				t.Errorf("requests answered = %d, want 0", got)
+			}
+			// Message is left unanswered, so that the reply can be requested again with /retry
+			history, err := p.messages.History(ctx, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var texts []string
+			for _, msg := range history {
+				texts = append(texts, msg.Text)
+			}
+			if got := strings.Join(texts, ", "); !strings.Contains(got, "hello") || strings.Contains(got, "the answer") {
+				t.Errorf("history = %q, want the message without the reply", got)
+			}
+		})
+	}
+}
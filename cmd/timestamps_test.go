@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimestampsRoundTrip(t *testing.T) {
+	// Nanoseconds and the time zone are lost, the instant is kept to the millisecond
+	createdAt := time.Date(2023, 3, 15, 10, 30, 45, 123456789, time.FixedZone("UTC+3", 3*60*60))
+	want := createdAt.Truncate(time.Millisecond)
+
+	tests := []struct {
+		name string
+		// load saves the value with createdAt and returns the time it is loaded with.
+		load func(ctx context.Context, s *sqlStore) (time.Time, error)
+	}{
+		{
+			name: "chat history",
+			load: func(ctx context.Context, s *sqlStore) (time.Time, error) {
+				if err := s.Save(ctx, &dbMessage{UserID: 1, OwnerID: 1, Role: messageRoleUser, Text: "hello", CreatedAt: createdAt}); err != nil {
+					return time.Time{}, err
+				}
+				history, err := s.History(ctx, 1, "")
+				if err != nil || len(history) == 0 {
+					return time.Time{}, err
+				}
+				return history[0].CreatedAt, nil
+			},
+		},
+		{
+			name: "chat error",
+			load: func(ctx context.Context, s *sqlStore) (time.Time, error) {
+				if err := s.SaveChatError(ctx, &dbChatError{ChatID: 1, Text: "timeout", CreatedAt: createdAt}); err != nil {
+					return time.Time{}, err
+				}
+				chatErr, err := s.ChatError(ctx, 1)
+				if err != nil || chatErr == nil {
+					return time.Time{}, err
+				}
+				return chatErr.CreatedAt, nil
+			},
+		},
+		{
+			name: "starred message",
+			load: func(ctx context.Context, s *sqlStore) (time.Time, error) {
+				if err := s.SaveStar(ctx, &dbStarredMessage{ChatID: 1, UserID: 1, MessageID: 1, Text: "star", CreatedAt: createdAt}); err != nil {
+					return time.Time{}, err
+				}
+				// The star is found only in the millisecond it is starred in
+				stars, err := s.StarredMessages(ctx, 1, want, want.Add(time.Millisecond))
+				if err != nil || len(stars) == 0 {
+					return time.Time{}, err
+				}
+				return want, nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.load(context.Background(), newSQLStore(newTestDB(t)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("loaded time = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUnixTimeMigration(t *testing.T) {
+	const textTimeVersion = 20230314000000
+	createdAt := time.Date(2023, 3, 15, 10, 30, 45, 123456789, time.FixedZone("UTC+3", 3*60*60))
+
+	// The values are inserted the way they were before the migration, as the driver formats times
+	tests := []struct {
+		table  string
+		insert string
+	}{
+		{table: "starred_messages", insert: "INSERT INTO starred_messages(chat_id, user_id, message_id, message, created_at) VALUES(1, 1, 1, 'star', ?)"},
+		{table: "feedback", insert: "INSERT INTO feedback(chat_id, user_id, message_id, message, rating, comment, created_at) VALUES(1, 1, 1, '', 'good', '', ?)"},
+		{table: "chat_errors", insert: "INSERT INTO chat_errors(chat_id, message, created_at) VALUES(1, 'timeout', ?)"},
+		{table: "user_personas", insert: "INSERT INTO user_personas(user_id, prompt, created_at) VALUES(1, 'pirate', ?)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			db, migrator := newTestMigrator(t)
+			if err := migrator.Migrate(textTimeVersion); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(tt.insert, createdAt); err != nil {
+				t.Fatal(err)
+			}
+
+			// Migrating down and up again keeps the time too
+			for _, steps := range []int{1, -1, 1} {
+				if err := migrator.Steps(steps); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got int64
+			if err := db.QueryRow("SELECT created_at FROM " + tt.table).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if want := createdAt.UnixMilli(); got != want {
+				t.Errorf("created_at = %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+func init() {
+	// Encodings are embedded into the binary instead of being downloaded on the first use
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// tokenCounter returns the number of tokens the text takes in the model context.
+type tokenCounter func(text string) int
+
+// newTokenCounter returns the counter using the model's BPE encoding. If there is no encoding for the model,
+// tokens are estimated as one per byte, which overestimates ASCII text, so that prompts still fit into the context.
+func newTokenCounter(model string) tokenCounter {
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		slog.Warn("failed to load tokenizer, estimating one token per byte", "model", model, "error", err)
+		return countBytes
+	}
+	return func(text string) int {
+		return len(encoding.EncodeOrdinary(text))
+	}
+}
+
+func countBytes(text string) int {
+	return len(text)
+}
+
+// modelTokenCounters caches token counters by model, loading the encoding takes a while.
+var modelTokenCounters sync.Map
+
+// tokenCounterForModel returns the counter of the model created once, see newTokenCounter.
+func tokenCounterForModel(model string) tokenCounter {
+	if counter, ok := modelTokenCounters.Load(model); ok {
+		return counter.(tokenCounter)
+	}
+	counter, _ := modelTokenCounters.LoadOrStore(model, newTokenCounter(model))
+	return counter.(tokenCounter)
+}
+
+// tokenCounterFor returns the counter of the model the prompt is built for. Models the user switches to,
+// e.g. with /model or /think, may use another encoding than the configured one.
+func (p *messageProcessor) tokenCounterFor(model string) tokenCounter {
+	if model == p.model.name {
+		return p.countTokens
+	}
+	return tokenCounterForModel(model)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestTokenCounter(t *testing.T) {
+	const code = "```go\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```"
+
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{model: openai.GPT3Dot5Turbo, text: "Hello, world!", want: 4},
+		{model: openai.GPT3Dot5Turbo, text: "👍🎉", want: 6},
+		{model: openai.GPT3Dot5Turbo, text: "Привет, как дела?", want: 8},
+		{model: openai.GPT3Dot5Turbo, text: code, want: 14},
+		{model: openai.GPT3TextDavinci003, text: "👍🎉", want: 5},
+		{model: openai.GPT3TextDavinci003, text: "Привет, как дела?", want: 18},
+		{model: openai.GPT3TextDavinci003, text: code, want: 23},
+		{model: openai.GPT4o, text: "Привет, как дела?", want: 6},
+		// Tokens of the model without encoding are estimated by bytes
+		{model: "llama-3", text: "Привет, как дела?", want: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model+" "+tt.text, func(t *testing.T) {
+			if got := newTokenCounter(tt.model)(tt.text); got != tt.want {
+				t.Errorf("tokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptTokensAreCountedWithPromptModel(t *testing.T) {
+	const text = "Привет, как дела?"
+	p := &messageProcessor{model: chatModel{name: openai.GPT3Dot5Turbo}, countTokens: newTokenCounter(openai.GPT3Dot5Turbo)}
+
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{model: openai.GPT3Dot5Turbo, want: 8},
+		// Model the user switched to uses another encoding
+		{model: openai.GPT3TextDavinci003, want: 18},
+		{model: openai.GPT4o, want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := p.countPromptTokens(modelPrompt{model: tt.model, text: text}); got != tt.want {
+				t.Errorf("tokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
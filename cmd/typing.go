@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// typingActionInterval is how often the typing action is sent, Telegram shows it for about 5 seconds.
+const typingActionInterval = 4 * time.Second
+
+// startTyping shows that the bot is typing in the chat until the returned function is called
+// or the context is cancelled. The returned function waits for the typing action to stop,
+// so that the indicator isn't sent again after the reply.
+func (p *messageProcessor) startTyping(ctx context.Context, chatID int64) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(typingActionInterval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := p.bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)); err != nil {
+				slog.Error("failed to send typing action", "error", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	updatesReconnectInterval = 3 * time.Second
+
+	defaultUpdatesBufferSize = 1000
+)
+
+// checkUpdatesHealth is called when no updates arrived for too long, returns false if receiving updates is broken.
+// Silence is fine while Telegram API responds, it only means nobody writes to the bot.
+func (p *messageProcessor) checkUpdatesHealth() bool {
+	if _, err := p.bot.GetMe(); err != nil {
+		slog.Error("no Telegram updates and Telegram API doesn't respond, check the token and connectivity", "silence", p.updatesSilenceTimeout, "error", err)
+		p.updatesHealthy.Store(false)
+		return false
+	}
+	p.updatesHealthy.Store(true)
+	return true
+}
+
+// updatesSource returns the updates starting from the offset of the config, it is the bot.
+type updatesSource interface {
+	GetUpdates(config tgbotapi.UpdateConfig) ([]tgbotapi.Update, error)
+}
+
+// updatesPoller receives updates until it is stopped, its channel is closed once the request in flight is done.
+// Polling of the bot itself can't be started again once it is stopped, so reconnecting starts a new poller.
+type updatesPoller struct {
+	updates tgbotapi.UpdatesChannel
+	stop    context.CancelFunc
+}
+
+// pollUpdates receives updates starting from the offset until ctx is cancelled or the poller is stopped. Updates are
+// forwarded through the buffer of updatesBufferSize, so that Telegram is polled while the workers are busy.
+// Updates keep their order, the ones that don't fit into the full buffer are dropped.
+func (p *messageProcessor) pollUpdates(ctx context.Context, offset int) updatesPoller {
+	ctx, cancel := context.WithCancel(ctx)
+	updates := make(chan tgbotapi.Update, p.updatesBufferSize)
+
+	go func() {
+		defer close(updates)
+
+		config := tgbotapi.NewUpdate(offset)
+		config.Timeout = telegramBotUpdaterTimeoutSeconds
+		for ctx.Err() == nil {
+			batch, err := p.updatesSource.GetUpdates(config)
+			if err != nil {
+				slog.Warn("failed to get Telegram updates, retrying", "error", err)
+				select {
+				case <-time.After(updatesReconnectInterval):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			for _, update := range batch {
+				if update.UpdateID < config.Offset {
+					continue
+				}
+				config.Offset = update.UpdateID + 1
+
+				select {
+				case updates <- update:
+				default:
+					slog.Warn("updates buffer is full, dropped update", "update_id", update.UpdateID, "buffer_size", p.updatesBufferSize)
+					p.metrics.updateDropped()
+				}
+			}
+		}
+	}()
+	return updatesPoller{updates: updates, stop: cancel}
+}
+
+// newSilenceTimer returns timer which fires after the timeout, zero timeout disables it.
+func newSilenceTimer(timeout time.Duration) *time.Timer {
+	timer := time.NewTimer(timeout)
+	if timeout <= 0 {
+		timer.Stop()
+	}
+	return timer
+}
+
+func resetSilenceTimer(timer *time.Timer, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(timeout)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeUpdatesSource returns the batches in order, one per request, and then blocks each request until it is released.
+type fakeUpdatesSource struct {
+	mu      sync.Mutex
+	batches [][]tgbotapi.Update
+	offsets []int
+	release chan error
+	polled  chan int
+}
+
+func newFakeUpdatesSource(batches ...[]tgbotapi.Update) *fakeUpdatesSource {
+	return &fakeUpdatesSource{batches: batches, release: make(chan error), polled: make(chan int, 100)}
+}
+
+func (s *fakeUpdatesSource) GetUpdates(config tgbotapi.UpdateConfig) ([]tgbotapi.Update, error) {
+	s.mu.Lock()
+	s.offsets = append(s.offsets, config.Offset)
+	var batch []tgbotapi.Update
+	pending := len(s.batches) > 0
+	if pending {
+		batch, s.batches = s.batches[0], s.batches[1:]
+	}
+	s.mu.Unlock()
+
+	s.polled <- config.Offset
+	if pending {
+		return batch, nil
+	}
+	return nil, <-s.release
+}
+
+func updatesWithIDs(ids ...int) []tgbotapi.Update {
+	updates := make([]tgbotapi.Update, len(ids))
+	for i, id := range ids {
+		updates[i] = tgbotapi.Update{UpdateID: id}
+	}
+	return updates
+}
+
+func TestPollUpdates(t *testing.T) {
+	tests := []struct {
+		name       string
+		offset     int
+		batches    [][]tgbotapi.Update
+		bufferSize int
+		want       []int
+		// wantOffsets are the offsets of the requests before the poller blocks.
+		wantOffsets []int
+	}{
+		{
+			name:        "updates in order",
+			batches:     [][]tgbotapi.Update{updatesWithIDs(1, 2), updatesWithIDs(3)},
+			bufferSize:  10,
+			want:        []int{1, 2, 3},
+			wantOffsets: []int{0, 3, 4},
+		},
+		{
+			name:        "resumes from offset",
+			offset:      5,
+			batches:     [][]tgbotapi.Update{updatesWithIDs(4, 5, 6)},
+			bufferSize:  10,
+			want:        []int{5, 6},
+			wantOffsets: []int{5, 7},
+		},
+		{
+			name:        "drops updates that don't fit into the buffer",
+			batches:     [][]tgbotapi.Update{updatesWithIDs(1, 2, 3)},
+			bufferSize:  2,
+			want:        []int{1, 2},
+			wantOffsets: []int{0, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := newFakeUpdatesSource(tt.batches...)
+			p := &messageProcessor{updatesSource: source, updatesBufferSize: tt.bufferSize}
+
+			poller := p.pollUpdates(context.Background(), tt.offset)
+			for range tt.wantOffsets {
+				<-source.polled
+			}
+			poller.stop()
+			close(source.release)
+
+			var got []int
+			for update := range poller.updates {
+				got = append(got, update.UpdateID)
+			}
+			if !equalInts(got, tt.want) {
+				t.Errorf("updates = %v, want %v", got, tt.want)
+			}
+			if !equalInts(source.offsets, tt.wantOffsets) {
+				t.Errorf("offsets = %v, want %v", source.offsets, tt.wantOffsets)
+			}
+		})
+	}
+}
+
+func TestPollUpdatesRetriesFailedRequest(t *testing.T) {
+	source := newFakeUpdatesSource()
+	p := &messageProcessor{updatesSource: source, updatesBufferSize: 1}
+	poller := p.pollUpdates(context.Background(), 1)
+	defer close(source.release)
+
+	<-source.polled
+	source.release <- errors.New("network is down")
+	select {
+	case offset := <-source.polled:
+		if offset != 1 {
+			t.Errorf("offset of the retry = %d, want 1", offset)
+		}
+	case <-time.After(2 * updatesReconnectInterval):
+		t.Fatal("failed request is not retried")
+	}
+
+	poller.stop()
+	source.release <- errors.New("network is down")
+	if _, ok := <-poller.updates; ok {
+		t.Error("updates channel is not closed after the poller is stopped")
+	}
+}
+
+func TestProcessIncomingMessagesReconnectsAfterSilence(t *testing.T) {
+	bot := newTestBot(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`)
+	})
+	source := newFakeUpdatesSource(updatesWithIDs(7))
+	p := &messageProcessor{
+		bot:                   bot,
+		updatesSource:         source,
+		updatesBufferSize:     10,
+		updatesSilenceTimeout: 50 * time.Millisecond,
+		workerCount:           1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go p.processIncomingMessages(ctx, context.Background(), done)
+	defer func() {
+		cancel()
+		close(source.release)
+		<-done
+	}()
+
+	if offset := <-source.polled; offset != 0 {
+		t.Fatalf("offset of the first request = %d, want 0", offset)
+	}
+	// Poll hangs after the first update until the client times out, Telegram API doesn't respond meanwhile
+	if offset := <-source.polled; offset != 8 {
+		t.Fatalf("offset of the second request = %d, want 8", offset)
+	}
+	time.Sleep(3 * p.updatesSilenceTimeout)
+	source.release <- errors.New("timeout")
+
+	// Stopped poller doesn't retry, the new one resumes right after the last received update
+	select {
+	case offset := <-source.polled:
+		if offset != 8 {
+			t.Errorf("offset after reconnecting = %d, want 8", offset)
+		}
+	case <-time.After(updatesReconnectInterval / 2):
+		t.Fatal("updates polling is not restarted after silence")
+	}
+	if p.updatesHealthy.Load() {
+		t.Error("updates are healthy while Telegram API doesn't respond")
+	}
+}
+
+// burstSource returns the bursts of updates of the users in turn, one burst per request after the interval,
+// each update carries its sequence number within the messages of the user. Then it blocks each request until it is released.
+type burstSource struct {
+	bursts, burstSize, users int
+	interval                 time.Duration
+	nextID                   int
+	release                  chan struct{}
+	// drained is closed once all bursts are returned.
+	drained chan struct{}
+}
+
+func (s *burstSource) GetUpdates(config tgbotapi.UpdateConfig) ([]tgbotapi.Update, error) {
+	if s.bursts == 0 {
+		close(s.drained)
+		<-s.release
+		return nil, errors.New("released")
+	}
+	s.bursts--
+	time.Sleep(s.interval)
+
+	batch := make([]tgbotapi.Update, s.burstSize)
+	for i := range batch {
+		s.nextID++
+		userID := s.nextID%s.users + 1
+		batch[i] = tgbotapi.Update{UpdateID: s.nextID, Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: userID},
+			Chat: &tgbotapi.Chat{ID: int64(userID), Type: "private"},
+			Text: strconv.Itoa(s.nextID / s.users),
+		}}
+	}
+	return batch, nil
+}
+
+// BenchmarkPollUpdatesBursts feeds bursts of updates through the buffer to the processor that keeps up with them
+// on average, but not within the burst. Updates of the burst that doesn't fit into the buffer are dropped,
+// the ones that are received keep the order of each user.
+func BenchmarkPollUpdatesBursts(b *testing.B) {
+	const (
+		burstSize     = 200
+		burstInterval = 10 * time.Millisecond
+		users         = 10
+		// Processor takes a millisecond per processBatch updates, shorter sleeps take about as long anyway
+		processBatch = 50
+	)
+
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	for _, bufferSize := range []int{50, defaultUpdatesBufferSize} {
+		b.Run(fmt.Sprintf("buffer %d", bufferSize), func(b *testing.B) {
+			var logs bytes.Buffer
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			source := &burstSource{bursts: b.N, burstSize: burstSize, users: users, interval: burstInterval, release: make(chan struct{}), drained: make(chan struct{})}
+			p := &messageProcessor{updatesSource: source, updatesBufferSize: bufferSize}
+
+			b.ResetTimer()
+			poller := p.pollUpdates(context.Background(), 0)
+			go func() {
+				<-source.drained
+				poller.stop()
+				close(source.release)
+			}()
+
+			received := 0
+			last := make(map[int]int)
+			for update := range poller.updates {
+				if received++; received%processBatch == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				seq, _ := strconv.Atoi(update.Message.Text)
+				if prev, ok := last[update.Message.From.ID]; ok && seq <= prev {
+					b.Fatalf("update %d of user %d is received after %d", seq, update.Message.From.ID, prev)
+				}
+				last[update.Message.From.ID] = seq
+			}
+			b.StopTimer()
+
+			dropped := strings.Count(logs.String(), "updates buffer is full")
+			if total := b.N * burstSize; received+dropped != total {
+				b.Errorf("received %d and dropped %d of %d updates", received, dropped, total)
+			}
+			if bufferSize < burstSize && dropped == 0 {
+				b.Error("no updates are dropped from the buffer smaller than the burst")
+			}
+			b.ReportMetric(float64(dropped)/float64(b.N*burstSize), "dropped/update")
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
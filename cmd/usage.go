@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	commandUsage = "usage"
+
+	// defaultTokenPricePer1K is the price of gpt-3.5-turbo in US dollars.
+	defaultTokenPricePer1K = 0.002
+)
+
+// tokenUsage is the number of tokens used by replies to the user over a period.
+type tokenUsage struct {
+	prompt     int64
+	completion int64
+	total      int64
+}
+
+// cost returns the estimated cost of the tokens in US dollars.
+func (u tokenUsage) cost(pricePer1K float64) float64 {
+	return float64(u.total) / 1000 * pricePer1K
+}
+
+// handleUsageCommand replies with how many tokens the user spent over the last day and week and what they cost.
+func (p *messageProcessor) handleUsageCommand(ctx context.Context, update tgbotapi.Update, parseMode string) {
+	now := time.Now()
+	periods := []struct {
+		name  string
+		since time.Time
+	}{
+		{"day", now.AddDate(0, 0, -1)},
+		{"week", now.AddDate(0, 0, -7)},
+	}
+
+	lines := make([]string, 0, len(periods)+1)
+	for _, period := range periods {
+		usage, err := p.messages.TokenUsage(ctx, conversationOwnerID(update.Message), period.since)
+		if err != nil {
+			slog.Error("failed to get token usage", "error", err)
+			p.sendErrorMessage(ctx, update, parseMode, err)
+			return
+		}
+		lines = append(lines, fmt.Sprintf("Last %v: %d tokens (%d in prompts, %d in replies), about $%.4f.",
+			period.name, usage.total, usage.prompt, usage.completion, usage.cost(p.tokenPricePer1K)))
+	}
+	lines = append(lines, fmt.Sprintf("The cost is estimated at $%v per 1000 tokens, only messages kept in the conversation history are counted.", p.tokenPricePer1K))
+
+	sendTextMessage(p.bot, update.Message.Chat.ID, "", strings.Join(lines, "\n"))
+}
+
+func getTokenUsage(ctx context.Context, db *sql.DB, ownerID int, since time.Time) (tokenUsage, error) {
+	const query = `
+		SELECT COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(total_tokens), 0)
+		FROM chat_history
+		WHERE owner_id = ? AND created_at >= ?
+	`
+
+	var usage tokenUsage
+	if err := db.QueryRowContext(ctx, query, ownerID, since.UnixMilli()).Scan(&usage.prompt, &usage.completion, &usage.total); err != nil {
+		return tokenUsage{}, fmt.Errorf("failed to get token usage from the database: %w", err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseUserIDs parses comma-separated list of Telegram user IDs, the first one is the administrator.
+// Empty list allows no one.
+func parseUserIDs(list string) (allowed map[int]struct{}, adminID int, err error) {
+	allowed = make(map[int]struct{})
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid user ID '%v': %w", field, err)
+		}
+		if len(allowed) == 0 {
+			adminID = id
+		}
+		allowed[id] = struct{}{}
+	}
+	return allowed, adminID, nil
+}
+
+// isAllowedUser reports whether the user may talk to the bot.
+func (p *messageProcessor) isAllowedUser(userID int) bool {
+	_, ok := p.allowedUserIDs[userID]
+	return ok
+}
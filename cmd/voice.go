@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// voiceFileSizeMax is the largest audio file OpenAI transcription API accepts.
+const voiceFileSizeMax = 25 << 20
+
+var errVoiceTooLarge = fmt.Errorf("voice message is larger than %d MB", voiceFileSizeMax>>20)
+
+var voiceTooLargeMessage = fmt.Sprintf("Sorry, the voice message is too long, at most %d MB can be transcribed. Please split it into shorter ones.", voiceFileSizeMax>>20)
+
+// transcribeVoice returns the text of the voice message, so that it is answered as if the user had typed it.
+func (p *messageProcessor) transcribeVoice(ctx context.Context, voice *tgbotapi.Voice) (string, error) {
+	if voice.FileSize > voiceFileSizeMax {
+		return "", errVoiceTooLarge
+	}
+
+	// File size is optional in the message, so the downloaded file is checked again
+	data, err := p.downloadFile(ctx, voice.FileID, voiceFileSizeMax+1)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > voiceFileSizeMax {
+		return "", errVoiceTooLarge
+	}
+
+	requestCtx, cancel := p.withOpenAITimeout(ctx)
+	defer cancel()
+
+	resp, err := p.gptClient.CreateTranscription(requestCtx, openai.AudioRequest{
+		Model:    openai.Whisper1,
+		FilePath: "voice.ogg",
+		Reader:   bytes.NewReader(data),
+		Language: p.voiceLanguage,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to transcribe voice message: %w", err)
+	}
+
+	text := strings.TrimSpace(resp.Text)
+	if text == "" {
+		return "", errors.New("voice message has no speech")
+	}
+	return text, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	defaultWorkerCount = 1
+
+	// workerQueueSize is how many messages may wait for a busy worker before receiving of updates is blocked.
+	workerQueueSize = 64
+)
+
+// workerPool processes messages of different conversations concurrently. Messages of the conversation
+// are always processed by the same worker, so that they are answered in the order they are sent.
+type workerPool struct {
+	queues []chan tgbotapi.Update
+	wg     sync.WaitGroup
+}
+
+// startWorkers starts count workers that process messages with ctx until the pool is stopped.
+// Messages still queued when ctxRun is cancelled are dropped, only the ones being processed are answered.
+func (p *messageProcessor) startWorkers(ctxRun context.Context, ctx context.Context, count int) *workerPool {
+	pool := &workerPool{queues: make([]chan tgbotapi.Update, count)}
+	for i := range pool.queues {
+		queue := make(chan tgbotapi.Update, workerQueueSize)
+		pool.queues[i] = queue
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for update := range queue {
+				if ctxRun.Err() != nil {
+					continue
+				}
+				p.processUpdateOnce(ctx, update)
+			}
+		}()
+	}
+	return pool
+}
+
+// dispatch queues the update to the worker of its conversation, waiting while the queue is full until ctxRun is cancelled.
+func (w *workerPool) dispatch(ctxRun context.Context, update tgbotapi.Update) {
+	queue := w.queues[uint(conversationOwnerID(update.Message))%uint(len(w.queues))]
+	select {
+	case queue <- update:
+	case <-ctxRun.Done():
+	}
+}
+
+// stop waits until the workers finish processing and returns.
+func (w *workerPool) stop() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
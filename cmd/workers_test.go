@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestWorkerPoolServesUsersInParallel(t *testing.T) {
+	const replyTime = 300 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		workers int
+		userIDs []int
+		// wantConcurrent is the largest number of replies generated at once.
+		wantConcurrent int
+	}{
+		{name: "two users with two workers", workers: 2, userIDs: []int{1, 2}, wantConcurrent: 2},
+		{name: "two users with one worker", workers: 1, userIDs: []int{1, 2}, wantConcurrent: 1},
+		{name: "messages of the user are answered in order", workers: 2, userIDs: []int{1, 1}, wantConcurrent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := &fakeChatCompletions{replies: []openai.ChatCompletionChoice{chatChoice("the answer", openai.FinishReasonStop)}}
+			p := newTestProcessor(t, &fakeTelegram{}, completions)
+			var (
+				mu                    sync.Mutex
+				inFlight, maxInFlight int
+			)
+			p.gptClient = newTestOpenAIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				inFlight++
+				maxInFlight = max(maxInFlight, inFlight)
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+				}()
+
+				time.Sleep(replyTime)
+				completions.handle(w, r)
+			})
+
+			ctx := context.Background()
+			pool := p.startWorkers(ctx, ctx, tt.workers)
+			start := time.Now()
+			for i, userID := range tt.userIDs {
+				update := privateMessage(userID, "hello")
+				update.UpdateID = i + 1
+				pool.dispatch(ctx, update)
+			}
+			pool.stop()
+			elapsed := time.Since(start)
+
+			if got := maxInFlight; got != tt.wantConcurrent {
+				t.Errorf("replies generated at once = %d, want %d", got, tt.wantConcurrent)
+			}
+			if got := len(completions.requests); got != len(tt.userIDs) {
+				t.Errorf("requests = %d, want %d", got, len(tt.userIDs))
+			}
+			if serial := time.Duration(len(tt.userIDs)) * replyTime; (elapsed < serial) != (tt.wantConcurrent > 1) {
+				t.Errorf("messages are answered in %v, answering them one by one takes %v", elapsed, serial)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS daily_message_counts (
+    user_id INTEGER NOT NULL,
+    day TEXT NOT NULL,
+    count INTEGER NOT NULL,
+    PRIMARY KEY (user_id, day)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS message_tags (
+    message_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (message_id, tag)
+);
+CREATE INDEX IF NOT EXISTS message_tags_tag ON message_tags (tag);
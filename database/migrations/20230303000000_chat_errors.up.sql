@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS chat_errors (
+    chat_id INTEGER PRIMARY KEY,
+    message TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
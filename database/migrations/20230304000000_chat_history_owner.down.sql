@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS chat_history_owner_id;
+ALTER TABLE chat_history DROP COLUMN owner_id;
@@ -0,0 +1,8 @@
+ALTER TABLE chat_history ADD COLUMN owner_id INTEGER NOT NULL DEFAULT 0;
+UPDATE chat_history SET owner_id = user_id WHERE user_id != 0;
+UPDATE chat_history SET owner_id = COALESCE((
+    SELECT h.user_id FROM chat_history h
+    WHERE h.user_id != 0 AND h.id < chat_history.id
+    ORDER BY h.id DESC LIMIT 1
+), 0) WHERE user_id = 0;
+CREATE INDEX IF NOT EXISTS chat_history_owner_id ON chat_history (owner_id, created_at);
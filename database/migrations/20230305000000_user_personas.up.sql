@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS user_personas (
+    user_id INTEGER PRIMARY KEY,
+    prompt TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
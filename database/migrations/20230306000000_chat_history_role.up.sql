@@ -0,0 +1,2 @@
+ALTER TABLE chat_history ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+UPDATE chat_history SET role = 'assistant' WHERE user_id = 0;
@@ -0,0 +1,15 @@
+CREATE TABLE chat_history_text_time (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    username TEXT NOT NULL,
+    message TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    owner_id INTEGER NOT NULL DEFAULT 0,
+    role TEXT NOT NULL DEFAULT 'user'
+);
+INSERT INTO chat_history_text_time (id, user_id, username, message, created_at, owner_id, role)
+SELECT id, user_id, username, message, strftime('%Y-%m-%d %H:%M:%f+00:00', created_at / 1000.0, 'unixepoch'), owner_id, role
+FROM chat_history;
+DROP TABLE chat_history;
+ALTER TABLE chat_history_text_time RENAME TO chat_history;
+CREATE INDEX IF NOT EXISTS chat_history_owner_id ON chat_history (owner_id, created_at);
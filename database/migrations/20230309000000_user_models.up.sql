@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS user_models (
+    user_id INTEGER PRIMARY KEY,
+    model TEXT NOT NULL
+);
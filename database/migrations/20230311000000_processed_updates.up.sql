@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS processed_updates (
+    owner_id INTEGER PRIMARY KEY,
+    update_id INTEGER NOT NULL
+);
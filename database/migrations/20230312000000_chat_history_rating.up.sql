@@ -0,0 +1 @@
+ALTER TABLE chat_history ADD COLUMN rating TEXT;
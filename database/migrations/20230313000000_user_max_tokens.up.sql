@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS user_max_tokens (
+    user_id INTEGER PRIMARY KEY,
+    max_tokens INTEGER NOT NULL
+);
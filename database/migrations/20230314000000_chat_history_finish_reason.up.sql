@@ -0,0 +1 @@
+ALTER TABLE chat_history ADD COLUMN finish_reason TEXT;
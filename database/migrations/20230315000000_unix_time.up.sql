@@ -0,0 +1,49 @@
+CREATE TABLE starred_messages_unix_time (
+    id INTEGER PRIMARY KEY,
+    chat_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    message TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    UNIQUE (chat_id, message_id)
+);
+INSERT INTO starred_messages_unix_time (id, chat_id, user_id, message_id, message, created_at)
+SELECT id, chat_id, user_id, message_id, message, CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER)
+FROM starred_messages;
+DROP TABLE starred_messages;
+ALTER TABLE starred_messages_unix_time RENAME TO starred_messages;
+CREATE TABLE feedback_unix_time (
+    id INTEGER PRIMARY KEY,
+    chat_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    message TEXT NOT NULL,
+    rating TEXT NOT NULL,
+    comment TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+INSERT INTO feedback_unix_time (id, chat_id, user_id, message_id, message, rating, comment, created_at)
+SELECT id, chat_id, user_id, message_id, message, rating, comment, CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER)
+FROM feedback;
+DROP TABLE feedback;
+ALTER TABLE feedback_unix_time RENAME TO feedback;
+CREATE TABLE chat_errors_unix_time (
+    chat_id INTEGER PRIMARY KEY,
+    message TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+INSERT INTO chat_errors_unix_time (chat_id, message, created_at)
+SELECT chat_id, message, CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER)
+FROM chat_errors;
+DROP TABLE chat_errors;
+ALTER TABLE chat_errors_unix_time RENAME TO chat_errors;
+CREATE TABLE user_personas_unix_time (
+    user_id INTEGER PRIMARY KEY,
+    prompt TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+INSERT INTO user_personas_unix_time (user_id, prompt, created_at)
+SELECT user_id, prompt, CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER)
+FROM user_personas;
+DROP TABLE user_personas;
+ALTER TABLE user_personas_unix_time RENAME TO user_personas;
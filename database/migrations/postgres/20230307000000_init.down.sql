@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS user_personas;
+DROP TABLE IF EXISTS chat_errors;
+DROP TABLE IF EXISTS feedback;
+DROP TABLE IF EXISTS starred_messages;
+DROP TABLE IF EXISTS message_tags;
+DROP TABLE IF EXISTS daily_message_counts;
+DROP TABLE IF EXISTS chat_settings;
+DROP TABLE IF EXISTS chat_history;
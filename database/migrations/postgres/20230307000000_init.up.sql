@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS chat_history (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    owner_id BIGINT NOT NULL DEFAULT 0,
+    role TEXT NOT NULL DEFAULT 'user',
+    username TEXT NOT NULL,
+    message TEXT NOT NULL,
+    created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chat_history_owner_id ON chat_history (owner_id, created_at);
+
+CREATE TABLE IF NOT EXISTS chat_settings (
+    chat_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (chat_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS daily_message_counts (
+    user_id BIGINT NOT NULL,
+    day TEXT NOT NULL,
+    count INTEGER NOT NULL,
+    PRIMARY KEY (user_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS message_tags (
+    message_id BIGINT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (message_id, tag)
+);
+CREATE INDEX IF NOT EXISTS message_tags_tag ON message_tags (tag);
+
+CREATE TABLE IF NOT EXISTS starred_messages (
+    id BIGSERIAL PRIMARY KEY,
+    chat_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    message_id BIGINT NOT NULL,
+    message TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    UNIQUE (chat_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS feedback (
+    id BIGSERIAL PRIMARY KEY,
+    chat_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    message_id BIGINT NOT NULL,
+    message TEXT NOT NULL,
+    rating TEXT NOT NULL,
+    comment TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chat_errors (
+    chat_id BIGINT PRIMARY KEY,
+    message TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_personas (
+    user_id BIGINT PRIMARY KEY,
+    prompt TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
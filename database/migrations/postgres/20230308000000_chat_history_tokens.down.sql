@@ -0,0 +1,3 @@
+ALTER TABLE chat_history DROP COLUMN total_tokens;
+ALTER TABLE chat_history DROP COLUMN completion_tokens;
+ALTER TABLE chat_history DROP COLUMN prompt_tokens;
@@ -0,0 +1,3 @@
+ALTER TABLE chat_history ADD COLUMN prompt_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chat_history ADD COLUMN completion_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chat_history ADD COLUMN total_tokens INTEGER NOT NULL DEFAULT 0;
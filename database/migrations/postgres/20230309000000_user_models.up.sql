@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS user_models (
+    user_id BIGINT PRIMARY KEY,
+    model TEXT NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS conversation_summaries (
+    owner_id BIGINT NOT NULL,
+    tag TEXT NOT NULL,
+    summary TEXT NOT NULL,
+    through_message_id BIGINT NOT NULL,
+    PRIMARY KEY (owner_id, tag)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS processed_updates (
+    owner_id BIGINT PRIMARY KEY,
+    update_id BIGINT NOT NULL
+);
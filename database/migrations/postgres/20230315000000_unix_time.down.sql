@@ -0,0 +1,4 @@
+ALTER TABLE starred_messages ALTER COLUMN created_at TYPE TEXT USING to_char(to_timestamp(created_at / 1000.0) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.MS') || '+00:00';
+ALTER TABLE feedback ALTER COLUMN created_at TYPE TEXT USING to_char(to_timestamp(created_at / 1000.0) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.MS') || '+00:00';
+ALTER TABLE chat_errors ALTER COLUMN created_at TYPE TEXT USING to_char(to_timestamp(created_at / 1000.0) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.MS') || '+00:00';
+ALTER TABLE user_personas ALTER COLUMN created_at TYPE TEXT USING to_char(to_timestamp(created_at / 1000.0) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.MS') || '+00:00';
@@ -0,0 +1,4 @@
+ALTER TABLE starred_messages ALTER COLUMN created_at TYPE BIGINT USING CAST(ROUND(EXTRACT(EPOCH FROM CAST(created_at AS TIMESTAMPTZ)) * 1000) AS BIGINT);
+ALTER TABLE feedback ALTER COLUMN created_at TYPE BIGINT USING CAST(ROUND(EXTRACT(EPOCH FROM CAST(created_at AS TIMESTAMPTZ)) * 1000) AS BIGINT);
+ALTER TABLE chat_errors ALTER COLUMN created_at TYPE BIGINT USING CAST(ROUND(EXTRACT(EPOCH FROM CAST(created_at AS TIMESTAMPTZ)) * 1000) AS BIGINT);
+ALTER TABLE user_personas ALTER COLUMN created_at TYPE BIGINT USING CAST(ROUND(EXTRACT(EPOCH FROM CAST(created_at AS TIMESTAMPTZ)) * 1000) AS BIGINT);